@@ -0,0 +1,365 @@
+// Package asm assembles the textual form of bytecode into compiler.Bytecode.
+//
+// The format is the one written by package disasm:
+//
+//	.main
+//		OpConstant 0         ; comments run to the end of the line
+//		OpJumpNotTruthy done
+//		OpNull
+//	done:
+//		OpPop
+//	.end
+//
+//	.constant 0 Integer 1
+//	.constant 1 String "monkey"
+//
+//	.function 2 "add" parameters=2 locals=2
+//		OpGetLocal 0
+//		OpGetLocal 1
+//		OpAdd
+//		OpReturnValue
+//	.end
+//
+// An instruction may be prefixed by its offset, as disasm does; the prefix is ignored so that
+// instructions can be inserted without renumbering the others. Labels are local to the block
+// which defines them and can be used as the operand of OpJump and OpJumpNotTruthy.
+// Constant indices must cover the constant pool without gaps.
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/token"
+)
+
+// Assemble assembles src into bytecode.
+func Assemble(src string) (compiler.Bytecode, error) {
+	return AssembleFile("", src)
+}
+
+// AssembleFile assembles src read from filename. Errors are reported as *token.Error at the offending position.
+func AssembleFile(filename, src string) (compiler.Bytecode, error) {
+	a := &assembler{filename: filename, constants: make(map[int]object.Object)}
+	offset := 0
+	for i, line := range strings.SplitAfter(src, "\n") {
+		a.line, a.lineOffset = i+1, offset
+		offset += len(line)
+		if err := a.assembleLine(strings.TrimRight(line, "\r\n")); err != nil {
+			return compiler.Bytecode{}, err
+		}
+	}
+	if a.block != nil {
+		return compiler.Bytecode{}, a.errorf(a.block.start, "%s is not closed by .end", a.block.directive)
+	}
+
+	constants := make([]object.Object, len(a.constants))
+	for i := range constants {
+		c, ok := a.constants[i]
+		if !ok {
+			return compiler.Bytecode{}, a.errorf(token.Position{Filename: filename}, "constant %d is not defined", i)
+		}
+		constants[i] = c
+	}
+	if len(constants) == 0 {
+		constants = nil
+	}
+	return compiler.Bytecode{Instructions: a.main, Constants: constants}, nil
+}
+
+type field struct {
+	text string
+	pos  token.Position
+}
+
+type instruction struct {
+	pos      token.Position
+	op       code.Opcode
+	def      code.Definition
+	operands []int64
+	labels   map[int]field // operand index to the label used for it
+}
+
+// block is a .main or .function directive being assembled.
+type block struct {
+	directive    string
+	start        token.Position
+	index        int // constant index of a function
+	fn           object.CompiledFunction
+	instructions []instruction
+	size         int
+	labels       map[string]int
+}
+
+type assembler struct {
+	filename   string
+	line       int
+	lineOffset int
+
+	block     *block
+	main      code.Instructions
+	mainSeen  bool
+	constants map[int]object.Object
+}
+
+func (a *assembler) errorf(pos token.Position, format string, args ...any) error {
+	return &token.Error{Pos: pos, Err: fmt.Errorf(format, args...)}
+}
+
+// fields splits line into whitespace separated fields, keeping quoted strings together and dropping comments.
+func (a *assembler) fields(line string) ([]field, error) {
+	var result []field
+	col := 0
+	for {
+		trimmed := strings.TrimLeft(line[col:], " \t")
+		col = len(line) - len(trimmed)
+		pos := token.Position{Filename: a.filename, Offset: a.lineOffset + col, Line: a.line, Column: col + 1}
+		if trimmed == "" || trimmed[0] == ';' {
+			return result, nil
+		}
+		if trimmed[0] == '"' {
+			q, err := strconv.QuotedPrefix(trimmed)
+			if err != nil {
+				return nil, a.errorf(pos, "invalid string literal")
+			}
+			result = append(result, field{text: q, pos: pos})
+			col += len(q)
+			continue
+		}
+		end := strings.IndexAny(trimmed, " \t;")
+		if end < 0 {
+			end = len(trimmed)
+		}
+		result = append(result, field{text: trimmed[:end], pos: pos})
+		col += end
+	}
+}
+
+func (a *assembler) assembleLine(line string) error {
+	fields, err := a.fields(line)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	head := fields[0]
+	switch {
+	case strings.HasPrefix(head.text, "."):
+		return a.directive(fields)
+	case strings.HasSuffix(head.text, ":") && len(fields) == 1:
+		return a.label(head)
+	default:
+		return a.instruction(fields)
+	}
+}
+
+func (a *assembler) directive(fields []field) error {
+	head := fields[0]
+	if head.text != ".end" && a.block != nil {
+		return a.errorf(head.pos, "%s inside %s", head.text, a.block.directive)
+	}
+	switch head.text {
+	case ".main":
+		if len(fields) != 1 {
+			return a.errorf(fields[1].pos, "unexpected %s after .main", fields[1].text)
+		}
+		if a.mainSeen {
+			return a.errorf(head.pos, ".main is already defined")
+		}
+		a.mainSeen = true
+		a.block = &block{directive: head.text, start: head.pos, labels: make(map[string]int)}
+	case ".function":
+		return a.function(fields)
+	case ".constant":
+		return a.constant(fields)
+	case ".end":
+		return a.end(head)
+	default:
+		return a.errorf(head.pos, "unknown directive %s", head.text)
+	}
+	return nil
+}
+
+func (a *assembler) constantIndex(f field) (int, error) {
+	idx, err := strconv.Atoi(f.text)
+	if err != nil || idx < 0 {
+		return 0, a.errorf(f.pos, "invalid constant index %s", f.text)
+	}
+	if _, ok := a.constants[idx]; ok {
+		return 0, a.errorf(f.pos, "constant %d is already defined", idx)
+	}
+	return idx, nil
+}
+
+func (a *assembler) constant(fields []field) error {
+	if len(fields) != 4 {
+		return a.errorf(fields[0].pos, "usage: .constant INDEX TYPE VALUE")
+	}
+	idx, err := a.constantIndex(fields[1])
+	if err != nil {
+		return err
+	}
+	value := fields[3]
+	switch fields[2].text {
+	case "Integer":
+		v, err := strconv.ParseInt(value.text, 10, 64)
+		if err != nil {
+			return a.errorf(value.pos, "invalid integer %s", value.text)
+		}
+		a.constants[idx] = object.Integer{Value: v}
+	case "String":
+		v, err := strconv.Unquote(value.text)
+		if err != nil || !strings.HasPrefix(value.text, `"`) {
+			return a.errorf(value.pos, "invalid string %s", value.text)
+		}
+		a.constants[idx] = object.String{Value: v}
+	default:
+		return a.errorf(fields[2].pos, "unsupported constant type %s", fields[2].text)
+	}
+	return nil
+}
+
+func (a *assembler) function(fields []field) error {
+	if len(fields) < 3 {
+		return a.errorf(fields[0].pos, `usage: .function INDEX "NAME" [parameters=N] [locals=N]`)
+	}
+	idx, err := a.constantIndex(fields[1])
+	if err != nil {
+		return err
+	}
+	name, err := strconv.Unquote(fields[2].text)
+	if err != nil || !strings.HasPrefix(fields[2].text, `"`) {
+		return a.errorf(fields[2].pos, "invalid function name %s", fields[2].text)
+	}
+	fn := object.CompiledFunction{Name: name}
+	for _, f := range fields[3:] {
+		key, value, _ := strings.Cut(f.text, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return a.errorf(f.pos, "invalid %s", f.text)
+		}
+		switch key {
+		case "parameters":
+			fn.NumParameters = n
+		case "locals":
+			fn.NumLocals = n
+		default:
+			return a.errorf(f.pos, "unknown attribute %s", key)
+		}
+	}
+	// reserve the index so that it cannot be defined twice
+	a.constants[idx] = fn
+	a.block = &block{directive: fields[0].text, start: fields[0].pos, index: idx, fn: fn, labels: make(map[string]int)}
+	return nil
+}
+
+func (a *assembler) end(head field) error {
+	if a.block == nil {
+		return a.errorf(head.pos, ".end without .main or .function")
+	}
+	ins, err := a.encode(a.block)
+	if err != nil {
+		return err
+	}
+	if a.block.directive == ".main" {
+		a.main = ins
+	} else {
+		a.block.fn.Instructions = ins
+		a.constants[a.block.index] = a.block.fn
+	}
+	a.block = nil
+	return nil
+}
+
+func (a *assembler) label(f field) error {
+	if a.block == nil {
+		return a.errorf(f.pos, "label outside of .main or .function")
+	}
+	name := strings.TrimSuffix(f.text, ":")
+	if name == "" {
+		return a.errorf(f.pos, "empty label")
+	}
+	if _, ok := a.block.labels[name]; ok {
+		return a.errorf(f.pos, "label %s is already defined", name)
+	}
+	a.block.labels[name] = a.block.size
+	return nil
+}
+
+func (a *assembler) instruction(fields []field) error {
+	if a.block == nil {
+		return a.errorf(fields[0].pos, "instruction outside of .main or .function")
+	}
+	// skip the offset written by disasm
+	if _, err := strconv.Atoi(fields[0].text); err == nil {
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return nil
+		}
+	}
+
+	head := fields[0]
+	op, def, err := code.LookupByName(head.text)
+	if err != nil {
+		return a.errorf(head.pos, "unknown opcode %s", head.text)
+	}
+	args := fields[1:]
+	if len(args) != len(def.OperandWitdth) {
+		return a.errorf(head.pos, "%s takes %d operands, got %d", def.Name, len(def.OperandWitdth), len(args))
+	}
+
+	in := instruction{pos: head.pos, op: op, def: def, operands: make([]int64, len(args))}
+	for i, arg := range args {
+		v, err := strconv.ParseInt(arg.text, 10, 64)
+		if err != nil {
+			if i != 0 || !code.IsJump(op) {
+				return a.errorf(arg.pos, "invalid operand %s", arg.text)
+			}
+			if in.labels == nil {
+				in.labels = make(map[int]field)
+			}
+			in.labels[i] = arg
+			continue
+		}
+		if max := int64(1)<<(8*def.OperandWitdth[i]) - 1; v < 0 || max < v {
+			return a.errorf(arg.pos, "operand %d of %s out of range [0, %d]", v, def.Name, max)
+		}
+		in.operands[i] = v
+	}
+
+	a.block.instructions = append(a.block.instructions, in)
+	a.block.size += 1
+	for _, w := range def.OperandWitdth {
+		a.block.size += w
+	}
+	return nil
+}
+
+// encode resolves the labels of b and encodes its instructions.
+func (a *assembler) encode(b *block) (code.Instructions, error) {
+	ins := make(code.Instructions, 0, b.size)
+	for _, in := range b.instructions {
+		for i, l := range in.labels {
+			target, ok := b.labels[l.text]
+			if !ok {
+				return nil, a.errorf(l.pos, "undefined label %s", l.text)
+			}
+			if max := 1<<(8*in.def.OperandWitdth[i]) - 1; max < target {
+				return nil, a.errorf(l.pos, "label %s at %d is out of range [0, %d]", l.text, target, max)
+			}
+			in.operands[i] = int64(target)
+		}
+		made, err := code.Make(in.op, in.operands...)
+		if err != nil {
+			return nil, a.errorf(in.pos, "code.Make: %w", err)
+		}
+		ins = append(ins, made...)
+	}
+	return ins, nil
+}
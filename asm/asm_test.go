@@ -0,0 +1,164 @@
+package asm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Warashi/monkey/asm"
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/disasm"
+	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/parser"
+	. "github.com/Warashi/monkey/testutil"
+	"github.com/Warashi/monkey/token"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the listing does not carry source maps nor global names
+var ignoreDebugInfo = cmp.Options{
+	cmpopts.IgnoreFields(compiler.Bytecode{}, "SourceMap", "Globals"),
+	cmpopts.IgnoreFields(object.CompiledFunction{}, "SourceMap"),
+	cmpopts.EquateEmpty(),
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"arithmetic", "1 + 2 * -3; 10 / 5 - 9223372036854775807"},
+		{"strings", "\"mon\" + \"k\te\ny\""},
+		{"conditionals", "if (1 > 2) { 10 } else { if (true) { 20 } }; if (false) { 30 }"},
+		{"composite", `let h = {"one": [1, 2], 2: "two"}; h["one"][0]`},
+		{"closures", "let newAdder = fn(a, b) { fn(c) { a + b + c }; }; let adder = newAdder(1, 2); adder(8);"},
+		{"recursive", "let fib = fn(n) { if (n < 2) { return n; } fib(n - 1) + fib(n - 2) }; puts(fib(10));"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p := parser.New(lexer.New(tt.input))
+			program := p.Parse()
+			require.Empty(t, p.Errors())
+			c := compiler.New()
+			require.NoError(t, c.Compile(program))
+			want := c.Bytecode()
+
+			var listing strings.Builder
+			require.NoError(t, disasm.Disassemble(&listing, want))
+
+			got, err := asm.Assemble(listing.String())
+			require.NoError(t, err)
+			if !cmp.Equal(want, got, ignoreDebugInfo) {
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+
+			var again strings.Builder
+			require.NoError(t, disasm.Disassemble(&again, got))
+			assert.Equal(t, listing.String(), again.String())
+		})
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+	)
+	input := `; hand written, without offsets
+.constant 1 String "done"
+
+.main
+	OpTrue
+loop:
+	OpJumpNotTruthy done    ; exit when false
+	OpFalse
+	OpJump loop
+done:
+	OpClosure 0 0
+	OpCall 0
+	OpPop
+.end
+
+.function 0 "" locals=1
+	OpConstant 1
+	OpSetLocal 0
+	OpGetLocal 0
+	OpReturnValue
+.end
+`
+	want := compiler.Bytecode{
+		Instructions: cat(
+			instr(t, code.OpTrue),
+			instr(t, code.OpJumpNotTruthy, 8),
+			instr(t, code.OpFalse),
+			instr(t, code.OpJump, 1),
+			instr(t, code.OpClosure, 0, 0),
+			instr(t, code.OpCall, 0),
+			instr(t, code.OpPop),
+		),
+		Constants: []object.Object{
+			object.CompiledFunction{
+				Instructions: cat(
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpSetLocal, 0),
+					instr(t, code.OpGetLocal, 0),
+					instr(t, code.OpReturnValue),
+				),
+				NumLocals: 1,
+			},
+			StringObject("done"),
+		},
+	}
+	got, err := asm.Assemble(input)
+	require.NoError(t, err)
+	if !cmp.Equal(want, got, ignoreDebugInfo) {
+		t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		pos   string
+		want  string
+	}{
+		{"unknown-opcode", ".main\n\tOpNop\n.end", "2:2", "unknown opcode OpNop"},
+		{"missing-operand", ".main\n\tOpConstant\n.end", "2:2", "OpConstant takes 1 operands, got 0"},
+		{"extra-operand", ".main\n\tOpPop 1\n.end", "2:2", "OpPop takes 0 operands, got 1"},
+		{"operand-range", ".main\n\tOpGetLocal 256\n.end", "2:13", "operand 256 of OpGetLocal out of range [0, 255]"},
+		{"label-operand", ".main\n\tOpConstant here\n.end", "2:13", "invalid operand here"},
+		{"undefined-label", ".main\n\tOpJump nowhere\n.end", "2:9", "undefined label nowhere"},
+		{"duplicate-label", ".main\nhere:\nhere:\n.end", "3:1", "label here is already defined"},
+		{"instruction-outside", "OpPop", "1:1", "instruction outside of .main or .function"},
+		{"unclosed", ".main\n\tOpPop", "1:1", ".main is not closed by .end"},
+		{"nested", ".main\n.function 0 \"\"\n.end", "2:1", ".function inside .main"},
+		{"duplicate-main", ".main\n.end\n.main\n.end", "3:1", ".main is already defined"},
+		{"duplicate-constant", ".constant 0 Integer 1\n.constant 0 Integer 2", "2:11", "constant 0 is already defined"},
+		{"constant-gap", ".constant 1 Integer 1", "-", "constant 0 is not defined"},
+		{"constant-type", ".constant 0 Boolean true", "1:13", "unsupported constant type Boolean"},
+		{"invalid-string", ".constant 0 String \"unterminated", "1:20", "invalid string literal"},
+		{"unknown-attribute", ".function 0 \"f\" free=1\n.end", "1:17", "unknown attribute free"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := asm.Assemble(tt.input)
+			var posErr *token.Error
+			require.ErrorAs(t, err, &posErr)
+			assert.Equal(t, tt.pos, posErr.Pos.String())
+			assert.EqualError(t, posErr.Err, tt.want)
+		})
+	}
+}
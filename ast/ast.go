@@ -12,6 +12,8 @@ import (
 type Node interface {
 	TokenLiteral() string
 	String() string
+	// Pos returns the position of the token the node was parsed from.
+	Pos() token.Position
 }
 
 type Statement interface {
@@ -35,6 +37,13 @@ func (p *Program) TokenLiteral() string {
 	return ""
 }
 
+func (p *Program) Pos() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return token.Position{}
+}
+
 func (p *Program) String() string {
 	var b strings.Builder
 	for _, s := range p.Statements {
@@ -51,6 +60,7 @@ type LetStatement struct {
 
 func (s *LetStatement) statementNode()       {}
 func (s *LetStatement) TokenLiteral() string { return s.Token.Literal }
+func (s *LetStatement) Pos() token.Position  { return s.Token.Pos }
 func (s *LetStatement) String() string {
 	var b strings.Builder
 	b.WriteString(s.TokenLiteral())
@@ -71,6 +81,7 @@ type Identifier struct {
 
 func (e *Identifier) expressionNode()      {}
 func (e *Identifier) TokenLiteral() string { return e.Token.Literal }
+func (e *Identifier) Pos() token.Position  { return e.Token.Pos }
 func (e *Identifier) String() string       { return e.Value }
 
 type IntegerLiteral struct {
@@ -80,6 +91,7 @@ type IntegerLiteral struct {
 
 func (e *IntegerLiteral) expressionNode()      {}
 func (e *IntegerLiteral) TokenLiteral() string { return e.Token.Literal }
+func (e *IntegerLiteral) Pos() token.Position  { return e.Token.Pos }
 func (e *IntegerLiteral) String() string       { return e.Token.Literal }
 
 type StringLiteral struct {
@@ -89,6 +101,7 @@ type StringLiteral struct {
 
 func (e *StringLiteral) expressionNode()      {}
 func (e *StringLiteral) TokenLiteral() string { return e.Token.Literal }
+func (e *StringLiteral) Pos() token.Position  { return e.Token.Pos }
 func (e *StringLiteral) String() string       { return e.Token.Literal }
 
 type BooleanLiteral struct {
@@ -98,16 +111,19 @@ type BooleanLiteral struct {
 
 func (e *BooleanLiteral) expressionNode()      {}
 func (e *BooleanLiteral) TokenLiteral() string { return e.Token.Literal }
+func (e *BooleanLiteral) Pos() token.Position  { return e.Token.Pos }
 func (e *BooleanLiteral) String() string       { return e.Token.Literal }
 
 type FunctionLiteral struct {
 	Token      token.Token
 	Parameters []*Identifier
 	Body       *BlockStatement
+	Name       string
 }
 
 func (e *FunctionLiteral) expressionNode()      {}
 func (e *FunctionLiteral) TokenLiteral() string { return e.Token.Literal }
+func (e *FunctionLiteral) Pos() token.Position  { return e.Token.Pos }
 func (e *FunctionLiteral) String() string {
 	var b strings.Builder
 	params := make([]string, 0, len(e.Parameters))
@@ -115,6 +131,11 @@ func (e *FunctionLiteral) String() string {
 		params = append(params, p.String())
 	}
 	b.WriteString(e.TokenLiteral())
+	if e.Name != "" {
+		b.WriteString("<")
+		b.WriteString(e.Name)
+		b.WriteString(">")
+	}
 	b.WriteString("(")
 	b.WriteString(strings.Join(params, ","))
 	b.WriteString(")")
@@ -129,6 +150,7 @@ type ArrayLiteral struct {
 
 func (e *ArrayLiteral) expressionNode()      {}
 func (e *ArrayLiteral) TokenLiteral() string { return e.Token.Literal }
+func (e *ArrayLiteral) Pos() token.Position  { return e.Token.Pos }
 func (e *ArrayLiteral) String() string {
 	var b strings.Builder
 	elements := make([]string, 0, len(e.Elements))
@@ -148,6 +170,7 @@ type HashLiteral struct {
 
 func (e *HashLiteral) expressionNode()      {}
 func (e *HashLiteral) TokenLiteral() string { return e.Token.Literal }
+func (e *HashLiteral) Pos() token.Position  { return e.Token.Pos }
 func (e *HashLiteral) String() string {
 	var b strings.Builder
 	pairs := make([]string, 0, len(e.Pairs))
@@ -181,6 +204,7 @@ type PrefixExpression struct {
 
 func (e *PrefixExpression) expressionNode()      {}
 func (e *PrefixExpression) TokenLiteral() string { return e.Token.Literal }
+func (e *PrefixExpression) Pos() token.Position  { return e.Token.Pos }
 func (e *PrefixExpression) String() string {
 	var b strings.Builder
 	b.WriteString("(")
@@ -198,6 +222,7 @@ type InfixExpression struct {
 
 func (e *InfixExpression) expressionNode()      {}
 func (e *InfixExpression) TokenLiteral() string { return e.Token.Literal }
+func (e *InfixExpression) Pos() token.Position  { return e.Token.Pos }
 func (e *InfixExpression) String() string {
 	var b strings.Builder
 	b.WriteString("(")
@@ -217,6 +242,7 @@ type IndexExpression struct {
 
 func (e *IndexExpression) expressionNode()      {}
 func (e *IndexExpression) TokenLiteral() string { return e.Token.Literal }
+func (e *IndexExpression) Pos() token.Position  { return e.Token.Pos }
 func (e *IndexExpression) String() string {
 	var b strings.Builder
 	b.WriteString("(")
@@ -235,6 +261,7 @@ type IfExpression struct {
 
 func (e *IfExpression) expressionNode()      {}
 func (e *IfExpression) TokenLiteral() string { return e.Token.Literal }
+func (e *IfExpression) Pos() token.Position  { return e.Token.Pos }
 func (e *IfExpression) String() string {
 	var b strings.Builder
 	b.WriteString("if")
@@ -256,6 +283,7 @@ type CallExpression struct {
 
 func (e *CallExpression) expressionNode()      {}
 func (e *CallExpression) TokenLiteral() string { return e.Token.Literal }
+func (e *CallExpression) Pos() token.Position  { return e.Token.Pos }
 func (e *CallExpression) String() string {
 	args := make([]string, 0, len(e.Arguments))
 	for _, arg := range e.Arguments {
@@ -276,6 +304,7 @@ type ReturnStatement struct {
 
 func (s *ReturnStatement) statementNode()       {}
 func (s *ReturnStatement) TokenLiteral() string { return s.Token.Literal }
+func (s *ReturnStatement) Pos() token.Position  { return s.Token.Pos }
 func (s *ReturnStatement) String() string {
 	var b strings.Builder
 	b.WriteString(s.TokenLiteral())
@@ -294,6 +323,7 @@ type ExpressionStatement struct {
 
 func (s *ExpressionStatement) statementNode()       {}
 func (s *ExpressionStatement) TokenLiteral() string { return s.Token.Literal }
+func (s *ExpressionStatement) Pos() token.Position  { return s.Token.Pos }
 func (s *ExpressionStatement) String() string {
 	if s.Expression != nil {
 		return s.Expression.String()
@@ -310,6 +340,10 @@ func (s *BlockStatement) TokenLiteral() string {
 	return s.Token.Literal
 }
 
+func (s *BlockStatement) Pos() token.Position {
+	return s.Token.Pos
+}
+
 func (s *BlockStatement) String() string {
 	var b strings.Builder
 	for _, s := range s.Statements {
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"strings"
+
+	"github.com/Warashi/monkey/token"
 )
 
 //go:generate go run golang.org/x/tools/cmd/stringer -type Opcode
@@ -43,32 +45,118 @@ const (
 
 	// null
 	OpNull
+
+	// global binding
+	OpGetGlobal
+	OpSetGlobal
+
+	// composite
+	OpArray
+	OpHash
+	OpIndex
+
+	// function
+	OpCall
+	OpReturnValue
+	OpReturn
+
+	// local binding
+	OpGetLocal
+	OpSetLocal
+
+	// closure
+	OpClosure
+	OpGetFree
+	OpCurrentClosure
+
+	// builtin
+	OpGetBuiltin
+
+	// wide operands, for constant indices and jump targets which do not fit in 2 bytes
+	OpConstantWide
+	OpJumpNotTruthyWide
+	OpJumpWide
+
+	// binary operators added after the bytecode format was fixed
+	OpMod
+
+	// function
+	OpTailCall
+
+	// wide operands, for closures of constant indices which do not fit in 2 bytes
+	OpClosureWide
 )
 
+// SourceMap maps the offset of each instruction to the source position it was compiled from.
+type SourceMap map[int]token.Position
+
 type Definition struct {
 	Name          string
 	OperandWitdth []int
+
+	// stack effect: the instruction pops Pop values, plus the values of the operands at PopOperands,
+	// and then pushes Push values.
+	Pop         int
+	Push        int
+	PopOperands []int
+}
+
+// StackEffect returns the number of values popped and pushed by the instruction with operands.
+func (def Definition) StackEffect(operands []int64) (pop, push int) {
+	pop = def.Pop
+	for _, i := range def.PopOperands {
+		pop += int(operands[i])
+	}
+	return pop, def.Push
 }
 
 var definitions = map[Opcode]Definition{
-	OpConstant:      {"OpConstant", []int{2}},
-	OpPop:           {"OpPop", nil},
-	OpMinus:         {"OpMinus", nil},
-	OpBang:          {"OpBang", nil},
-	OpAdd:           {"OpAdd", nil},
-	OpSub:           {"OpSub", nil},
-	OpMul:           {"OpMul", nil},
-	OpDiv:           {"OpDiv", nil},
-	OpEqual:         {"OpEqual", nil},
-	OpNotEqual:      {"OpNotEqual", nil},
-	OpGreaterThan:   {"OpGreaterThan", nil},
-	OpTrue:          {"OpTrue", nil},
-	OpFalse:         {"OpFalse", nil},
-	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
-	OpJump:          {"OpJump", []int{2}},
-	OpNull:          {"OpNull", nil},
+	// name, operand widths, pop, push, pop operands
+	OpConstant:       {"OpConstant", []int{2}, 0, 1, nil},
+	OpPop:            {"OpPop", nil, 1, 0, nil},
+	OpMinus:          {"OpMinus", nil, 1, 1, nil},
+	OpBang:           {"OpBang", nil, 1, 1, nil},
+	OpAdd:            {"OpAdd", nil, 2, 1, nil},
+	OpSub:            {"OpSub", nil, 2, 1, nil},
+	OpMul:            {"OpMul", nil, 2, 1, nil},
+	OpDiv:            {"OpDiv", nil, 2, 1, nil},
+	OpEqual:          {"OpEqual", nil, 2, 1, nil},
+	OpNotEqual:       {"OpNotEqual", nil, 2, 1, nil},
+	OpGreaterThan:    {"OpGreaterThan", nil, 2, 1, nil},
+	OpTrue:           {"OpTrue", nil, 0, 1, nil},
+	OpFalse:          {"OpFalse", nil, 0, 1, nil},
+	OpJumpNotTruthy:  {"OpJumpNotTruthy", []int{2}, 1, 0, nil},
+	OpJump:           {"OpJump", []int{2}, 0, 0, nil},
+	OpNull:           {"OpNull", nil, 0, 1, nil},
+	OpGetGlobal:      {"OpGetGlobal", []int{2}, 0, 1, nil},
+	OpSetGlobal:      {"OpSetGlobal", []int{2}, 1, 0, nil},
+	OpArray:          {"OpArray", []int{2}, 0, 1, []int{0}},
+	OpHash:           {"OpHash", []int{2}, 0, 1, []int{0}},
+	OpIndex:          {"OpIndex", nil, 2, 1, nil},
+	OpCall:           {"OpCall", []int{1}, 1, 1, []int{0}},
+	OpReturnValue:    {"OpReturnValue", nil, 1, 0, nil},
+	OpReturn:         {"OpReturn", nil, 0, 0, nil},
+	OpGetLocal:       {"OpGetLocal", []int{1}, 0, 1, nil},
+	OpSetLocal:       {"OpSetLocal", []int{1}, 1, 0, nil},
+	OpClosure:        {"OpClosure", []int{2, 1}, 0, 1, []int{1}},
+	OpGetFree:        {"OpGetFree", []int{1}, 0, 1, nil},
+	OpCurrentClosure: {"OpCurrentClosure", nil, 0, 1, nil},
+	OpGetBuiltin:     {"OpGetBuiltin", []int{1}, 0, 1, nil},
+
+	OpConstantWide:      {"OpConstantWide", []int{4}, 0, 1, nil},
+	OpJumpNotTruthyWide: {"OpJumpNotTruthyWide", []int{4}, 1, 0, nil},
+	OpJumpWide:          {"OpJumpWide", []int{4}, 0, 0, nil},
+
+	OpMod: {"OpMod", nil, 2, 1, nil},
+
+	OpTailCall: {"OpTailCall", []int{1}, 1, 1, []int{0}},
+
+	OpClosureWide: {"OpClosureWide", []int{4, 1}, 0, 1, []int{1}},
 }
 
+// ErrOperandOverflow is returned by Append and Make when an operand does not fit its width.
+var ErrOperandOverflow = errors.New("operand overflow")
+
 func Lookup(op Opcode) (Definition, error) {
 	def, ok := definitions[op]
 	if !ok {
@@ -77,6 +165,59 @@ func Lookup(op Opcode) (Definition, error) {
 	return def, nil
 }
 
+// IsJump reports whether op jumps to the offset given by its first operand.
+func IsJump(op Opcode) bool {
+	switch op {
+	case OpJump, OpJumpNotTruthy, OpJumpWide, OpJumpNotTruthyWide:
+		return true
+	default:
+		return false
+	}
+}
+
+// Widen returns the variant of op with a 4-byte operand, or op itself if there is none.
+func Widen(op Opcode) Opcode {
+	switch op {
+	case OpConstant:
+		return OpConstantWide
+	case OpClosure:
+		return OpClosureWide
+	case OpJump:
+		return OpJumpWide
+	case OpJumpNotTruthy:
+		return OpJumpNotTruthyWide
+	default:
+		return op
+	}
+}
+
+// Narrow returns the variant of op with a 2-byte operand, or op itself if there is none.
+func Narrow(op Opcode) Opcode {
+	switch op {
+	case OpConstantWide:
+		return OpConstant
+	case OpClosureWide:
+		return OpClosure
+	case OpJumpWide:
+		return OpJump
+	case OpJumpNotTruthyWide:
+		return OpJumpNotTruthy
+	default:
+		return op
+	}
+}
+
+// LookupByName returns the opcode whose definition has the given name, such as "OpConstant".
+func LookupByName(name string) (Opcode, Definition, error) {
+	for op, def := range definitions {
+		if def.Name == name {
+			return op, def, nil
+		}
+	}
+	return 0, Definition{}, fmt.Errorf("%s not found.", name)
+}
+
+// Make encodes the instruction into a new Instructions.
 func Make(op Opcode, operands ...int64) (Instructions, error) {
 	def, err := Lookup(op)
 	if err != nil {
@@ -86,19 +227,46 @@ func Make(op Opcode, operands ...int64) (Instructions, error) {
 	for _, w := range def.OperandWitdth {
 		instLen += w
 	}
-	buf := new(bytes.Buffer)
-	buf.Grow(instLen)
-	binary.Write(buf, binary.BigEndian, op)
+	ins, err := Append(make(Instructions, 0, instLen), op, operands...)
+	if err != nil {
+		return nil, err
+	}
+	return ins, nil
+}
 
+// Append encodes the instruction at the end of ins and returns the extended Instructions.
+// Unlike Make it allocates only when ins has to grow, like the builtin append.
+func Append(ins Instructions, op Opcode, operands ...int64) (Instructions, error) {
+	def, ok := definitions[op]
+	if !ok {
+		return ins, fmt.Errorf("%s not found.", op)
+	}
+	if len(operands) != len(def.OperandWitdth) {
+		return ins, fmt.Errorf("%s takes %d operands, got %d", def.Name, len(def.OperandWitdth), len(operands))
+	}
 	for i, o := range operands {
-		width := def.OperandWitdth[i]
-		switch width {
+		if max := MaxOperand(def.OperandWitdth[i]); o < 0 || max < o {
+			return ins, fmt.Errorf("%w: operand %d of %s out of range [0, %d]", ErrOperandOverflow, o, def.Name, max)
+		}
+	}
+
+	ins = append(ins, byte(op))
+	for i, o := range operands {
+		switch def.OperandWitdth[i] {
+		case 1:
+			ins = append(ins, byte(o))
 		case 2:
-			binary.Write(buf, binary.BigEndian, uint16(o))
+			ins = append(ins, byte(o>>8), byte(o))
+		case 4:
+			ins = append(ins, byte(o>>24), byte(o>>16), byte(o>>8), byte(o))
 		}
 	}
+	return ins, nil
+}
 
-	return buf.Bytes(), nil
+// MaxOperand returns the largest operand which fits in width bytes.
+func MaxOperand(width int) int64 {
+	return int64(1)<<(8*width) - 1
 }
 
 func (ins Instructions) String() string {
@@ -137,14 +305,27 @@ func (ins Instructions) fmtInstruction(def Definition, operands []int64) string
 		return fmt.Sprintf("ERROR: operand len %d does not match defined %d\n", len(operands), operandCount)
 	}
 
-	switch operandCount {
-	case 0:
-		return def.Name
-	case 1:
-		return fmt.Sprintf("%s %d", def.Name, operands[0])
-	default:
-		return fmt.Sprintf("ERROR: unhandled operandCount for %s", def.Name)
+	var b strings.Builder
+	b.WriteString(def.Name)
+	for _, o := range operands {
+		fmt.Fprintf(&b, " %d", o)
 	}
+	return b.String()
+}
+
+// Uint16 decodes the big-endian uint16 operand at offset.
+func (ins Instructions) Uint16(offset int) uint16 {
+	return binary.BigEndian.Uint16(ins[offset:])
+}
+
+// Uint32 decodes the big-endian uint32 operand at offset.
+func (ins Instructions) Uint32(offset int) uint32 {
+	return binary.BigEndian.Uint32(ins[offset:])
+}
+
+// Uint8 decodes the uint8 operand at offset.
+func (ins Instructions) Uint8(offset int) uint8 {
+	return ins[offset]
 }
 
 func ReadOpcode(r io.Reader) (Opcode, error) {
@@ -161,12 +342,24 @@ func ReadOperands(def Definition, r io.Reader) ([]int64, int, error) {
 	read := 0
 	for i, width := range def.OperandWitdth {
 		switch width {
+		case 1:
+			var err error
+			operands[i], err = ReadUint8(r)
+			if err != nil {
+				return nil, 0, fmt.Errorf("ReadUint8: %w", err)
+			}
 		case 2:
 			var err error
 			operands[i], err = ReadUint16(r)
 			if err != nil {
 				return nil, 0, fmt.Errorf("ReadUint16: %w", err)
 			}
+		case 4:
+			var err error
+			operands[i], err = ReadUint32(r)
+			if err != nil {
+				return nil, 0, fmt.Errorf("ReadUint32: %w", err)
+			}
 		}
 		read += width
 	}
@@ -174,6 +367,14 @@ func ReadOperands(def Definition, r io.Reader) ([]int64, int, error) {
 	return operands, read, nil
 }
 
+func ReadUint8(r io.Reader) (int64, error) {
+	var read uint8
+	if err := binary.Read(r, binary.BigEndian, &read); err != nil {
+		return 0, fmt.Errorf("binary.Read: %w", err)
+	}
+	return int64(read), nil
+}
+
 func ReadUint16(r io.Reader) (int64, error) {
 	var read uint16
 	if err := binary.Read(r, binary.BigEndian, &read); err != nil {
@@ -181,3 +382,11 @@ func ReadUint16(r io.Reader) (int64, error) {
 	}
 	return int64(read), nil
 }
+
+func ReadUint32(r io.Reader) (int64, error) {
+	var read uint32
+	if err := binary.Read(r, binary.BigEndian, &read); err != nil {
+		return 0, fmt.Errorf("binary.Read: %w", err)
+	}
+	return int64(read), nil
+}
@@ -19,6 +19,14 @@ func TestMake(t *testing.T) {
 	}{
 		{"constant", code.OpConstant, []int64{0xFFFE}, code.Instructions{byte(code.OpConstant), 0xFF, 0xFE}, assert.NoError},
 		{"add", code.OpAdd, nil, code.Instructions{byte(code.OpAdd)}, assert.NoError},
+		{"closure", code.OpClosure, []int64{0xFFFE, 0xFF}, code.Instructions{byte(code.OpClosure), 0xFF, 0xFE, 0xFF}, assert.NoError},
+		{"get-local", code.OpGetLocal, []int64{0xFF}, code.Instructions{byte(code.OpGetLocal), 0xFF}, assert.NoError},
+		{"constant-wide", code.OpConstantWide, []int64{0x010203}, code.Instructions{byte(code.OpConstantWide), 0x00, 0x01, 0x02, 0x03}, assert.NoError},
+		{"closure-wide", code.OpClosureWide, []int64{0x010203, 0xFF}, code.Instructions{byte(code.OpClosureWide), 0x00, 0x01, 0x02, 0x03, 0xFF}, assert.NoError},
+		{"overflow", code.OpConstant, []int64{0x10000}, nil, assert.Error},
+		{"negative", code.OpGetLocal, []int64{-1}, nil, assert.Error},
+		{"missing-operand", code.OpConstant, nil, nil, assert.Error},
+		{"extra-operand", code.OpAdd, []int64{1}, nil, assert.Error},
 	}
 
 	for _, tt := range tests {
@@ -32,3 +40,77 @@ func TestMake(t *testing.T) {
 		})
 	}
 }
+
+func TestAppend(t *testing.T) {
+	t.Parallel()
+
+	buf := make(code.Instructions, 0, 16)
+	ins, err := code.Append(buf, code.OpConstant, 0xFFFE)
+	assert.NoError(t, err)
+	ins, err = code.Append(ins, code.OpClosure, 0x0102, 0x03)
+	assert.NoError(t, err)
+	ins, err = code.Append(ins, code.OpPop)
+	assert.NoError(t, err)
+
+	want := code.Instructions{byte(code.OpConstant), 0xFF, 0xFE, byte(code.OpClosure), 0x01, 0x02, 0x03, byte(code.OpPop)}
+	assert.Equal(t, want, ins)
+	assert.Same(t, &buf[:1][0], &ins[0], "appending within the capacity must not reallocate")
+
+	got, err := code.Append(ins, code.OpConstant)
+	assert.Error(t, err)
+	assert.Equal(t, want, got, "the instructions must be kept on error")
+}
+
+func TestOperandOverflow(t *testing.T) {
+	t.Parallel()
+
+	_, err := code.Make(code.OpJump, 0x10000)
+	assert.ErrorIs(t, err, code.ErrOperandOverflow)
+	assert.ErrorContains(t, err, "operand 65536 of OpJump out of range [0, 65535]")
+}
+
+func TestLookupByName(t *testing.T) {
+	t.Parallel()
+
+	op, def, err := code.LookupByName("OpClosure")
+	assert.NoError(t, err)
+	assert.Equal(t, code.OpClosure, op)
+	assert.Equal(t, []int{2, 1}, def.OperandWitdth)
+
+	_, _, err = code.LookupByName("OpNop")
+	assert.Error(t, err)
+}
+
+func TestStackEffect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		op       code.Opcode
+		operands []int64
+		pop      int
+		push     int
+	}{
+		{"constant", code.OpConstant, []int64{0}, 0, 1},
+		{"add", code.OpAdd, nil, 2, 1},
+		{"jump-not-truthy", code.OpJumpNotTruthy, []int64{0}, 1, 0},
+		{"array", code.OpArray, []int64{3}, 3, 1},
+		{"hash", code.OpHash, []int64{4}, 4, 1},
+		{"call", code.OpCall, []int64{2}, 3, 1},
+		{"closure", code.OpClosure, []int64{0, 2}, 2, 1},
+		{"return-value", code.OpReturnValue, nil, 1, 0},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			def, err := code.Lookup(tt.op)
+			assert.NoError(t, err)
+			pop, push := def.StackEffect(tt.operands)
+			assert.Equal(t, tt.pop, pop)
+			assert.Equal(t, tt.push, push)
+		})
+	}
+}
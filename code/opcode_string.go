@@ -24,11 +24,31 @@ func _() {
 	_ = x[OpJumpNotTruthy-14]
 	_ = x[OpJump-15]
 	_ = x[OpNull-16]
+	_ = x[OpGetGlobal-17]
+	_ = x[OpSetGlobal-18]
+	_ = x[OpArray-19]
+	_ = x[OpHash-20]
+	_ = x[OpIndex-21]
+	_ = x[OpCall-22]
+	_ = x[OpReturnValue-23]
+	_ = x[OpReturn-24]
+	_ = x[OpGetLocal-25]
+	_ = x[OpSetLocal-26]
+	_ = x[OpClosure-27]
+	_ = x[OpGetFree-28]
+	_ = x[OpCurrentClosure-29]
+	_ = x[OpGetBuiltin-30]
+	_ = x[OpConstantWide-31]
+	_ = x[OpJumpNotTruthyWide-32]
+	_ = x[OpJumpWide-33]
+	_ = x[OpMod-34]
+	_ = x[OpTailCall-35]
+	_ = x[OpClosureWide-36]
 }
 
-const _Opcode_name = "OpConstantOpPopOpMinusOpBangOpAddOpSubOpMulOpDivOpEqualOpNotEqualOpGreaterThanOpTrueOpFalseOpJumpNotTruthyOpJumpOpNull"
+const _Opcode_name = "OpConstantOpPopOpMinusOpBangOpAddOpSubOpMulOpDivOpEqualOpNotEqualOpGreaterThanOpTrueOpFalseOpJumpNotTruthyOpJumpOpNullOpGetGlobalOpSetGlobalOpArrayOpHashOpIndexOpCallOpReturnValueOpReturnOpGetLocalOpSetLocalOpClosureOpGetFreeOpCurrentClosureOpGetBuiltinOpConstantWideOpJumpNotTruthyWideOpJumpWideOpModOpTailCallOpClosureWide"
 
-var _Opcode_index = [...]uint8{0, 10, 15, 22, 28, 33, 38, 43, 48, 55, 65, 78, 84, 91, 106, 112, 118}
+var _Opcode_index = [...]uint16{0, 10, 15, 22, 28, 33, 38, 43, 48, 55, 65, 78, 84, 91, 106, 112, 118, 129, 140, 147, 153, 160, 166, 179, 187, 197, 207, 216, 225, 241, 253, 267, 286, 296, 301, 311, 324}
 
 func (i Opcode) String() string {
 	i -= 1
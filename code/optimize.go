@@ -0,0 +1,264 @@
+package code
+
+// Optimize rewrites sequences of instructions emitted by the compiler into shorter ones:
+//
+//   - OpTrue; OpJumpNotTruthy is removed, and OpFalse or OpNull; OpJumpNotTruthy becomes OpJump
+//   - a jump to OpJump jumps to the target of the latter
+//   - a jump to OpNull; OpPop jumps past them, and OpNull; OpPop reached only by falling through is removed
+//   - OpJump to the next instruction is removed, and OpJumpNotTruthy to it becomes OpPop
+//   - unreachable instructions are removed
+//
+// Jump targets are fixed up, and sourceMap is translated to the new offsets. The last OpPop is kept,
+// since the value it pops is the result of the main instructions. The result is compacted like Compact.
+// ins and sourceMap are not modified, and are returned as they are if ins cannot be decoded.
+func Optimize(ins Instructions, sourceMap SourceMap) (Instructions, SourceMap) {
+	o, ok := newOptimizer(ins, sourceMap)
+	if !ok {
+		return ins, sourceMap
+	}
+	for o.rewrite() || o.removeUnreachable() {
+	}
+	return o.encode()
+}
+
+// Compact encodes each instruction of ins which has a wide variant in its narrowest form, such as
+// OpJump instead of OpJumpWide if the target fits in 2 bytes, and translates sourceMap to the new offsets.
+// ins and sourceMap are not modified, and are returned as they are if ins cannot be decoded.
+func Compact(ins Instructions, sourceMap SourceMap) (Instructions, SourceMap) {
+	o, ok := newOptimizer(ins, sourceMap)
+	if !ok {
+		return ins, sourceMap
+	}
+	return o.encode()
+}
+
+type optimizedInstruction struct {
+	op       Opcode   // the narrow variant, which encode widens if needed
+	operands [2]int64 // no instruction has more operands
+	target   int      // index of the target instruction of a jump
+	offset   int      // offset in the original instructions
+	deleted  bool
+}
+
+type optimizer struct {
+	instructions []optimizedInstruction
+	sourceMap    SourceMap
+}
+
+func newOptimizer(ins Instructions, sourceMap SourceMap) (*optimizer, bool) {
+	// most instructions take one or two bytes
+	o := &optimizer{instructions: make([]optimizedInstruction, 0, len(ins)/2+1), sourceMap: sourceMap}
+	index := make([]int, len(ins)+1) // offset to index+1, 0 for the middle of an instruction
+	for offset := 0; offset < len(ins); {
+		op := Opcode(ins[offset])
+		def, ok := definitions[op]
+		if !ok {
+			return nil, false
+		}
+		in := optimizedInstruction{op: Narrow(op), offset: offset}
+		index[offset] = len(o.instructions) + 1
+		next := offset + 1
+		for i, w := range def.OperandWitdth {
+			if len(ins) < next+w {
+				return nil, false
+			}
+			switch w {
+			case 1:
+				in.operands[i] = int64(ins.Uint8(next))
+			case 2:
+				in.operands[i] = int64(ins.Uint16(next))
+			case 4:
+				in.operands[i] = int64(ins.Uint32(next))
+			}
+			next += w
+		}
+		o.instructions = append(o.instructions, in)
+		offset = next
+	}
+	index[len(ins)] = len(o.instructions) + 1
+
+	for i := range o.instructions {
+		in := &o.instructions[i]
+		if !IsJump(in.op) {
+			continue
+		}
+		if int(in.operands[0]) >= len(index) || index[in.operands[0]] == 0 {
+			return nil, false
+		}
+		in.target = index[in.operands[0]] - 1
+	}
+	return o, true
+}
+
+// live returns the index of the first instruction at or after i which is not deleted.
+// The end of the instructions is len(o.instructions).
+func (o *optimizer) live(i int) int {
+	for i < len(o.instructions) && o.instructions[i].deleted {
+		i++
+	}
+	return i
+}
+
+// is reports whether the instruction at i exists and is op.
+func (o *optimizer) is(i int, op Opcode) bool {
+	return i < len(o.instructions) && o.instructions[i].op == op
+}
+
+func (o *optimizer) jumpTargets() []bool {
+	targets := make([]bool, len(o.instructions)+1)
+	for _, in := range o.instructions {
+		if !in.deleted && IsJump(in.op) {
+			targets[o.live(in.target)] = true
+		}
+	}
+	return targets
+}
+
+// rewrite applies the first applicable rewrite, and reports whether it did.
+func (o *optimizer) rewrite() bool {
+	targets := o.jumpTargets()
+	last := len(o.instructions) - 1
+	for last >= 0 && o.instructions[last].deleted {
+		last--
+	}
+	for i := range o.instructions {
+		in := &o.instructions[i]
+		if in.deleted {
+			continue
+		}
+		next := o.live(i + 1)
+
+		switch in.op {
+		case OpTrue, OpFalse, OpNull:
+			if o.is(next, OpJumpNotTruthy) && !targets[next] {
+				in.deleted = true
+				if in.op == OpTrue {
+					o.instructions[next].deleted = true
+				} else {
+					o.instructions[next].op = OpJump
+				}
+				return true
+			}
+			if in.op == OpNull && o.is(next, OpPop) && !targets[next] && next != last {
+				in.deleted = true
+				o.instructions[next].deleted = true
+				return true
+			}
+		case OpJump, OpJumpNotTruthy:
+			target := o.live(in.target)
+			if o.is(target, OpJump) && target != i && o.live(o.instructions[target].target) != target {
+				in.target = o.live(o.instructions[target].target)
+				return true
+			}
+			if o.is(target, OpNull) {
+				if pop := o.live(target + 1); o.is(pop, OpPop) && pop != last {
+					in.target = pop + 1
+					return true
+				}
+			}
+			if target == next {
+				if in.op == OpJump {
+					in.deleted = true
+				} else {
+					in.op = OpPop
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeUnreachable deletes the instructions which cannot be reached from the first one, and reports
+// whether there was any.
+func (o *optimizer) removeUnreachable() bool {
+	reachable := make([]bool, len(o.instructions)+1)
+	work := []int{o.live(0)}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if reachable[i] {
+			continue
+		}
+		reachable[i] = true
+		if i == len(o.instructions) {
+			continue
+		}
+		in := o.instructions[i]
+		if IsJump(in.op) {
+			work = append(work, o.live(in.target))
+		}
+		switch in.op {
+		case OpJump, OpReturnValue, OpReturn:
+		default:
+			work = append(work, o.live(i+1))
+		}
+	}
+
+	removed := false
+	for i := range o.instructions {
+		if !o.instructions[i].deleted && !reachable[i] {
+			o.instructions[i].deleted = true
+			removed = true
+		}
+	}
+	return removed
+}
+
+func (o *optimizer) encode() (Instructions, SourceMap) {
+	// jumps start narrow and are widened until every target fits, which only moves targets further
+	wide := make([]bool, len(o.instructions))
+	for i, in := range o.instructions {
+		wide[i] = !IsJump(in.op) && in.operands[0] > MaxOperand(2)
+	}
+	offsets := make([]int, len(o.instructions)+1)
+	for {
+		size := 0
+		for i, in := range o.instructions {
+			offsets[i] = size
+			if in.deleted {
+				continue
+			}
+			op := in.op
+			if wide[i] {
+				op = Widen(op)
+			}
+			size++
+			for _, w := range definitions[op].OperandWitdth {
+				size += w
+			}
+		}
+		offsets[len(o.instructions)] = size
+
+		widened := false
+		for i, in := range o.instructions {
+			if !in.deleted && IsJump(in.op) && !wide[i] && int64(offsets[o.live(in.target)]) > MaxOperand(2) {
+				wide[i] = true
+				widened = true
+			}
+		}
+		if !widened {
+			break
+		}
+	}
+
+	ins := make(Instructions, 0, offsets[len(o.instructions)])
+	sourceMap := make(SourceMap, len(o.sourceMap))
+	for i, in := range o.instructions {
+		if in.deleted {
+			continue
+		}
+		if pos, ok := o.sourceMap[in.offset]; ok {
+			sourceMap[len(ins)] = pos
+		}
+		if IsJump(in.op) {
+			in.operands[0] = int64(offsets[o.live(in.target)])
+		}
+		if wide[i] {
+			in.op = Widen(in.op)
+		}
+		// the operands are the ones decoded, so that they always fit the definition
+		ins, _ = Append(ins, in.op, in.operands[:len(definitions[in.op].OperandWitdth)]...)
+	}
+	return ins, sourceMap
+}
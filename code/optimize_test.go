@@ -0,0 +1,329 @@
+package code_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/disasm"
+	. "github.com/Warashi/monkey/testutil"
+	"github.com/Warashi/monkey/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptimize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		before string
+		after  string
+	}{
+		{
+			name: "true-condition",
+			before: `
+.main
+	OpTrue
+	OpJumpNotTruthy else
+	OpGetGlobal 0
+	OpJump end
+else:
+	OpGetGlobal 1
+end:
+	OpPop
+.end
+`,
+			after: `
+.main
+	0000 OpGetGlobal 0
+	0003 OpPop
+.end
+`,
+		},
+		{
+			name: "false-condition",
+			before: `
+.main
+	OpFalse
+	OpJumpNotTruthy else
+	OpGetGlobal 0
+	OpJump end
+else:
+	OpGetGlobal 1
+end:
+	OpPop
+.end
+`,
+			after: `
+.main
+	0000 OpGetGlobal 1
+	0003 OpPop
+.end
+`,
+		},
+		{
+			name: "jump-to-jump",
+			before: `
+.main
+	OpGetGlobal 0
+	OpJumpNotTruthy hop
+	OpGetGlobal 1
+	OpPop
+hop:
+	OpJump done
+	OpGetGlobal 2
+	OpPop
+done:
+	OpGetGlobal 3
+	OpPop
+.end
+`,
+			after: `
+.main
+	0000 OpGetGlobal 0
+	0003 OpJumpNotTruthy L0
+	0006 OpGetGlobal 1
+	0009 OpPop
+L0:
+	0010 OpGetGlobal 3
+	0013 OpPop
+.end
+`,
+		},
+		{
+			name: "if-without-else-statement",
+			before: `
+.main
+	OpGetGlobal 0
+	OpJumpNotTruthy else
+	OpGetGlobal 1
+	OpJump end
+else:
+	OpNull
+end:
+	OpPop
+	OpGetGlobal 2
+	OpPop
+.end
+`,
+			after: `
+.main
+	0000 OpGetGlobal 0
+	0003 OpJumpNotTruthy L0
+	0006 OpGetGlobal 1
+	0009 OpPop
+L0:
+	0010 OpGetGlobal 2
+	0013 OpPop
+.end
+`,
+		},
+		{
+			// the last OpPop leaves the result of the program
+			name: "if-without-else-result",
+			before: `
+.main
+	OpGetGlobal 0
+	OpJumpNotTruthy else
+	OpGetGlobal 1
+	OpJump end
+else:
+	OpNull
+end:
+	OpPop
+.end
+`,
+			after: `
+.main
+	0000 OpGetGlobal 0
+	0003 OpJumpNotTruthy L0
+	0006 OpGetGlobal 1
+	0009 OpJump L1
+L0:
+	0012 OpNull
+L1:
+	0013 OpPop
+.end
+`,
+		},
+		{
+			name: "null-pop",
+			before: `
+.main
+	OpNull
+	OpPop
+	OpGetGlobal 0
+	OpPop
+.end
+`,
+			after: `
+.main
+	0000 OpGetGlobal 0
+	0003 OpPop
+.end
+`,
+		},
+		{
+			name: "jump-to-next",
+			before: `
+.main
+	OpGetGlobal 0
+	OpJumpNotTruthy next
+next:
+	OpGetGlobal 1
+	OpJump end
+end:
+	OpPop
+.end
+`,
+			after: `
+.main
+	0000 OpGetGlobal 0
+	0003 OpPop
+	0004 OpGetGlobal 1
+	0007 OpPop
+.end
+`,
+		},
+		{
+			name: "unreachable",
+			before: `
+.main
+	OpGetGlobal 0
+	OpJump end
+	OpGetGlobal 1
+	OpPop
+end:
+	OpPop
+.end
+`,
+			after: `
+.main
+	0000 OpGetGlobal 0
+	0003 OpPop
+.end
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			bytecode := Assemble(t, tt.before)
+			bytecode.Instructions, bytecode.SourceMap = code.Optimize(bytecode.Instructions, bytecode.SourceMap)
+			var got strings.Builder
+			require.NoError(t, disasm.Disassemble(&got, bytecode))
+			assert.Equal(t, strings.TrimPrefix(tt.after, "\n"), got.String())
+		})
+	}
+}
+
+func TestOptimizeSourceMap(t *testing.T) {
+	t.Parallel()
+
+	bytecode := Assemble(t, `
+.main
+	OpTrue
+	OpJumpNotTruthy else
+	OpGetGlobal 0
+	OpJump end
+else:
+	OpGetGlobal 1
+end:
+	OpPop
+.end
+`)
+	pos := func(line int) token.Position { return token.Position{Line: line, Column: 1} }
+	sourceMap := code.SourceMap{0: pos(1), 1: pos(2), 4: pos(3), 7: pos(4), 10: pos(5), 13: pos(6)}
+	before := bytecode.Instructions.String()
+
+	ins, got := code.Optimize(bytecode.Instructions, sourceMap)
+	assert.Equal(t, "0000 OpGetGlobal 0\n0003 OpPop\n", ins.String())
+	assert.Equal(t, code.SourceMap{0: pos(3), 3: pos(6)}, got)
+	assert.Equal(t, before, bytecode.Instructions.String(), "the instructions must not be modified")
+	assert.Len(t, sourceMap, 6, "the source map must not be modified")
+}
+
+func TestOptimizeInvalid(t *testing.T) {
+	t.Parallel()
+
+	ins := code.Instructions{byte(code.OpConstant), 0}
+	got, _ := code.Optimize(ins, nil)
+	assert.Equal(t, ins, got)
+}
+
+func TestCompact(t *testing.T) {
+	t.Parallel()
+
+	// OpNull; OpPop pairs between the jumps and their targets
+	padding := func(n int) code.Instructions {
+		var ins code.Instructions
+		for i := 0; i < n; i++ {
+			ins = append(ins, MakeInstructions(t, code.OpNull)...)
+			ins = append(ins, MakeInstructions(t, code.OpPop)...)
+		}
+		return ins
+	}
+
+	t.Run("narrow", func(t *testing.T) {
+		t.Parallel()
+		ins := ConcatInstructions(
+			MakeInstructions(t, code.OpTrue),
+			MakeInstructions(t, code.OpJumpNotTruthyWide, 16),
+			MakeInstructions(t, code.OpConstantWide, 1),
+			MakeInstructions(t, code.OpJumpWide, 17),
+			MakeInstructions(t, code.OpNull),
+			MakeInstructions(t, code.OpPop),
+		)
+		got, sourceMap := code.Compact(ins, code.SourceMap{6: token.Position{Line: 3}, 17: token.Position{Line: 6}})
+		assert.Equal(t, "0000 OpTrue\n0001 OpJumpNotTruthy 10\n0004 OpConstant 1\n0007 OpJump 11\n0010 OpNull\n0011 OpPop\n", got.String())
+		assert.Equal(t, code.SourceMap{4: token.Position{Line: 3}, 11: token.Position{Line: 6}}, sourceMap)
+	})
+
+	t.Run("closure", func(t *testing.T) {
+		t.Parallel()
+		ins := ConcatInstructions(
+			MakeInstructions(t, code.OpClosureWide, 1, 2),
+			MakeInstructions(t, code.OpPop),
+			MakeInstructions(t, code.OpClosureWide, 0x10000, 2),
+			MakeInstructions(t, code.OpPop),
+		)
+		got, _ := code.Compact(ins, nil)
+		assert.Equal(t, "0000 OpClosure 1 2\n0004 OpPop\n0005 OpClosureWide 65536 2\n0011 OpPop\n", got.String())
+	})
+
+	t.Run("wide", func(t *testing.T) {
+		t.Parallel()
+		const pairs = 0x8000
+		ins := ConcatInstructions(
+			MakeInstructions(t, code.OpTrue),
+			MakeInstructions(t, code.OpJumpNotTruthyWide, 11+2*pairs),
+			MakeInstructions(t, code.OpConstantWide, 0x10000),
+			MakeInstructions(t, code.OpPop),
+			padding(pairs),
+			MakeInstructions(t, code.OpNull),
+			MakeInstructions(t, code.OpPop),
+		)
+		got, _ := code.Compact(ins, nil)
+		assert.Equal(t, ins, got, "operands which do not fit in 2 bytes keep the wide variant")
+	})
+
+	t.Run("fits-once-narrowed", func(t *testing.T) {
+		t.Parallel()
+		// the target OpPop is at 0x10001 with the wide jump, and at 0xFFFF with the narrow one
+		const pairs = 32765
+		ins := ConcatInstructions(
+			MakeInstructions(t, code.OpTrue),
+			MakeInstructions(t, code.OpJumpNotTruthyWide, 7+2*pairs),
+			padding(pairs),
+			MakeInstructions(t, code.OpNull),
+			MakeInstructions(t, code.OpPop),
+		)
+		got, _ := code.Compact(ins, nil)
+		assert.Equal(t, code.Instructions{byte(code.OpTrue), byte(code.OpJumpNotTruthy), 0xFF, 0xFF}, got[:4])
+		assert.Len(t, got, len(ins)-2)
+	})
+}
@@ -0,0 +1,55 @@
+package code
+
+// MarkTailCalls replaces each OpCall in ins which is followed by OpReturnValue, directly or through
+// OpJump, with OpTailCall, which the vm runs in the frame of the caller. ins is modified in place,
+// and is left as it is from the first instruction which cannot be decoded.
+func MarkTailCalls(ins Instructions) {
+	for offset := 0; offset < len(ins); {
+		op := Opcode(ins[offset])
+		def, ok := definitions[op]
+		if !ok {
+			return
+		}
+		next := offset + 1
+		for _, w := range def.OperandWitdth {
+			next += w
+		}
+		if next > len(ins) {
+			return
+		}
+		if op == OpCall && returnsAt(ins, next) {
+			ins[offset] = byte(OpTailCall)
+		}
+		offset = next
+	}
+}
+
+// returnsAt reports whether the instructions from offset return the value on top of the stack without
+// doing anything else.
+func returnsAt(ins Instructions, offset int) bool {
+	for offset < len(ins) {
+		var target int
+		switch Opcode(ins[offset]) {
+		case OpReturnValue:
+			return true
+		case OpJump:
+			if offset+3 > len(ins) {
+				return false
+			}
+			target = int(ins.Uint16(offset + 1))
+		case OpJumpWide:
+			if offset+5 > len(ins) {
+				return false
+			}
+			target = int(ins.Uint32(offset + 1))
+		default:
+			return false
+		}
+		// the compiler only jumps forward, and anything else might loop
+		if target <= offset {
+			return false
+		}
+		offset = target
+	}
+	return false
+}
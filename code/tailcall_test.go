@@ -0,0 +1,78 @@
+package code_test
+
+import (
+	"testing"
+
+	"github.com/Warashi/monkey/code"
+	. "github.com/Warashi/monkey/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarkTailCalls(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		ins  code.Instructions
+		want string
+	}{
+		{
+			name: "return",
+			ins: ConcatInstructions(
+				MakeInstructions(t, code.OpCurrentClosure),
+				MakeInstructions(t, code.OpCall, 0),
+				MakeInstructions(t, code.OpReturnValue),
+			),
+			want: "0000 OpCurrentClosure\n0001 OpTailCall 0\n0003 OpReturnValue\n",
+		},
+		{
+			name: "jump",
+			ins: ConcatInstructions(
+				MakeInstructions(t, code.OpCurrentClosure),
+				MakeInstructions(t, code.OpCall, 0),
+				MakeInstructions(t, code.OpJump, 7),
+				MakeInstructions(t, code.OpNull),
+				MakeInstructions(t, code.OpJumpWide, 12),
+				MakeInstructions(t, code.OpReturnValue),
+			),
+			want: "0000 OpCurrentClosure\n0001 OpTailCall 0\n0003 OpJump 7\n0006 OpNull\n0007 OpJumpWide 12\n0012 OpReturnValue\n",
+		},
+		{
+			name: "not-tail",
+			ins: ConcatInstructions(
+				MakeInstructions(t, code.OpConstant, 0),
+				MakeInstructions(t, code.OpCurrentClosure),
+				MakeInstructions(t, code.OpCall, 0),
+				MakeInstructions(t, code.OpAdd),
+				MakeInstructions(t, code.OpReturnValue),
+			),
+			want: "0000 OpConstant 0\n0003 OpCurrentClosure\n0004 OpCall 0\n0006 OpAdd\n0007 OpReturnValue\n",
+		},
+		{
+			name: "backward-jump",
+			ins: ConcatInstructions(
+				MakeInstructions(t, code.OpCurrentClosure),
+				MakeInstructions(t, code.OpCall, 0),
+				MakeInstructions(t, code.OpJump, 3),
+			),
+			want: "0000 OpCurrentClosure\n0001 OpCall 0\n0003 OpJump 3\n",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			code.MarkTailCalls(tt.ins)
+			assert.Equal(t, tt.want, tt.ins.String())
+		})
+	}
+}
+
+func TestMarkTailCallsInvalid(t *testing.T) {
+	t.Parallel()
+
+	ins := code.Instructions{byte(code.OpCall), 0, byte(code.OpJump), 0}
+	code.MarkTailCalls(ins)
+	assert.Equal(t, code.Instructions{byte(code.OpCall), 0, byte(code.OpJump), 0}, ins)
+}
@@ -1,35 +1,95 @@
 package compiler
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/Warashi/monkey/ast"
 	"github.com/Warashi/monkey/code"
 	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/token"
 )
 
 type (
 	Bytecode struct {
 		Instructions code.Instructions
 		Constants    []object.Object
+		SourceMap    code.SourceMap
+		// names of the global bindings by index, to report reads of globals which are not set yet
+		Globals []string
 	}
 	EmittedInstruction struct {
 		Opcode   code.Opcode
 		Position int
 	}
-	Compiler struct {
+	CompilationScope struct {
 		instructions        code.Instructions
-		constants           []object.Object
+		sourceMap           code.SourceMap
 		lastInstruction     EmittedInstruction
 		previousInstruction EmittedInstruction
 	}
+	Compiler struct {
+		constants []object.Object
+		// index of each interned constant, keyed by constantKey
+		constantIndex map[any]int
+		symbolTable   *SymbolTable
+		scopes        []CompilationScope
+		scopeIndex    int
+
+		// position of the node being compiled, recorded in the source map of emitted instructions
+		position token.Position
+		// whether constant expressions are evaluated at compile time
+		foldConstants bool
+		// whether code.Optimize is applied to the emitted instructions
+		optimize bool
+	}
 )
 
 func New() *Compiler {
-	return new(Compiler)
+	symbolTable := NewSymbolTable()
+	for i, b := range object.Builtins {
+		symbolTable.DefineBuiltin(i, b.Name)
+	}
+	return NewWithState(symbolTable, nil)
+}
+
+// NewWithState returns a Compiler which continues from the given symbol table and constant pool,
+// so that successive compilations can share their definitions.
+func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
+	c := &Compiler{
+		constants:     constants,
+		constantIndex: make(map[any]int, len(constants)),
+		symbolTable:   s,
+		scopes:        []CompilationScope{{sourceMap: make(code.SourceMap)}},
+		foldConstants: true,
+		optimize:      true,
+	}
+	for i, obj := range constants {
+		if key, ok := constantKey(obj); ok {
+			if _, ok := c.constantIndex[key]; !ok {
+				c.constantIndex[key] = i
+			}
+		}
+	}
+	return c
+}
+
+// DisablePeepholeOptimization makes the compiler keep the instructions as emitted, without code.Optimize.
+func (c *Compiler) DisablePeepholeOptimization() {
+	c.optimize = false
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	if node == nil {
+		return errors.New("missing node")
+	}
+	if pos := node.Pos(); pos.IsValid() {
+		defer func(outer token.Position) { c.position = outer }(c.position)
+		c.position = pos
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, stmt := range node.Statements {
@@ -51,53 +111,61 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 	case *ast.IfExpression:
+		if cond, ok := c.constantValue(node.Condition); ok {
+			if err := c.compileConstantIf(node, isTruthy(cond)); err != nil {
+				return fmt.Errorf("c.compileConstantIf: %w", err)
+			}
+			return nil
+		}
 		if err := c.Compile(node.Condition); err != nil {
 			return fmt.Errorf("c.Compile(%T): %w", node, err)
 		}
-		// emit an `OpJumpNotTruthy` with a bogus value
-		jumpNotTruthyPos, err := c.emit(code.OpJumpNotTruthy, 9999)
+		// emit an `OpJumpNotTruthy` with a bogus value, wide so that any target fits until Compact
+		jumpNotTruthyPos, err := c.emit(code.OpJumpNotTruthyWide, 9999)
 		if err != nil {
 			return fmt.Errorf("c.emit: %w", err)
 		}
 
-		if err := c.Compile(node.Consequence); err != nil {
-			return fmt.Errorf("c.Compile(%T): %w", node, err)
-		}
-
-		if c.lastInstructionIsPop() {
-			c.removeLastPop()
+		if err := c.compileBranch(node.Consequence); err != nil {
+			return fmt.Errorf("c.compileBranch: %w", err)
 		}
-		// emit an `OpJump` with a bogus value
-		jumpPos, err := c.emit(code.OpJump, 9999)
+		// emit an `OpJump` with a bogus value, wide so that any target fits until Compact
+		jumpPos, err := c.emit(code.OpJumpWide, 9999)
 		if err != nil {
 			return fmt.Errorf("c.emit: %w", err)
 		}
-		afterConsequencePos := len(c.instructions)
-		c.changeOperand(jumpNotTruthyPos, int64(afterConsequencePos))
-
-		if node.Alternative == nil {
-			if _, err := c.emit(code.OpNull); err != nil {
-				return fmt.Errorf("c.emit: %w", err)
-			}
-		} else {
-			if err := c.Compile(node.Alternative); err != nil {
-				return fmt.Errorf("c.Compile(%T): %w", node, err)
-			}
+		afterConsequencePos := len(c.currentInstructions())
+		if err := c.changeOperand(jumpNotTruthyPos, int64(afterConsequencePos)); err != nil {
+			return fmt.Errorf("c.changeOperand: %w", err)
+		}
 
-			if c.lastInstructionIsPop() {
-				c.removeLastPop()
-			}
+		if err := c.compileBranch(node.Alternative); err != nil {
+			return fmt.Errorf("c.compileBranch: %w", err)
+		}
+		afterAlternativePos := len(c.currentInstructions())
+		if err := c.changeOperand(jumpPos, int64(afterAlternativePos)); err != nil {
+			return fmt.Errorf("c.changeOperand: %w", err)
 		}
-		afterAlternativePos := len(c.instructions)
-		c.changeOperand(jumpPos, int64(afterAlternativePos))
 	case *ast.PrefixExpression:
+		if v, ok := c.constantValue(node); ok {
+			if _, err := c.emitValue(v); err != nil {
+				return fmt.Errorf("c.emitValue: %w", err)
+			}
+			return nil
+		}
 		if err := c.Compile(node.Right); err != nil {
 			return fmt.Errorf("c.Compile(%T): %w", node, err)
 		}
 		if _, err := c.emitPrefixOp(node.Operator); err != nil {
-			return fmt.Errorf("c.emitPrefixOp: %w", err)
+			return &token.Error{Pos: node.Pos(), Err: fmt.Errorf("c.emitPrefixOp: %w", err)}
 		}
 	case *ast.InfixExpression:
+		if v, ok := c.constantValue(node); ok {
+			if _, err := c.emitValue(v); err != nil {
+				return fmt.Errorf("c.emitValue: %w", err)
+			}
+			return nil
+		}
 		switch node.Operator {
 		case "<":
 			if err := c.Compile(node.Right); err != nil {
@@ -117,11 +185,140 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return fmt.Errorf("c.Compile(%T): %w", node, err)
 			}
 			if _, err := c.emitInfixOp(node.Operator); err != nil {
-				return fmt.Errorf("c.emitInfixOp: %w", err)
+				return &token.Error{Pos: node.Pos(), Err: fmt.Errorf("c.emitInfixOp: %w", err)}
 			}
 		}
+	case *ast.LetStatement:
+		if err := c.Compile(node.Value); err != nil {
+			return fmt.Errorf("c.Compile(%T): %w", node, err)
+		}
+		symbol := c.symbolTable.Define(node.Name.Value)
+		if _, err := c.storeSymbol(symbol); err != nil {
+			return fmt.Errorf("c.storeSymbol: %w", err)
+		}
+	case *ast.ReturnStatement:
+		if err := c.Compile(node.Value); err != nil {
+			return fmt.Errorf("c.Compile(%T): %w", node, err)
+		}
+		if _, err := c.emit(code.OpReturnValue); err != nil {
+			return fmt.Errorf("c.emit: %w", err)
+		}
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(node.Value)
+		if !ok {
+			return &token.Error{Pos: node.Pos(), Err: fmt.Errorf("undefined variable: %s", node.Value)}
+		}
+		if _, err := c.loadSymbol(symbol); err != nil {
+			return fmt.Errorf("c.loadSymbol: %w", err)
+		}
+	case *ast.FunctionLiteral:
+		c.enterScope()
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+		}
+		for _, p := range node.Parameters {
+			c.symbolTable.Define(p.Value)
+		}
+		if err := c.Compile(node.Body); err != nil {
+			return fmt.Errorf("c.Compile(%T): %w", node, err)
+		}
+		if c.lastInstructionIs(code.OpPop) {
+			if err := c.replaceLastPopWithReturn(); err != nil {
+				return fmt.Errorf("c.replaceLastPopWithReturn: %w", err)
+			}
+		}
+		ok, err := c.loadLetValue(node.Body)
+		if err != nil {
+			return fmt.Errorf("c.loadLetValue: %w", err)
+		}
+		if ok {
+			if _, err := c.emit(code.OpReturnValue); err != nil {
+				return fmt.Errorf("c.emit: %w", err)
+			}
+		}
+		if !c.lastInstructionIs(code.OpReturnValue) {
+			if _, err := c.emit(code.OpReturn); err != nil {
+				return fmt.Errorf("c.emit: %w", err)
+			}
+		}
+		freeSymbols := c.symbolTable.FreeSymbols
+		numLocals := c.symbolTable.numDefinitions
+		sourceMap := c.scopes[c.scopeIndex].sourceMap
+		body := c.leaveScope()
+		code.MarkTailCalls(body)
+		instructions, sourceMap := c.finish(body, sourceMap)
+
+		for _, s := range freeSymbols {
+			if _, err := c.loadSymbol(s); err != nil {
+				return fmt.Errorf("c.loadSymbol: %w", err)
+			}
+		}
+
+		fn := object.CompiledFunction{
+			Name:          node.Name,
+			Instructions:  instructions,
+			NumLocals:     numLocals,
+			NumParameters: len(node.Parameters),
+			SourceMap:     sourceMap,
+		}
+		if _, err := c.emitClosure(fn, len(freeSymbols)); err != nil {
+			return fmt.Errorf("c.emit: %w", err)
+		}
+	case *ast.CallExpression:
+		if err := c.Compile(node.Function); err != nil {
+			return fmt.Errorf("c.Compile(%T): %w", node, err)
+		}
+		for _, a := range node.Arguments {
+			if err := c.Compile(a); err != nil {
+				return fmt.Errorf("c.Compile(%T): %w", node, err)
+			}
+		}
+		if _, err := c.emit(code.OpCall, int64(len(node.Arguments))); err != nil {
+			return fmt.Errorf("c.emit: %w", err)
+		}
 	case *ast.IntegerLiteral:
-		if _, err := c.emit(code.OpConstant, c.addConstant(object.Integer{Value: node.Value})); err != nil {
+		if _, err := c.emitConstant(object.Integer{Value: node.Value}); err != nil {
+			return fmt.Errorf("c.emitConstant: %w", err)
+		}
+	case *ast.StringLiteral:
+		if _, err := c.emitConstant(object.String{Value: node.Value}); err != nil {
+			return fmt.Errorf("c.emitConstant: %w", err)
+		}
+	case *ast.ArrayLiteral:
+		for _, e := range node.Elements {
+			if err := c.Compile(e); err != nil {
+				return fmt.Errorf("c.Compile(%T): %w", node, err)
+			}
+		}
+		if _, err := c.emit(code.OpArray, int64(len(node.Elements))); err != nil {
+			return fmt.Errorf("c.emit: %w", err)
+		}
+	case *ast.HashLiteral:
+		keys := make([]ast.Expression, 0, len(node.Pairs))
+		for k := range node.Pairs {
+			keys = append(keys, k)
+		}
+		// sort keys so that the emitted instructions are deterministic
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			if err := c.Compile(k); err != nil {
+				return fmt.Errorf("c.Compile(%T): %w", node, err)
+			}
+			if err := c.Compile(node.Pairs[k]); err != nil {
+				return fmt.Errorf("c.Compile(%T): %w", node, err)
+			}
+		}
+		if _, err := c.emit(code.OpHash, int64(len(node.Pairs)*2)); err != nil {
+			return fmt.Errorf("c.emit: %w", err)
+		}
+	case *ast.IndexExpression:
+		if err := c.Compile(node.Left); err != nil {
+			return fmt.Errorf("c.Compile(%T): %w", node, err)
+		}
+		if err := c.Compile(node.Right); err != nil {
+			return fmt.Errorf("c.Compile(%T): %w", node, err)
+		}
+		if _, err := c.emit(code.OpIndex); err != nil {
 			return fmt.Errorf("c.emit: %w", err)
 		}
 	case *ast.BooleanLiteral:
@@ -136,41 +333,217 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 	default:
-		return fmt.Errorf("unknown type: %T", node)
+		return &token.Error{Pos: node.Pos(), Err: fmt.Errorf("unknown type: %T", node)}
 	}
 	return nil
 }
 
 func (c *Compiler) Bytecode() Bytecode {
+	instructions, sourceMap := c.finish(c.currentInstructions(), c.scopes[c.scopeIndex].sourceMap)
 	return Bytecode{
-		Instructions: c.instructions,
+		Instructions: instructions,
 		Constants:    c.constants,
+		SourceMap:    sourceMap,
+		Globals:      c.symbolTable.globalNames,
 	}
 }
 
+func (c *Compiler) currentInstructions() code.Instructions {
+	return c.scopes[c.scopeIndex].instructions
+}
+
+func (c *Compiler) enterScope() {
+	c.scopes = append(c.scopes, CompilationScope{sourceMap: make(code.SourceMap)})
+	c.scopeIndex++
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveScope() code.Instructions {
+	instructions := c.currentInstructions()
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+	c.symbolTable = c.symbolTable.Outer
+	return instructions
+}
+
+// addConstant returns the index of obj in the constant pool, adding it unless an equal constant is there.
 func (c *Compiler) addConstant(obj object.Object) int64 {
+	key, ok := constantKey(obj)
+	if ok {
+		if i, ok := c.constantIndex[key]; ok {
+			return int64(i)
+		}
+		c.constantIndex[key] = len(c.constants)
+	}
 	c.constants = append(c.constants, obj)
 	return int64(len(c.constants) - 1)
 }
 
-func (c *Compiler) addInstruction(ins code.Instructions) int {
-	posNewInstruction := len(c.instructions)
-	c.instructions = append(c.instructions, ins...)
-	return posNewInstruction
+// functionKey identifies a compiled function. The source map is a part of it, so that functions
+// written in different places stay apart and report runtime errors where they are written.
+type functionKey struct {
+	name          string
+	instructions  string
+	numLocals     int
+	numParameters int
+	sourceMap     string
+}
+
+// constantKey returns the key of obj in Compiler.constantIndex. ok is false if obj is not interned.
+func constantKey(obj object.Object) (key any, ok bool) {
+	switch obj := obj.(type) {
+	case object.Integer, object.String:
+		return obj, true
+	case object.CompiledFunction:
+		return functionKey{
+			name:          obj.Name,
+			instructions:  string(obj.Instructions),
+			numLocals:     obj.NumLocals,
+			numParameters: obj.NumParameters,
+			sourceMap:     sourceMapKey(obj.SourceMap),
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+// sourceMapKey returns a comparable form of m, which lists its positions in the order of the offsets.
+func sourceMapKey(m code.SourceMap) string {
+	offsets := make([]int, 0, len(m))
+	for offset := range m {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+	var b strings.Builder
+	for _, offset := range offsets {
+		pos := m[offset]
+		fmt.Fprintf(&b, "%d:%q:%d;", offset, pos.Filename, pos.Offset)
+	}
+	return b.String()
+}
+
+// compileBranch compiles a branch of an if expression so that it leaves the value of the branch on
+// the stack: the value of its last expression or let statement, or null if the branch is missing,
+// empty or ends with another statement.
+func (c *Compiler) compileBranch(branch *ast.BlockStatement) error {
+	if branch != nil {
+		start := len(c.currentInstructions())
+		if err := c.Compile(branch); err != nil {
+			return fmt.Errorf("c.Compile(%T): %w", branch, err)
+		}
+		if c.lastInstructionIs(code.OpPop) && start <= c.scopes[c.scopeIndex].lastInstruction.Position {
+			c.removeLastPop()
+			return nil
+		}
+		ok, err := c.loadLetValue(branch)
+		if err != nil {
+			return fmt.Errorf("c.loadLetValue: %w", err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	if _, err := c.emit(code.OpNull); err != nil {
+		return fmt.Errorf("c.emit: %w", err)
+	}
+	return nil
+}
+
+// loadLetValue emits the instruction to load the binding of the let statement which block ends with,
+// if it does, since the value of the let is the value of the block. It reports whether block ends so.
+func (c *Compiler) loadLetValue(block *ast.BlockStatement) (bool, error) {
+	if len(block.Statements) == 0 {
+		return false, nil
+	}
+	let, ok := block.Statements[len(block.Statements)-1].(*ast.LetStatement)
+	if !ok {
+		return false, nil
+	}
+	symbol, ok := c.symbolTable.Resolve(let.Name.Value)
+	if !ok {
+		return false, fmt.Errorf("undefined variable: %s", let.Name.Value)
+	}
+	if _, err := c.loadSymbol(symbol); err != nil {
+		return false, fmt.Errorf("c.loadSymbol: %w", err)
+	}
+	return true, nil
+}
+
+// emitConstant adds obj to the constant pool and emits the instruction to load it,
+// which is OpConstantWide if the index does not fit in OpConstant.
+func (c *Compiler) emitConstant(obj object.Object) (int, error) {
+	idx := c.addConstant(obj)
+	if idx > code.MaxOperand(2) {
+		return c.emit(code.OpConstantWide, idx)
+	}
+	return c.emit(code.OpConstant, idx)
+}
+
+// emitClosure adds fn to the constant pool and emits the instruction to make a closure of it,
+// which is OpClosureWide if the index does not fit in OpClosure.
+func (c *Compiler) emitClosure(fn object.CompiledFunction, numFree int) (int, error) {
+	idx := c.addConstant(fn)
+	if idx > code.MaxOperand(2) {
+		return c.emit(code.OpClosureWide, idx, int64(numFree))
+	}
+	return c.emit(code.OpClosure, idx, int64(numFree))
+}
+
+// finish returns the instructions of a scope as they are run: optimized unless disabled,
+// and compacted so that instructions emitted in the wide form are narrowed where possible.
+func (c *Compiler) finish(instructions code.Instructions, sourceMap code.SourceMap) (code.Instructions, code.SourceMap) {
+	if c.optimize {
+		return code.Optimize(instructions, sourceMap)
+	}
+	return code.Compact(instructions, sourceMap)
 }
 
 func (c *Compiler) emit(op code.Opcode, operands ...int64) (int, error) {
-	ins, err := code.Make(op, operands...)
+	scope := &c.scopes[c.scopeIndex]
+	pos := len(scope.instructions)
+	ins, err := code.Append(scope.instructions, op, operands...)
 	if err != nil {
-		return 0, fmt.Errorf("code.Make: %w", err)
+		// operands overflow in large programs, so the error is reported where it happened
+		return 0, &token.Error{Pos: c.position, Err: fmt.Errorf("code.Append: %w", err)}
+	}
+	scope.instructions = ins
+	if c.position.IsValid() {
+		scope.sourceMap[pos] = c.position
 	}
-	pos := c.addInstruction(ins)
 
 	c.setLastInstruction(op, pos)
 
 	return pos, nil
 }
 
+func (c *Compiler) loadSymbol(s Symbol) (int, error) {
+	switch s.Scope {
+	case GlobalScope:
+		return c.emit(code.OpGetGlobal, int64(s.Index))
+	case LocalScope:
+		return c.emit(code.OpGetLocal, int64(s.Index))
+	case FreeScope:
+		return c.emit(code.OpGetFree, int64(s.Index))
+	case FunctionScope:
+		return c.emit(code.OpCurrentClosure)
+	case BuiltinScope:
+		return c.emit(code.OpGetBuiltin, int64(s.Index))
+	default:
+		return 0, fmt.Errorf("unknown scope: %s", s.Scope)
+	}
+}
+
+func (c *Compiler) storeSymbol(s Symbol) (int, error) {
+	switch s.Scope {
+	case GlobalScope:
+		return c.emit(code.OpSetGlobal, int64(s.Index))
+	case LocalScope:
+		return c.emit(code.OpSetLocal, int64(s.Index))
+	default:
+		return 0, fmt.Errorf("unknown scope: %s", s.Scope)
+	}
+}
+
 func (c *Compiler) emitPrefixOp(op string) (int, error) {
 	switch op {
 	case "!":
@@ -192,6 +565,8 @@ func (c *Compiler) emitInfixOp(op string) (int, error) {
 		return c.emit(code.OpMul)
 	case "/":
 		return c.emit(code.OpDiv)
+	case "%":
+		return c.emit(code.OpMod)
 	case ">":
 		return c.emit(code.OpGreaterThan)
 	case "==":
@@ -204,29 +579,45 @@ func (c *Compiler) emitInfixOp(op string) (int, error) {
 }
 
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
-	previous := c.lastInstruction
-	last := EmittedInstruction{Opcode: op, Position: pos}
-
-	c.previousInstruction = previous
-	c.lastInstruction = last
+	scope := &c.scopes[c.scopeIndex]
+	scope.previousInstruction = scope.lastInstruction
+	scope.lastInstruction = EmittedInstruction{Opcode: op, Position: pos}
 }
 
-func (c *Compiler) lastInstructionIsPop() bool {
-	return c.lastInstruction.Opcode == code.OpPop
+func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+	return c.scopes[c.scopeIndex].lastInstruction.Opcode == op
 }
 
 func (c *Compiler) removeLastPop() {
-	c.instructions = c.instructions[:c.lastInstruction.Position]
+	scope := &c.scopes[c.scopeIndex]
+	delete(scope.sourceMap, scope.lastInstruction.Position)
+	scope.instructions = scope.instructions[:scope.lastInstruction.Position]
+	scope.lastInstruction = scope.previousInstruction
+}
+
+func (c *Compiler) replaceLastPopWithReturn() error {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	ins, err := code.Make(code.OpReturnValue)
+	if err != nil {
+		return fmt.Errorf("code.Make: %w", err)
+	}
+	c.replaceInstruction(lastPos, ins)
+	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
+	return nil
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction code.Instructions) {
+	ins := c.currentInstructions()
 	for i := range newInstruction {
-		c.instructions[pos+i] = newInstruction[i]
+		ins[pos+i] = newInstruction[i]
 	}
 }
 
 func (c *Compiler) changeOperand(opPos int, operand int64) error {
-	op := code.Opcode(c.instructions[opPos])
+	op := code.Opcode(c.currentInstructions()[opPos])
 	newInstruction, err := code.Make(op, operand)
 	if err != nil {
 		return fmt.Errorf("code.Make: %w", err)
@@ -0,0 +1,57 @@
+package compiler_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Warashi/monkey/ast"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/parser"
+	"github.com/stretchr/testify/require"
+)
+
+// generateProgram returns a program with n functions, each of which is called from the main program.
+func generateProgram(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "let fun_%s = fn(a, b) { let c = a * %d + b; if (c > %d) { [c, a, b][0] } else { {\"c\": c}[\"c\"] } };\n", name(i), i, i*2)
+		fmt.Fprintf(&b, "let val_%s = fun_%s(%d, -%d) - len(\"%s\");\n", name(i), name(i), i, i, name(i))
+	}
+	return b.String()
+}
+
+// name returns a distinct identifier suffix for i, since identifiers cannot contain digits.
+func name(i int) string {
+	var b strings.Builder
+	for {
+		b.WriteByte(byte('a' + i%26))
+		i /= 26
+		if i == 0 {
+			return b.String()
+		}
+	}
+}
+
+func parseBench(b *testing.B, input string) *ast.Program {
+	b.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.Parse()
+	require.Empty(b, p.Errors())
+	return program
+}
+
+func BenchmarkCompile(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		program := parseBench(b, generateProgram(n))
+		b.Run(fmt.Sprintf("functions=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := compiler.New().Compile(program); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package compiler_test
 
 import (
 	"bytes"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/Warashi/monkey/code"
@@ -10,7 +12,9 @@ import (
 	"github.com/Warashi/monkey/object"
 	"github.com/Warashi/monkey/parser"
 	. "github.com/Warashi/monkey/testutil"
+	"github.com/Warashi/monkey/token"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -21,6 +25,12 @@ type testcase struct {
 	want  compiler.Bytecode
 }
 
+// source maps and global names are tested separately, so that instruction tests stay readable
+var ignoreDebugInfo = cmp.Options{
+	cmpopts.IgnoreFields(compiler.Bytecode{}, "SourceMap", "Globals"),
+	cmpopts.IgnoreFields(object.CompiledFunction{}, "SourceMap"),
+}
+
 func TestIntegerArithmetric(t *testing.T) {
 	t.Parallel()
 	type ()
@@ -95,6 +105,22 @@ func TestIntegerArithmetric(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:  "percent",
+			input: "1 % 2",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpMod),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{
+					int(1),
+					int(2),
+				},
+			},
+		},
 		{
 			name:  "semicolon",
 			input: "1; 2",
@@ -133,9 +159,10 @@ func TestIntegerArithmetric(t *testing.T) {
 			program := parser.New(lexer.New(tt.input)).Parse()
 
 			compiler := compiler.New()
+			compiler.DisableConstantFolding()
 			require.NoError(t, compiler.Compile(program))
-			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got) {
-				t.Error(cmp.Diff(want, got))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
 			}
 		})
 	}
@@ -150,8 +177,8 @@ func TestBooleanExpressions(t *testing.T) {
 	)
 
 	tests := []testcase{
-		{"true", "true", compiler.Bytecode{cat(instr(t, code.OpTrue), instr(t, code.OpPop)), nil}},
-		{"false", "false", compiler.Bytecode{cat(instr(t, code.OpFalse), instr(t, code.OpPop)), nil}},
+		{"true", "true", compiler.Bytecode{Instructions: cat(instr(t, code.OpTrue), instr(t, code.OpPop))}},
+		{"false", "false", compiler.Bytecode{Instructions: cat(instr(t, code.OpFalse), instr(t, code.OpPop))}},
 		{"gt", "1 > 2", compiler.Bytecode{
 			Instructions: cat(
 				instr(t, code.OpConstant, 0),
@@ -234,12 +261,13 @@ func TestBooleanExpressions(t *testing.T) {
 			program := parser.New(lexer.New(tt.input)).Parse()
 
 			compiler := compiler.New()
+			compiler.DisableConstantFolding()
 			require.NoError(t, compiler.Compile(program))
-			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got) {
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
 				if !cmp.Equal(want.Instructions, got.Instructions) {
 					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
 				}
-				t.Error(cmp.Diff(want, got))
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
 			}
 		})
 	}
@@ -249,12 +277,14 @@ func TestInstructionsString(t *testing.T) {
 	want := `0000 OpAdd
 0001 OpConstant 2
 0004 OpConstant 65535
+0007 OpClosure 65535 255
 `
 
 	got := ConcatInstructions(
 		MakeInstructions(t, code.OpAdd),
 		MakeInstructions(t, code.OpConstant, 2),
 		MakeInstructions(t, code.OpConstant, 65535),
+		MakeInstructions(t, code.OpClosure, 65535, 255),
 	)
 
 	assert.Equal(t, want, got.String())
@@ -266,7 +296,11 @@ func TestReadOperands(t *testing.T) {
 		op        code.Opcode
 		operands  []int64
 		bytesRead int
-	}{}
+	}{
+		{"constant", code.OpConstant, []int64{65535}, 2},
+		{"get-local", code.OpGetLocal, []int64{255}, 1},
+		{"closure", code.OpClosure, []int64{65535, 255}, 3},
+	}
 
 	for _, tt := range tests {
 		tt := tt
@@ -334,6 +368,319 @@ func TestConditionals(t *testing.T) {
 				),
 			},
 		},
+		{
+			name:  "let-in-branch",
+			input: "let y = 2; if (y) { let x = 1; }; 5;",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(2), int(1), int(5)},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpGetGlobal, 0),
+					instr(t, code.OpJumpNotTruthy, 24),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpSetGlobal, 1),
+					instr(t, code.OpGetGlobal, 1),
+					instr(t, code.OpJump, 25),
+					instr(t, code.OpNull),
+					instr(t, code.OpPop),
+					instr(t, code.OpConstant, 2),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "empty-branches",
+			input: "let y = 2; if (y) { } else { };",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(2)},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpGetGlobal, 0),
+					instr(t, code.OpJumpNotTruthy, 16),
+					instr(t, code.OpNull),
+					instr(t, code.OpJump, 17),
+					instr(t, code.OpNull),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			compiler.DisableConstantFolding()
+			compiler.DisablePeepholeOptimization()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				if !cmp.Equal(want.Instructions, got.Instructions) {
+					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
+				}
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		int   = IntegerObject
+	)
+	tests := []testcase{
+		{
+			name:  "define",
+			input: "let one = 1; let two = 2;",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(1), int(2)},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpSetGlobal, 1),
+				),
+			},
+		},
+		{
+			name:  "resolve",
+			input: "let one = 1; one;",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(1)},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpGetGlobal, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "rebind",
+			input: "let one = 1; let two = one; two;",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(1)},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpGetGlobal, 0),
+					instr(t, code.OpSetGlobal, 1),
+					instr(t, code.OpGetGlobal, 1),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				if !cmp.Equal(want.Instructions, got.Instructions) {
+					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
+				}
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestUndefinedVariable(t *testing.T) {
+	t.Parallel()
+	program := parser.New(lexer.New("let one = 1; two;")).Parse()
+	err := compiler.New().Compile(program)
+	assert.ErrorContains(t, err, "undefined variable: two")
+
+	var posErr *token.Error
+	if assert.ErrorAs(t, err, &posErr) {
+		assert.Equal(t, token.Position{Offset: 13, Line: 1, Column: 14}, posErr.Pos)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	t.Parallel()
+	program := parser.New(lexer.New("1 + 2;\nfn() { 3 };")).Parse()
+	compiler := compiler.New()
+	compiler.DisableConstantFolding()
+	require.NoError(t, compiler.Compile(program))
+	bytecode := compiler.Bytecode()
+
+	pos := func(offset, line, column int) token.Position {
+		return token.Position{Offset: offset, Line: line, Column: column}
+	}
+	want := code.SourceMap{
+		0:  pos(0, 1, 1), // OpConstant 1
+		3:  pos(4, 1, 5), // OpConstant 2
+		6:  pos(2, 1, 3), // OpAdd
+		7:  pos(0, 1, 1), // OpPop
+		8:  pos(7, 2, 1), // OpClosure
+		12: pos(7, 2, 1), // OpPop
+	}
+	assert.Equal(t, want, bytecode.SourceMap)
+
+	fn, ok := bytecode.Constants[3].(object.CompiledFunction)
+	require.True(t, ok)
+	want = code.SourceMap{
+		0: pos(14, 2, 8), // OpConstant 3
+		3: pos(14, 2, 8), // OpReturnValue
+	}
+	assert.Equal(t, want, fn.SourceMap)
+}
+
+func TestStringExpressions(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		str   = StringObject
+	)
+	tests := []testcase{
+		{
+			name:  "literal",
+			input: `"monkey"`,
+			want: compiler.Bytecode{
+				Constants: []object.Object{str("monkey")},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "concat",
+			input: `"mon" + "key"`,
+			want: compiler.Bytecode{
+				Constants: []object.Object{str("mon"), str("key")},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpAdd),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			compiler.DisableConstantFolding()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				if !cmp.Equal(want.Instructions, got.Instructions) {
+					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
+				}
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestCompositeLiterals(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		int   = IntegerObject
+	)
+	tests := []testcase{
+		{
+			name:  "array/empty",
+			input: "[]",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpArray, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "array",
+			input: "[1, 2 + 3]",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(1), int(2), int(3)},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpConstant, 2),
+					instr(t, code.OpAdd),
+					instr(t, code.OpArray, 2),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "hash/empty",
+			input: "{}",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpHash, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "hash",
+			input: "{2: 3 * 4, 1: 5}",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(1), int(5), int(2), int(3), int(4)},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpConstant, 2),
+					instr(t, code.OpConstant, 3),
+					instr(t, code.OpConstant, 4),
+					instr(t, code.OpMul),
+					instr(t, code.OpHash, 4),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "index/array",
+			input: "[1, 2][1 - 1]",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(1), int(2)},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpArray, 2),
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSub),
+					instr(t, code.OpIndex),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "index/hash",
+			input: "{1: 2}[1]",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(1), int(2)},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpHash, 2),
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpIndex),
+					instr(t, code.OpPop),
+				),
+			},
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -342,13 +689,842 @@ func TestConditionals(t *testing.T) {
 			program := parser.New(lexer.New(tt.input)).Parse()
 
 			compiler := compiler.New()
+			compiler.DisableConstantFolding()
 			require.NoError(t, compiler.Compile(program))
-			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got) {
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
 				if !cmp.Equal(want.Instructions, got.Instructions) {
 					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
 				}
-				t.Error(cmp.Diff(want, got))
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
 			}
 		})
 	}
 }
+
+func TestFunctions(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		int   = IntegerObject
+	)
+	tests := []testcase{
+		{
+			name:  "return",
+			input: "fn() { return 5 + 10 }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(5),
+					int(10),
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpConstant, 0),
+							instr(t, code.OpConstant, 1),
+							instr(t, code.OpAdd),
+							instr(t, code.OpReturnValue),
+						),
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 2, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "implicit-return",
+			input: "fn() { 5 + 10 }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(5),
+					int(10),
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpConstant, 0),
+							instr(t, code.OpConstant, 1),
+							instr(t, code.OpAdd),
+							instr(t, code.OpReturnValue),
+						),
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 2, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "multiple-statements",
+			input: "fn() { 1; 2 }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(1),
+					int(2),
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpConstant, 0),
+							instr(t, code.OpPop),
+							instr(t, code.OpConstant, 1),
+							instr(t, code.OpReturnValue),
+						),
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 2, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "empty-body",
+			input: "fn() { }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					object.CompiledFunction{
+						Instructions: instr(t, code.OpReturn),
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 0, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "call",
+			input: "fn() { 24 }();",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(24),
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpConstant, 0),
+							instr(t, code.OpReturnValue),
+						),
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 1, 0),
+					instr(t, code.OpCall, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "call-with-arguments",
+			input: "let f = fn(a, b) { a; b }; f(24, 25);",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					object.CompiledFunction{
+						Name: "f",
+						Instructions: cat(
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpPop),
+							instr(t, code.OpGetLocal, 1),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals:     2,
+						NumParameters: 2,
+					},
+					int(24),
+					int(25),
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 0, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpGetGlobal, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpConstant, 2),
+					instr(t, code.OpCall, 2),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			compiler.DisableConstantFolding()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				if !cmp.Equal(want.Instructions, got.Instructions) {
+					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
+				}
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestLetStatementScopes(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		int   = IntegerObject
+	)
+	tests := []testcase{
+		{
+			name:  "global",
+			input: "let num = 55; fn() { num }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(55),
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpGetGlobal, 0),
+							instr(t, code.OpReturnValue),
+						),
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpClosure, 1, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "local-at-end",
+			input: "fn() { let a = 55; }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(55),
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpConstant, 0),
+							instr(t, code.OpSetLocal, 0),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals: 1,
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 1, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "local",
+			input: "fn() { let a = 55; let b = 77; a + b }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(55),
+					int(77),
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpConstant, 0),
+							instr(t, code.OpSetLocal, 0),
+							instr(t, code.OpConstant, 1),
+							instr(t, code.OpSetLocal, 1),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpGetLocal, 1),
+							instr(t, code.OpAdd),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals: 2,
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 2, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				if !cmp.Equal(want.Instructions, got.Instructions) {
+					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
+				}
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestClosures(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		int   = IntegerObject
+	)
+	tests := []testcase{
+		{
+			name:  "free",
+			input: "fn(a) { fn(b) { a + b } }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpGetFree, 0),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpAdd),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals:     1,
+						NumParameters: 1,
+					},
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpClosure, 0, 1),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals:     1,
+						NumParameters: 1,
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 1, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "nested-free",
+			input: "fn(a) { fn(b) { fn(c) { a + b + c } } }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpGetFree, 0),
+							instr(t, code.OpGetFree, 1),
+							instr(t, code.OpAdd),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpAdd),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals:     1,
+						NumParameters: 1,
+					},
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpGetFree, 0),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpClosure, 0, 2),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals:     1,
+						NumParameters: 1,
+					},
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpClosure, 1, 1),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals:     1,
+						NumParameters: 1,
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 2, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "global-and-local",
+			input: "let global = 55; fn() { let a = 66; fn() { let b = 77; global + a + b } }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(55),
+					int(66),
+					int(77),
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpConstant, 2),
+							instr(t, code.OpSetLocal, 0),
+							instr(t, code.OpGetGlobal, 0),
+							instr(t, code.OpGetFree, 0),
+							instr(t, code.OpAdd),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpAdd),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals: 1,
+					},
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpConstant, 1),
+							instr(t, code.OpSetLocal, 0),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpClosure, 3, 1),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals: 1,
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpClosure, 4, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				if !cmp.Equal(want.Instructions, got.Instructions) {
+					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
+				}
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		int   = IntegerObject
+	)
+	tests := []testcase{
+		{
+			name:  "global",
+			input: "let countDown = fn(x) { countDown(x - 1); }; countDown(1);",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(1),
+					object.CompiledFunction{
+						Name: "countDown",
+						Instructions: cat(
+							instr(t, code.OpCurrentClosure),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpConstant, 0),
+							instr(t, code.OpSub),
+							instr(t, code.OpTailCall, 1),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals:     1,
+						NumParameters: 1,
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 1, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpGetGlobal, 0),
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpCall, 1),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "local",
+			input: "let wrapper = fn() { let countDown = fn(x) { countDown(x - 1); }; countDown(1); }; wrapper();",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					int(1),
+					object.CompiledFunction{
+						Name: "countDown",
+						Instructions: cat(
+							instr(t, code.OpCurrentClosure),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpConstant, 0),
+							instr(t, code.OpSub),
+							instr(t, code.OpTailCall, 1),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals:     1,
+						NumParameters: 1,
+					},
+					object.CompiledFunction{
+						Name: "wrapper",
+						Instructions: cat(
+							instr(t, code.OpClosure, 1, 0),
+							instr(t, code.OpSetLocal, 0),
+							instr(t, code.OpGetLocal, 0),
+							instr(t, code.OpConstant, 0),
+							instr(t, code.OpTailCall, 1),
+							instr(t, code.OpReturnValue),
+						),
+						NumLocals: 1,
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 2, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpGetGlobal, 0),
+					instr(t, code.OpCall, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				if !cmp.Equal(want.Instructions, got.Instructions) {
+					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
+				}
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		int   = IntegerObject
+	)
+	tests := []testcase{
+		{
+			name:  "global",
+			input: "len([]); push([], 1);",
+			want: compiler.Bytecode{
+				Constants: []object.Object{int(1)},
+				Instructions: cat(
+					instr(t, code.OpGetBuiltin, 0),
+					instr(t, code.OpArray, 0),
+					instr(t, code.OpCall, 1),
+					instr(t, code.OpPop),
+					instr(t, code.OpGetBuiltin, 5),
+					instr(t, code.OpArray, 0),
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpCall, 2),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "local",
+			input: "fn() { len([]) }",
+			want: compiler.Bytecode{
+				Constants: []object.Object{
+					object.CompiledFunction{
+						Instructions: cat(
+							instr(t, code.OpGetBuiltin, 0),
+							instr(t, code.OpArray, 0),
+							instr(t, code.OpTailCall, 1),
+							instr(t, code.OpReturnValue),
+						),
+					},
+				},
+				Instructions: cat(
+					instr(t, code.OpClosure, 0, 0),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				if !cmp.Equal(want.Instructions, got.Instructions) {
+					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
+				}
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "branches",
+			input: "let f = fn(x) { if (x) { f(x) } else { 1 + f(x) } };",
+			want: `0000 OpGetLocal 0
+0002 OpJumpNotTruthy 13
+0005 OpCurrentClosure
+0006 OpGetLocal 0
+0008 OpTailCall 1
+0010 OpJump 22
+0013 OpConstant 0
+0016 OpCurrentClosure
+0017 OpGetLocal 0
+0019 OpCall 1
+0021 OpAdd
+0022 OpReturnValue
+`,
+		},
+		{
+			name:  "return",
+			input: "let f = fn(x) { if (x) { return f(x); }; len(x) };",
+			want: `0000 OpGetLocal 0
+0002 OpJumpNotTruthy 11
+0005 OpCurrentClosure
+0006 OpGetLocal 0
+0008 OpTailCall 1
+0010 OpReturnValue
+0011 OpGetBuiltin 0
+0013 OpGetLocal 0
+0015 OpTailCall 1
+0017 OpReturnValue
+`,
+		},
+		{
+			name:  "let",
+			input: "let f = fn(x) { let y = f(x); y };",
+			want: `0000 OpCurrentClosure
+0001 OpGetLocal 0
+0003 OpCall 1
+0005 OpSetLocal 1
+0007 OpGetLocal 1
+0009 OpReturnValue
+`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(program))
+			constants := compiler.Bytecode().Constants
+			fn, ok := constants[len(constants)-1].(object.CompiledFunction)
+			require.True(t, ok)
+			assert.Equal(t, tt.want, fn.Instructions.String())
+		})
+	}
+}
+
+func TestPeepholeOptimization(t *testing.T) {
+	t.Parallel()
+	program := parser.New(lexer.New("let x = 1;\nif (x) { 2 };\nx")).Parse()
+
+	unoptimized := compiler.New()
+	unoptimized.DisablePeepholeOptimization()
+	require.NoError(t, unoptimized.Compile(program))
+	assert.Equal(t, `0000 OpConstant 0
+0003 OpSetGlobal 0
+0006 OpGetGlobal 0
+0009 OpJumpNotTruthy 18
+0012 OpConstant 1
+0015 OpJump 19
+0018 OpNull
+0019 OpPop
+0020 OpGetGlobal 0
+0023 OpPop
+`, unoptimized.Bytecode().Instructions.String())
+
+	optimized := compiler.New()
+	require.NoError(t, optimized.Compile(program))
+	bytecode := optimized.Bytecode()
+	assert.Equal(t, `0000 OpConstant 0
+0003 OpSetGlobal 0
+0006 OpGetGlobal 0
+0009 OpJumpNotTruthy 16
+0012 OpConstant 1
+0015 OpPop
+0016 OpGetGlobal 0
+0019 OpPop
+`, bytecode.Instructions.String())
+	assert.Equal(t, 3, bytecode.SourceMap[16].Line)
+}
+
+func TestConstantDeduplication(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		int   = IntegerObject
+	)
+
+	tests := []testcase{
+		{
+			name:  "literals",
+			input: `1; "a"; 1; "a"; 2; 1`,
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpPop),
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpPop),
+					instr(t, code.OpConstant, 2),
+					instr(t, code.OpPop),
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(1), object.String{Value: "a"}, int(2)},
+			},
+		},
+		{
+			// functions written in different places report their own positions, so they are not merged
+			name:  "functions",
+			input: "fn(x) { x }; fn(x) { x };",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpClosure, 0, 0),
+					instr(t, code.OpPop),
+					instr(t, code.OpClosure, 1, 0),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{
+					object.CompiledFunction{
+						Instructions:  cat(instr(t, code.OpGetLocal, 0), instr(t, code.OpReturnValue)),
+						NumLocals:     1,
+						NumParameters: 1,
+					},
+					object.CompiledFunction{
+						Instructions:  cat(instr(t, code.OpGetLocal, 0), instr(t, code.OpReturnValue)),
+						NumLocals:     1,
+						NumParameters: 1,
+					},
+				},
+			},
+		},
+		{
+			// constants of a discarded branch are removed from the pool
+			name:  "dead-branch",
+			input: "1; if (false) { 1; 2 }; 2",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(1), int(2)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestConstantDeduplicationOfFunctions(t *testing.T) {
+	t.Parallel()
+	program := parser.New(lexer.New("fn(x) { x }; let f = fn(x) { x };")).Parse()
+
+	// compiling the same source again gives functions with the same source maps, such as a line
+	// which is entered twice in the repl
+	c := compiler.New()
+	require.NoError(t, c.Compile(program))
+	require.NoError(t, c.Compile(program))
+	constants := c.Bytecode().Constants
+	require.Len(t, constants, 2)
+	assert.Equal(t, "", constants[0].(object.CompiledFunction).Name)
+	assert.Equal(t, "f", constants[1].(object.CompiledFunction).Name)
+}
+
+func TestConstantDeduplicationWithState(t *testing.T) {
+	t.Parallel()
+	program := parser.New(lexer.New(`"b"; 5`)).Parse()
+
+	c := compiler.NewWithState(compiler.NewSymbolTable(), []object.Object{IntegerObject(5)})
+	require.NoError(t, c.Compile(program))
+	bytecode := c.Bytecode()
+	assert.Equal(t, []object.Object{IntegerObject(5), object.String{Value: "b"}}, bytecode.Constants)
+	assert.Equal(t, "0000 OpConstant 1\n0003 OpPop\n0004 OpConstant 0\n0007 OpPop\n", bytecode.Instructions.String())
+}
+
+// integers returns a program which has the integers from 0 to n-1 as its statements, so that they
+// need n constants.
+func integers(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString(strconv.Itoa(i))
+		b.WriteString(";\n")
+	}
+	return b.String()
+}
+
+func TestWideOperands(t *testing.T) {
+	t.Parallel()
+	program := parser.New(lexer.New("let t = true; if (t) { " + integers(0x10001) + "} else { 0 }")).Parse()
+
+	c := compiler.New()
+	require.NoError(t, c.Compile(program))
+	bytecode := c.Bytecode()
+	require.Len(t, bytecode.Constants, 0x10001)
+
+	listing := bytecode.Instructions.String()
+	assert.Contains(t, listing, "0007 OpJumpNotTruthyWide 262166\n")
+	assert.Contains(t, listing, "262152 OpConstant 65535\n")
+	assert.Contains(t, listing, "262156 OpConstantWide 65536\n")
+	assert.Contains(t, listing, "262161 OpJumpWide 262169\n")
+}
+
+func TestWideClosure(t *testing.T) {
+	t.Parallel()
+	program := parser.New(lexer.New(integers(0x10001) + "fn() { 1 }")).Parse()
+
+	c := compiler.New()
+	require.NoError(t, c.Compile(program))
+	bytecode := c.Bytecode()
+	require.Len(t, bytecode.Constants, 0x10002)
+
+	listing := bytecode.Instructions.String()
+	assert.Contains(t, listing, "OpConstantWide 65536\n")
+	assert.Contains(t, listing, "OpClosureWide 65537 0\n")
+}
+
+func TestOperandOverflow(t *testing.T) {
+	t.Parallel()
+	src := "fn() { 1 }(" + strings.Repeat("1, ", 0xFF) + "1)"
+	program := parser.New(lexer.New(src)).Parse()
+
+	err := compiler.New().Compile(program)
+	require.ErrorIs(t, err, code.ErrOperandOverflow)
+	assert.ErrorContains(t, err, "operand 256 of OpCall out of range [0, 255]")
+
+	var posErr *token.Error
+	if assert.ErrorAs(t, err, &posErr) {
+		assert.Equal(t, token.Position{Offset: 10, Line: 1, Column: 11}, posErr.Pos)
+	}
+}
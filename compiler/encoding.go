@@ -0,0 +1,331 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/token"
+)
+
+// Bytecode files (.mkc) consist of a header and a payload.
+//
+//	header:  magic "MKC\x00" | version uint16 | CRC-32 (IEEE) of the payload uint32
+//	payload: filenames | main function | constants | global names
+//
+// All integers are big endian. Strings and byte slices are prefixed by their uint32 length.
+const (
+	BytecodeMagic   = "MKC\x00"
+	BytecodeVersion = 2
+
+	headerSize = len(BytecodeMagic) + 2 + 4
+)
+
+var (
+	ErrNotBytecode        = errors.New("not a monkey bytecode file")
+	ErrUnsupportedVersion = errors.New("unsupported bytecode version")
+	ErrChecksumMismatch   = errors.New("bytecode checksum mismatch")
+)
+
+// constant tags in the constant pool
+const (
+	_ byte = iota
+	tagInteger
+	tagString
+	tagCompiledFunction
+)
+
+// IsEncodedBytecode reports whether data starts with the bytecode file header.
+func IsEncodedBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(BytecodeMagic))
+}
+
+// MarshalBinary encodes b in the bytecode file format.
+func (b Bytecode) MarshalBinary() ([]byte, error) {
+	e := &encoder{filenames: make(map[string]uint32)}
+	e.addFilenames(b.SourceMap)
+	for _, c := range b.Constants {
+		if fn, ok := c.(object.CompiledFunction); ok {
+			e.addFilenames(fn.SourceMap)
+		}
+	}
+	// keep the output deterministic regardless of map iteration order
+	sort.Strings(e.filenameList)
+	for i, f := range e.filenameList {
+		e.filenames[f] = uint32(i)
+	}
+
+	var payload bytes.Buffer
+	e.buf = &payload
+	e.writeUint32(len(e.filenameList))
+	for _, f := range e.filenameList {
+		e.writeString(f)
+	}
+	e.writeFunction(object.CompiledFunction{Instructions: b.Instructions, SourceMap: b.SourceMap})
+	e.writeUint32(len(b.Constants))
+	for i, c := range b.Constants {
+		if err := e.writeConstant(c); err != nil {
+			return nil, fmt.Errorf("constant %d: %w", i, err)
+		}
+	}
+	e.writeUint32(len(b.Globals))
+	for _, name := range b.Globals {
+		e.writeString(name)
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, headerSize+payload.Len()))
+	out.WriteString(BytecodeMagic)
+	binary.Write(out, binary.BigEndian, uint16(BytecodeVersion))
+	binary.Write(out, binary.BigEndian, crc32.ChecksumIEEE(payload.Bytes()))
+	out.Write(payload.Bytes())
+	return out.Bytes(), nil
+}
+
+// UnmarshalBinary decodes data in the bytecode file format into b.
+func (b *Bytecode) UnmarshalBinary(data []byte) error {
+	if !IsEncodedBytecode(data) || len(data) < headerSize {
+		return ErrNotBytecode
+	}
+	header := data[len(BytecodeMagic):headerSize]
+	if v := binary.BigEndian.Uint16(header); v != BytecodeVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, v)
+	}
+	payload := data[headerSize:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[2:]) {
+		return ErrChecksumMismatch
+	}
+
+	d := &decoder{r: bytes.NewReader(payload)}
+	n, err := d.readLength()
+	if err != nil {
+		return fmt.Errorf("d.readLength: %w", err)
+	}
+	d.filenames = make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		f, err := d.readString()
+		if err != nil {
+			return fmt.Errorf("d.readString: %w", err)
+		}
+		d.filenames = append(d.filenames, f)
+	}
+	main, err := d.readFunction()
+	if err != nil {
+		return fmt.Errorf("d.readFunction: %w", err)
+	}
+	n, err = d.readLength()
+	if err != nil {
+		return fmt.Errorf("d.readLength: %w", err)
+	}
+	constants := make([]object.Object, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := d.readConstant()
+		if err != nil {
+			return fmt.Errorf("constant %d: %w", i, err)
+		}
+		constants = append(constants, c)
+	}
+	n, err = d.readLength()
+	if err != nil {
+		return fmt.Errorf("d.readLength: %w", err)
+	}
+	var globals []string
+	for i := 0; i < n; i++ {
+		name, err := d.readString()
+		if err != nil {
+			return fmt.Errorf("global %d: %w", i, err)
+		}
+		globals = append(globals, name)
+	}
+	if d.r.Len() != 0 {
+		return fmt.Errorf("%d bytes of trailing data", d.r.Len())
+	}
+
+	*b = Bytecode{Instructions: main.Instructions, Constants: constants, SourceMap: main.SourceMap, Globals: globals}
+	return nil
+}
+
+type encoder struct {
+	buf          *bytes.Buffer
+	filenames    map[string]uint32
+	filenameList []string
+}
+
+func (e *encoder) addFilenames(m code.SourceMap) {
+	for _, pos := range m {
+		if _, ok := e.filenames[pos.Filename]; !ok {
+			e.filenames[pos.Filename] = 0
+			e.filenameList = append(e.filenameList, pos.Filename)
+		}
+	}
+}
+
+func (e *encoder) writeUint32(v int) {
+	binary.Write(e.buf, binary.BigEndian, uint32(v))
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeUint32(len(b))
+	e.buf.Write(b)
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeBytes([]byte(s))
+}
+
+func (e *encoder) writeConstant(c object.Object) error {
+	switch c := c.(type) {
+	case object.Integer:
+		e.buf.WriteByte(tagInteger)
+		binary.Write(e.buf, binary.BigEndian, c.Value)
+	case object.String:
+		e.buf.WriteByte(tagString)
+		e.writeString(c.Value)
+	case object.CompiledFunction:
+		e.buf.WriteByte(tagCompiledFunction)
+		e.writeFunction(c)
+	default:
+		return fmt.Errorf("unsupported constant type: %s", c.Type())
+	}
+	return nil
+}
+
+func (e *encoder) writeFunction(fn object.CompiledFunction) {
+	e.writeString(fn.Name)
+	e.writeUint32(fn.NumLocals)
+	e.writeUint32(fn.NumParameters)
+	e.writeBytes(fn.Instructions)
+
+	offsets := make([]int, 0, len(fn.SourceMap))
+	for offset := range fn.SourceMap {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+	e.writeUint32(len(offsets))
+	for _, offset := range offsets {
+		pos := fn.SourceMap[offset]
+		e.writeUint32(offset)
+		e.writeUint32(int(e.filenames[pos.Filename]))
+		e.writeUint32(pos.Offset)
+		e.writeUint32(pos.Line)
+		e.writeUint32(pos.Column)
+	}
+}
+
+type decoder struct {
+	r         *bytes.Reader
+	filenames []string
+}
+
+func (d *decoder) readUint32() (int, error) {
+	var v uint32
+	if err := binary.Read(d.r, binary.BigEndian, &v); err != nil {
+		return 0, fmt.Errorf("binary.Read: %w", err)
+	}
+	return int(v), nil
+}
+
+// readLength reads a count of following items, each of which takes at least one byte.
+func (d *decoder) readLength() (int, error) {
+	n, err := d.readUint32()
+	if err != nil {
+		return 0, fmt.Errorf("d.readUint32: %w", err)
+	}
+	if n > d.r.Len() {
+		return 0, fmt.Errorf("length %d exceeds remaining %d bytes: %w", n, d.r.Len(), io.ErrUnexpectedEOF)
+	}
+	return n, nil
+}
+
+func (d *decoder) readBytes() ([]byte, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, fmt.Errorf("d.readLength: %w", err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	return b, nil
+}
+
+func (d *decoder) readString() (string, error) {
+	b, err := d.readBytes()
+	if err != nil {
+		return "", fmt.Errorf("d.readBytes: %w", err)
+	}
+	return string(b), nil
+}
+
+func (d *decoder) readConstant() (object.Object, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("d.r.ReadByte: %w", err)
+	}
+	switch tag {
+	case tagInteger:
+		var v int64
+		if err := binary.Read(d.r, binary.BigEndian, &v); err != nil {
+			return nil, fmt.Errorf("binary.Read: %w", err)
+		}
+		return object.Integer{Value: v}, nil
+	case tagString:
+		s, err := d.readString()
+		if err != nil {
+			return nil, fmt.Errorf("d.readString: %w", err)
+		}
+		return object.String{Value: s}, nil
+	case tagCompiledFunction:
+		fn, err := d.readFunction()
+		if err != nil {
+			return nil, fmt.Errorf("d.readFunction: %w", err)
+		}
+		return fn, nil
+	default:
+		return nil, fmt.Errorf("unknown constant tag: %d", tag)
+	}
+}
+
+func (d *decoder) readFunction() (object.CompiledFunction, error) {
+	var (
+		fn  object.CompiledFunction
+		err error
+	)
+	if fn.Name, err = d.readString(); err != nil {
+		return fn, fmt.Errorf("d.readString: %w", err)
+	}
+	if fn.NumLocals, err = d.readUint32(); err != nil {
+		return fn, fmt.Errorf("d.readUint32: %w", err)
+	}
+	if fn.NumParameters, err = d.readUint32(); err != nil {
+		return fn, fmt.Errorf("d.readUint32: %w", err)
+	}
+	if fn.Instructions, err = d.readBytes(); err != nil {
+		return fn, fmt.Errorf("d.readBytes: %w", err)
+	}
+
+	n, err := d.readLength()
+	if err != nil {
+		return fn, fmt.Errorf("d.readLength: %w", err)
+	}
+	fn.SourceMap = make(code.SourceMap, n)
+	for i := 0; i < n; i++ {
+		var entry [5]int
+		for j := range entry {
+			if entry[j], err = d.readUint32(); err != nil {
+				return fn, fmt.Errorf("d.readUint32: %w", err)
+			}
+		}
+		offset, file := entry[0], entry[1]
+		if file >= len(d.filenames) {
+			return fn, fmt.Errorf("filename index out of range: %d", file)
+		}
+		fn.SourceMap[offset] = token.Position{Filename: d.filenames[file], Offset: entry[2], Line: entry[3], Column: entry[4]}
+	}
+	return fn, nil
+}
@@ -0,0 +1,124 @@
+package compiler_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/parser"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compileFile(t *testing.T, filename, input string) compiler.Bytecode {
+	t.Helper()
+	p := parser.New(lexer.NewFile(filename, input))
+	program := p.Parse()
+	require.Empty(t, p.Errors())
+
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(program))
+	return compiler.Bytecode()
+}
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"integers", "1 + 2; -9223372036854775807 - 1"},
+		{"strings", `"monkey" + ""`},
+		{"closures", "let newAdder = fn(a) { fn(b) { a + b }; }; let addTwo = newAdder(2); addTwo(3);"},
+		{"recursive", "let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } }; countDown(3);"},
+		{"globals", "let x = 1; let x = x + 1; if (x > 1) { let y = x; }; y"},
+		{"composite", `let h = {"one": [1, 2], "two": len("two")}; h["one"][1]`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			want := compileFile(t, "test.monkey", tt.input)
+
+			b, err := want.MarshalBinary()
+			require.NoError(t, err)
+			assert.True(t, compiler.IsEncodedBytecode(b))
+
+			var got compiler.Bytecode
+			require.NoError(t, got.UnmarshalBinary(b))
+			if !cmp.Equal(want, got, cmpopts.EquateEmpty()) {
+				t.Error(cmp.Diff(want, got, cmpopts.EquateEmpty()))
+			}
+
+			again, err := got.MarshalBinary()
+			require.NoError(t, err)
+			assert.Equal(t, b, again, "encoding must be deterministic")
+		})
+	}
+}
+
+func TestBytecodeUnsupportedConstant(t *testing.T) {
+	t.Parallel()
+	bytecode := compiler.Bytecode{
+		Instructions: code.Instructions{},
+		Constants:    []object.Object{object.Boolean{Value: true}},
+	}
+	_, err := bytecode.MarshalBinary()
+	assert.ErrorContains(t, err, "unsupported constant type: Boolean")
+}
+
+func TestBytecodeUnmarshalErrors(t *testing.T) {
+	t.Parallel()
+	valid, err := compileFile(t, "test.monkey", `let f = fn(x) { x + "!" }; f("hi")`).MarshalBinary()
+	require.NoError(t, err)
+
+	// withChecksum fixes up the checksum so that the payload itself is checked
+	withChecksum := func(b []byte) []byte {
+		b = append([]byte{}, b...)
+		binary.BigEndian.PutUint32(b[6:], crc32.ChecksumIEEE(b[10:]))
+		return b
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+		msg  string
+	}{
+		{name: "empty", data: nil, want: compiler.ErrNotBytecode},
+		{name: "source", data: []byte("let a = 1;"), want: compiler.ErrNotBytecode},
+		{name: "header-only", data: valid[:6], want: compiler.ErrNotBytecode},
+		{name: "version", data: func() []byte {
+			b := append([]byte{}, valid...)
+			binary.BigEndian.PutUint16(b[4:], compiler.BytecodeVersion+1)
+			return b
+		}(), want: compiler.ErrUnsupportedVersion},
+		{name: "checksum", data: func() []byte {
+			b := append([]byte{}, valid...)
+			b[len(b)-1] ^= 0xff
+			return b
+		}(), want: compiler.ErrChecksumMismatch},
+		{name: "truncated", data: withChecksum(valid[:len(valid)-3]), msg: "unexpected EOF"},
+		{name: "trailing", data: withChecksum(append(append([]byte{}, valid...), 0)), msg: "1 bytes of trailing data"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var got compiler.Bytecode
+			err := got.UnmarshalBinary(tt.data)
+			if tt.want != nil {
+				assert.ErrorIs(t, err, tt.want)
+			} else {
+				assert.ErrorContains(t, err, tt.msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/Warashi/monkey/ast"
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/object"
+)
+
+// DisableConstantFolding makes the compiler emit every operator as written, which is useful to debug
+// the instructions of an expression.
+func (c *Compiler) DisableConstantFolding() {
+	c.foldConstants = false
+}
+
+// constantValue evaluates node at compile time. ok is false when folding is disabled, node is not
+// a constant expression, or evaluating it fails, so that the error is still reported by the vm.
+func (c *Compiler) constantValue(node ast.Expression) (value object.Object, ok bool) {
+	if !c.foldConstants {
+		return nil, false
+	}
+	return constantValue(node)
+}
+
+func constantValue(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return object.Integer{Value: node.Value}, true
+	case *ast.StringLiteral:
+		return object.String{Value: node.Value}, true
+	case *ast.BooleanLiteral:
+		return object.Boolean{Value: node.Value}, true
+	case *ast.PrefixExpression:
+		right, ok := constantValue(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldPrefix(node.Operator, right)
+	case *ast.InfixExpression:
+		left, ok := constantValue(node.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := constantValue(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldInfix(node.Operator, left, right)
+	default:
+		return nil, false
+	}
+}
+
+// foldPrefix and foldInfix follow the semantics of the vm, and give up on anything the vm rejects.
+// Integer operations are checked, so that overflow is left to the vm which may wrap around or not.
+
+func foldPrefix(op string, right object.Object) (object.Object, bool) {
+	switch op {
+	case "!":
+		return object.Boolean{Value: !isTruthy(right)}, true
+	case "-":
+		if right, ok := right.(object.Integer); ok {
+			value, err := object.IntegerNegation(right.Value, true)
+			if err != nil {
+				return nil, false
+			}
+			return object.Integer{Value: value}, true
+		}
+	}
+	return nil, false
+}
+
+func foldInfix(op string, left, right object.Object) (object.Object, bool) {
+	switch left := left.(type) {
+	case object.Integer:
+		right, ok := right.(object.Integer)
+		if !ok {
+			return nil, false
+		}
+		switch op {
+		case "+", "-", "*", "/", "%":
+			value, err := object.IntegerOperation(op, left.Value, right.Value, true)
+			if err != nil {
+				return nil, false
+			}
+			return object.Integer{Value: value}, true
+		case "<":
+			return object.Boolean{Value: left.Value < right.Value}, true
+		case ">":
+			return object.Boolean{Value: left.Value > right.Value}, true
+		case "==":
+			return object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return object.Boolean{Value: left.Value != right.Value}, true
+		}
+	case object.String:
+		right, ok := right.(object.String)
+		if !ok {
+			return nil, false
+		}
+		switch op {
+		case "+":
+			return object.String{Value: left.Value + right.Value}, true
+		case "<":
+			return object.Boolean{Value: left.Value < right.Value}, true
+		case ">":
+			return object.Boolean{Value: left.Value > right.Value}, true
+		case "==":
+			return object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return object.Boolean{Value: left.Value != right.Value}, true
+		}
+	case object.Boolean:
+		right, ok := right.(object.Boolean)
+		if !ok {
+			return nil, false
+		}
+		switch op {
+		case "==":
+			return object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return object.Boolean{Value: left.Value != right.Value}, true
+		}
+	}
+	return nil, false
+}
+
+func isTruthy(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case object.Boolean:
+		return obj.Value
+	case object.Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *Compiler) emitValue(obj object.Object) (int, error) {
+	switch obj := obj.(type) {
+	case object.Boolean:
+		if obj.Value {
+			return c.emit(code.OpTrue)
+		}
+		return c.emit(code.OpFalse)
+	default:
+		return c.emitConstant(obj)
+	}
+}
+
+// compileConstantIf compiles an if expression whose condition is known to be truthy or not.
+// The dead branch is compiled and then discarded, so that it reports the same errors and defines
+// the same symbols as it does without folding.
+func (c *Compiler) compileConstantIf(node *ast.IfExpression, truthy bool) error {
+	live := node.Consequence
+	if !truthy {
+		live = node.Alternative
+	}
+	for _, branch := range []*ast.BlockStatement{node.Consequence, node.Alternative} {
+		switch {
+		case branch == live:
+			// the branch is the value of the expression, as it is when not folded
+			if err := c.compileBranch(branch); err != nil {
+				return fmt.Errorf("c.compileBranch: %w", err)
+			}
+		case branch != nil:
+			m := c.mark()
+			if err := c.Compile(branch); err != nil {
+				return fmt.Errorf("c.Compile(%T): %w", node, err)
+			}
+			c.rewind(m)
+		}
+	}
+	return nil
+}
+
+// mark records the state of the current scope, to which rewind goes back.
+type mark struct {
+	instructions        int
+	constants           int
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+}
+
+func (c *Compiler) mark() mark {
+	scope := c.scopes[c.scopeIndex]
+	return mark{
+		instructions:        len(scope.instructions),
+		constants:           len(c.constants),
+		lastInstruction:     scope.lastInstruction,
+		previousInstruction: scope.previousInstruction,
+	}
+}
+
+// rewind discards the instructions and constants added since m. Symbols defined since m are kept.
+func (c *Compiler) rewind(m mark) {
+	scope := &c.scopes[c.scopeIndex]
+	for pos := range scope.sourceMap {
+		if pos >= m.instructions {
+			delete(scope.sourceMap, pos)
+		}
+	}
+	scope.instructions = scope.instructions[:m.instructions]
+	scope.lastInstruction = m.lastInstruction
+	scope.previousInstruction = m.previousInstruction
+	for i, obj := range c.constants[m.constants:] {
+		if key, ok := constantKey(obj); ok && c.constantIndex[key] == m.constants+i {
+			delete(c.constantIndex, key)
+		}
+	}
+	c.constants = c.constants[:m.constants]
+}
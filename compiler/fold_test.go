@@ -0,0 +1,227 @@
+package compiler_test
+
+import (
+	"testing"
+
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/parser"
+	. "github.com/Warashi/monkey/testutil"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConstantFolding(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+		int   = IntegerObject
+	)
+
+	tests := []testcase{
+		{
+			name:  "integer",
+			input: "60 * 60 * 24",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(86400)},
+			},
+		},
+		{
+			name:  "percent",
+			input: "-7 % 3",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(-1)},
+			},
+		},
+		{
+			name:  "minus",
+			input: "-(3 + 4)",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(-7)},
+			},
+		},
+		{
+			name:  "bang",
+			input: "!true; !5",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpFalse),
+					instr(t, code.OpPop),
+					instr(t, code.OpFalse),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "comparison",
+			input: "1 < 2 == true; 1 > 2 != false",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpTrue),
+					instr(t, code.OpPop),
+					instr(t, code.OpFalse),
+					instr(t, code.OpPop),
+				),
+			},
+		},
+		{
+			name:  "string",
+			input: `"mon" + "key"; "a" < "b"`,
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+					instr(t, code.OpTrue),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{object.String{Value: "monkey"}},
+			},
+		},
+		{
+			name:  "partial",
+			input: "let x = 1; x + 2 * 3",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSetGlobal, 0),
+					instr(t, code.OpGetGlobal, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpAdd),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(1), int(6)},
+			},
+		},
+		{
+			// errors are left to the vm
+			name:  "division-by-zero",
+			input: "1 / 0",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpDiv),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(1), int(0)},
+			},
+		},
+		{
+			// overflow is left to the vm, which wraps around unless checked
+			name:  "overflow",
+			input: "9223372036854775807 + 1",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpAdd),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(9223372036854775807), int(1)},
+			},
+		},
+		{
+			name:  "type-mismatch",
+			input: "1 + true",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpTrue),
+					instr(t, code.OpAdd),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(1)},
+			},
+		},
+		{
+			name:  "if-true",
+			input: "if (true) { 10 } else { 20 }; 3333;",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+					instr(t, code.OpConstant, 1),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(10), int(3333)},
+			},
+		},
+		{
+			name:  "if-false",
+			input: "if (1 > 2) { 10 } else { 20 }; if (!true) { 30 };",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+					instr(t, code.OpNull),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(20)},
+			},
+		},
+		{
+			name:  "if-empty",
+			input: "1; if (true) { };",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpPop),
+					instr(t, code.OpNull),
+					instr(t, code.OpPop),
+				),
+				Constants: []object.Object{int(1)},
+			},
+		},
+		{
+			// symbols defined in the dead branch are kept, as the branch is not a scope
+			name:  "if-dead-definition",
+			input: "if (false) { let a = 1; }; let b = 2;",
+			want: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpConstant, 0),
+					instr(t, code.OpSetGlobal, 1),
+				),
+				Constants: []object.Object{int(2)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(program))
+			if want, got := tt.want, compiler.Bytecode(); !cmp.Equal(want, got, ignoreDebugInfo) {
+				if !cmp.Equal(want.Instructions, got.Instructions) {
+					t.Log(cmp.Diff(want.Instructions.String(), got.Instructions.String()))
+				}
+				t.Error(cmp.Diff(want, got, ignoreDebugInfo))
+			}
+		})
+	}
+}
+
+func TestConstantFoldingDeadBranchError(t *testing.T) {
+	t.Parallel()
+	program := parser.New(lexer.New("if (false) { x }")).Parse()
+	err := compiler.New().Compile(program)
+	assert.ErrorContains(t, err, "undefined variable: x")
+}
@@ -0,0 +1,96 @@
+package compiler
+
+type SymbolScope string
+
+const (
+	GlobalScope   SymbolScope = "GLOBAL"
+	LocalScope    SymbolScope = "LOCAL"
+	FreeScope     SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
+	BuiltinScope  SymbolScope = "BUILTIN"
+)
+
+type (
+	Symbol struct {
+		Name  string
+		Scope SymbolScope
+		Index int
+	}
+	SymbolTable struct {
+		Outer       *SymbolTable
+		FreeSymbols []Symbol
+
+		store          map[string]Symbol
+		numDefinitions int
+		// names of the global bindings by index, including those shadowed by a later definition
+		globalNames []string
+	}
+)
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{store: make(map[string]Symbol)}
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+	return s
+}
+
+func (s *SymbolTable) Define(name string) Symbol {
+	symbol := Symbol{Name: name, Index: s.numDefinitions}
+	if s.Outer == nil {
+		symbol.Scope = GlobalScope
+		s.globalNames = append(s.globalNames, name)
+	} else {
+		symbol.Scope = LocalScope
+	}
+	s.store[name] = symbol
+	s.numDefinitions++
+	return symbol
+}
+
+// Clone returns a copy of s which later definitions in s leave unchanged, to go back to the state
+// before compiling a program which failed. The outer table is shared.
+func (s *SymbolTable) Clone() *SymbolTable {
+	clone := *s
+	clone.store = make(map[string]Symbol, len(s.store))
+	for name, symbol := range s.store {
+		clone.store[name] = symbol
+	}
+	clone.FreeSymbols = append([]Symbol(nil), s.FreeSymbols...)
+	clone.globalNames = append([]string(nil), s.globalNames...)
+	return &clone
+}
+
+func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Scope: BuiltinScope, Index: index}
+	s.store[name] = symbol
+	return symbol
+}
+
+// DefineFunctionName defines the name of the function being compiled so that it can refer to itself.
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Scope: FunctionScope, Index: 0}
+	s.store[name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+	symbol := Symbol{Name: original.Name, Scope: FreeScope, Index: len(s.FreeSymbols) - 1}
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	symbol, ok := s.store[name]
+	if ok || s.Outer == nil {
+		return symbol, ok
+	}
+	symbol, ok = s.Outer.Resolve(name)
+	if !ok || symbol.Scope == GlobalScope || symbol.Scope == BuiltinScope {
+		return symbol, ok
+	}
+	return s.defineFree(symbol), true
+}
@@ -0,0 +1,195 @@
+package compiler_test
+
+import (
+	"testing"
+
+	"github.com/Warashi/monkey/compiler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefine(t *testing.T) {
+	t.Parallel()
+	global := compiler.NewSymbolTable()
+
+	assert.Equal(t, compiler.Symbol{Name: "a", Scope: compiler.GlobalScope, Index: 0}, global.Define("a"))
+	assert.Equal(t, compiler.Symbol{Name: "b", Scope: compiler.GlobalScope, Index: 1}, global.Define("b"))
+}
+
+func TestResolveGlobal(t *testing.T) {
+	t.Parallel()
+	global := compiler.NewSymbolTable()
+	global.Define("a")
+	global.Define("b")
+
+	tests := []struct {
+		name string
+		want compiler.Symbol
+	}{
+		{"a", compiler.Symbol{Name: "a", Scope: compiler.GlobalScope, Index: 0}},
+		{"b", compiler.Symbol{Name: "b", Scope: compiler.GlobalScope, Index: 1}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := global.Resolve(tt.name)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, ok := global.Resolve("c")
+	assert.False(t, ok)
+}
+
+func TestResolveLocal(t *testing.T) {
+	t.Parallel()
+	global := compiler.NewSymbolTable()
+	global.Define("a")
+	global.Define("b")
+
+	firstLocal := compiler.NewEnclosedSymbolTable(global)
+	firstLocal.Define("c")
+	firstLocal.Define("d")
+
+	secondLocal := compiler.NewEnclosedSymbolTable(firstLocal)
+	secondLocal.Define("e")
+	secondLocal.Define("f")
+
+	tests := []struct {
+		name  string
+		table *compiler.SymbolTable
+		want  []compiler.Symbol
+	}{
+		{
+			name:  "first",
+			table: firstLocal,
+			want: []compiler.Symbol{
+				{Name: "a", Scope: compiler.GlobalScope, Index: 0},
+				{Name: "b", Scope: compiler.GlobalScope, Index: 1},
+				{Name: "c", Scope: compiler.LocalScope, Index: 0},
+				{Name: "d", Scope: compiler.LocalScope, Index: 1},
+			},
+		},
+		{
+			name:  "second",
+			table: secondLocal,
+			want: []compiler.Symbol{
+				{Name: "a", Scope: compiler.GlobalScope, Index: 0},
+				{Name: "b", Scope: compiler.GlobalScope, Index: 1},
+				{Name: "e", Scope: compiler.LocalScope, Index: 0},
+				{Name: "f", Scope: compiler.LocalScope, Index: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			for _, want := range tt.want {
+				got, ok := tt.table.Resolve(want.Name)
+				assert.True(t, ok)
+				assert.Equal(t, want, got)
+			}
+		})
+	}
+}
+
+func TestResolveFree(t *testing.T) {
+	t.Parallel()
+	global := compiler.NewSymbolTable()
+	global.Define("a")
+	global.Define("b")
+
+	firstLocal := compiler.NewEnclosedSymbolTable(global)
+	firstLocal.Define("c")
+	firstLocal.Define("d")
+
+	secondLocal := compiler.NewEnclosedSymbolTable(firstLocal)
+	secondLocal.Define("e")
+	secondLocal.Define("f")
+
+	for _, want := range []compiler.Symbol{
+		{Name: "a", Scope: compiler.GlobalScope, Index: 0},
+		{Name: "b", Scope: compiler.GlobalScope, Index: 1},
+		{Name: "c", Scope: compiler.FreeScope, Index: 0},
+		{Name: "d", Scope: compiler.FreeScope, Index: 1},
+		{Name: "e", Scope: compiler.LocalScope, Index: 0},
+		{Name: "f", Scope: compiler.LocalScope, Index: 1},
+	} {
+		got, ok := secondLocal.Resolve(want.Name)
+		assert.True(t, ok)
+		assert.Equal(t, want, got)
+	}
+	assert.Equal(t, []compiler.Symbol{
+		{Name: "c", Scope: compiler.LocalScope, Index: 0},
+		{Name: "d", Scope: compiler.LocalScope, Index: 1},
+	}, secondLocal.FreeSymbols)
+
+	_, ok := secondLocal.Resolve("g")
+	assert.False(t, ok)
+}
+
+func TestDefineAndResolveFunctionName(t *testing.T) {
+	t.Parallel()
+	global := compiler.NewSymbolTable()
+	global.DefineFunctionName("a")
+
+	got, ok := global.Resolve("a")
+	assert.True(t, ok)
+	assert.Equal(t, compiler.Symbol{Name: "a", Scope: compiler.FunctionScope, Index: 0}, got)
+}
+
+func TestShadowingFunctionName(t *testing.T) {
+	t.Parallel()
+	global := compiler.NewSymbolTable()
+	global.DefineFunctionName("a")
+	global.Define("a")
+
+	got, ok := global.Resolve("a")
+	assert.True(t, ok)
+	assert.Equal(t, compiler.Symbol{Name: "a", Scope: compiler.GlobalScope, Index: 0}, got)
+}
+
+func TestDefineResolveBuiltins(t *testing.T) {
+	t.Parallel()
+	global := compiler.NewSymbolTable()
+	firstLocal := compiler.NewEnclosedSymbolTable(global)
+	secondLocal := compiler.NewEnclosedSymbolTable(firstLocal)
+
+	want := []compiler.Symbol{
+		{Name: "a", Scope: compiler.BuiltinScope, Index: 0},
+		{Name: "c", Scope: compiler.BuiltinScope, Index: 1},
+		{Name: "e", Scope: compiler.BuiltinScope, Index: 2},
+		{Name: "f", Scope: compiler.BuiltinScope, Index: 3},
+	}
+	for i, s := range want {
+		global.DefineBuiltin(i, s.Name)
+	}
+
+	for _, table := range []*compiler.SymbolTable{global, firstLocal, secondLocal} {
+		for _, s := range want {
+			got, ok := table.Resolve(s.Name)
+			assert.True(t, ok)
+			assert.Equal(t, s, got)
+		}
+	}
+	assert.Empty(t, secondLocal.FreeSymbols)
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+	global := compiler.NewSymbolTable()
+	global.Define("a")
+
+	clone := global.Clone()
+	global.Define("b")
+	global.Define("a")
+
+	got, ok := clone.Resolve("a")
+	assert.True(t, ok)
+	assert.Equal(t, compiler.Symbol{Name: "a", Scope: compiler.GlobalScope, Index: 0}, got)
+	_, ok = clone.Resolve("b")
+	assert.False(t, ok)
+	assert.Equal(t, compiler.Symbol{Name: "c", Scope: compiler.GlobalScope, Index: 1}, clone.Define("c"))
+}
@@ -0,0 +1,218 @@
+// Package difftest runs programs on both the tree-walking evaluator and the vm, and reports where the
+// two engines disagree.
+//
+// The evaluator defines the semantics of the language, which the compiler and the vm have to reproduce,
+// so a divergence is a bug of the compiler or the vm. The known exceptions are programs which use
+// undefined identifiers where they are never evaluated, which the compiler rejects, and runs bounded
+// by Limits.MaxSteps, which counts different steps on each engine.
+//
+// Two runs of a program agree if they print the same output with `puts`, and either end with the same
+// value or both fail with errors of the same kind. Values are compared by their Inspect, except that
+// all functions are alike since the engines represent them differently. The kind of an error is the
+// error of Kinds which it wraps, if any; messages and positions of errors are not compared.
+package difftest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Warashi/monkey/ast"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/evaluator"
+	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/parser"
+	"github.com/Warashi/monkey/vm"
+)
+
+// Kinds are the kinds of errors which are told apart when comparing runs which failed. Other errors,
+// such as type errors, are of no kind and only have to happen on both engines.
+var Kinds = []error{
+	object.ErrDivisionByZero,
+	object.ErrIntegerOverflow,
+	object.ErrStepLimit,
+	object.ErrCallDepthLimit,
+	object.ErrAllocationLimit,
+	context.Canceled,
+	context.DeadlineExceeded,
+}
+
+// Result is the outcome of running a program on one engine.
+type Result struct {
+	Value  string // the value of the program in the form compared, if it did not fail
+	Output string // what the program printed with `puts`
+	Err    error  // the error the program failed with
+}
+
+// Kind returns the error of Kinds which r.Err wraps, or nil if it wraps none or r did not fail.
+func (r Result) Kind() error {
+	for _, kind := range Kinds {
+		if errors.Is(r.Err, kind) {
+			return kind
+		}
+	}
+	return nil
+}
+
+// Agrees reports whether r and other are the same outcome of a program.
+func (r Result) Agrees(other Result) bool {
+	if r.Output != other.Output || (r.Err == nil) != (other.Err == nil) {
+		return false
+	}
+	if r.Err != nil {
+		return r.Kind() == other.Kind()
+	}
+	return r.Value == other.Value
+}
+
+func (r Result) String() string {
+	var b strings.Builder
+	if r.Err != nil {
+		fmt.Fprintf(&b, "error: %s", r.Err)
+		if kind := r.Kind(); kind != nil {
+			fmt.Fprintf(&b, " (%s)", kind)
+		}
+	} else {
+		fmt.Fprintf(&b, "value: %s", r.Value)
+	}
+	if r.Output != "" {
+		fmt.Fprintf(&b, "\noutput: %q", r.Output)
+	}
+	return b.String()
+}
+
+// Compilation is how a program is compiled for the vm. The optimizations of the compiler must not
+// change the results of programs, so that each compilation has to agree with the evaluator.
+type Compilation struct {
+	NoFold     bool // compile with DisableConstantFolding
+	NoPeephole bool // compile with DisablePeepholeOptimization
+}
+
+// Compilations are the compilations Compare runs programs with.
+var Compilations = []Compilation{
+	{},
+	{NoFold: true},
+	{NoPeephole: true},
+	{NoFold: true, NoPeephole: true},
+}
+
+func (c Compilation) String() string {
+	var flags []string
+	if c.NoFold {
+		flags = append(flags, "nofold")
+	}
+	if c.NoPeephole {
+		flags = append(flags, "nopeephole")
+	}
+	if len(flags) == 0 {
+		return "optimized"
+	}
+	return strings.Join(flags, ", ")
+}
+
+// Divergence is the outcome of a program on which the engines disagree.
+type Divergence struct {
+	Eval        Result
+	VM          Result
+	Compilation Compilation // how the program was compiled for the run of VM
+}
+
+func (d Divergence) String() string {
+	indent := func(s string) string { return strings.ReplaceAll(s, "\n", "\n\t") }
+	return fmt.Sprintf("evaluator:\n\t%s\nvm (%s):\n\t%s", indent(d.Eval.String()), d.Compilation, indent(d.VM.String()))
+}
+
+// Compare runs src on the evaluator and, once for each of Compilations, on the vm with opts, and
+// returns how the first run of the vm which differs from the evaluator does, or nil if they all agree.
+// The runs are abandoned with the error of ctx once it is done.
+func Compare(ctx context.Context, src string, opts evaluator.Options) *Divergence {
+	want := Eval(ctx, src, opts)
+	for _, c := range Compilations {
+		if got := Run(ctx, src, opts, c); !want.Agrees(got) {
+			return &Divergence{Eval: want, VM: got, Compilation: c}
+		}
+	}
+	return nil
+}
+
+// Eval runs src on the evaluator with opts, capturing what it prints instead of writing to opts.Output.
+func Eval(ctx context.Context, src string, opts evaluator.Options) Result {
+	program, err := parse(src)
+	if err != nil {
+		return Result{Err: err}
+	}
+	var output strings.Builder
+	opts.Output = &output
+	result := evaluator.EvalContext(ctx, program, object.NewEnvironment(), opts)
+	if err, ok := result.(object.Error); ok {
+		return Result{Output: output.String(), Err: err}
+	}
+	return Result{Value: inspect(result), Output: output.String()}
+}
+
+// Run compiles src as c tells, and runs it on the vm with the checked arithmetic and limits of opts.
+func Run(ctx context.Context, src string, opts evaluator.Options, c Compilation) Result {
+	program, err := parse(src)
+	if err != nil {
+		return Result{Err: err}
+	}
+	comp := compiler.New()
+	if c.NoFold {
+		comp.DisableConstantFolding()
+	}
+	if c.NoPeephole {
+		comp.DisablePeepholeOptimization()
+	}
+	if err := comp.Compile(program); err != nil {
+		return Result{Err: fmt.Errorf("c.Compile: %w", err)}
+	}
+	machine := vm.New(comp.Bytecode())
+	if opts.CheckedArithmetic {
+		machine.EnableCheckedArithmetic()
+	}
+	machine.SetLimits(opts.Limits)
+	var output strings.Builder
+	machine.SetOutput(&output)
+	if err := machine.RunContext(ctx); err != nil {
+		return Result{Output: output.String(), Err: fmt.Errorf("machine.RunContext: %w", err)}
+	}
+	return Result{Value: inspect(machine.LastPopedStackElem()), Output: output.String()}
+}
+
+func parse(src string) (*ast.Program, error) {
+	p := parser.New(lexer.New(src))
+	program := p.Parse()
+	if errs := p.Errors(); len(errs) != 0 {
+		return nil, fmt.Errorf("parse error: %s", strings.Join(errs, "\n"))
+	}
+	return program, nil
+}
+
+// inspect returns the form of o which is compared between the engines: its Inspect, with functions
+// replaced by "<function>". It is empty if o is nil, for a program which has no value.
+func inspect(o object.Object) string {
+	switch o := o.(type) {
+	case nil:
+		return ""
+	case object.Function, object.Closure, object.CompiledFunction:
+		return "<function>"
+	case object.Array:
+		elements := make([]string, 0, len(o.Elements))
+		for _, e := range o.Elements {
+			elements = append(elements, inspect(e))
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case object.Hash:
+		pairs := make([]string, 0, len(o.Pairs))
+		for k, v := range o.Pairs {
+			pairs = append(pairs, fmt.Sprintf("%s:%s", inspect(k), inspect(v)))
+		}
+		sort.Strings(pairs)
+		return "{" + strings.Join(pairs, ", ") + "}"
+	default:
+		return o.Inspect()
+	}
+}
@@ -0,0 +1,123 @@
+package difftest_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Warashi/monkey/difftest"
+	"github.com/Warashi/monkey/evaluator"
+	"github.com/Warashi/monkey/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/txtar"
+)
+
+// TestCorpus runs each program of the archives in testdata on both engines. Every file of an archive
+// is a program named by the file.
+func TestCorpus(t *testing.T) {
+	t.Parallel()
+	archives, err := filepath.Glob("testdata/*.txtar")
+	require.NoError(t, err)
+	require.NotEmpty(t, archives)
+
+	options := []struct {
+		name string
+		opts evaluator.Options
+	}{
+		{"unchecked", evaluator.Options{}},
+		{"checked", evaluator.Options{CheckedArithmetic: true}},
+	}
+	for _, archive := range archives {
+		ar, err := txtar.ParseFile(archive)
+		require.NoError(t, err)
+		for _, f := range ar.Files {
+			f := f
+			name := strings.TrimSuffix(filepath.Base(archive), ".txtar") + "/" + f.Name
+			for _, o := range options {
+				o := o
+				t.Run(name+"/"+o.name, func(t *testing.T) {
+					t.Parallel()
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+					if d := difftest.Compare(ctx, string(f.Data), o.opts); d != nil {
+						t.Errorf("the engines diverge on\n%s\n%s", f.Data, d)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		input   string
+		diverge bool
+	}{
+		{"value", "1 + 2", false},
+		{"error-kind", "1 / 0", false},
+		{"error-without-kind", "1 + true", false},
+		// the compiler rejects undefined identifiers even where they are never evaluated
+		{"unreachable-undefined", "if (false) { x }", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			d := difftest.Compare(context.Background(), tt.input, evaluator.Options{})
+			assert.Equal(t, tt.diverge, d != nil, "%v", d)
+		})
+	}
+}
+
+func TestResultAgrees(t *testing.T) {
+	t.Parallel()
+	divisionByZero := object.Error{Message: "division by zero: 1 / 0", Err: object.ErrDivisionByZero}
+	tests := []struct {
+		name string
+		a, b difftest.Result
+		want bool
+	}{
+		{"same-value", difftest.Result{Value: "1"}, difftest.Result{Value: "1"}, true},
+		{"different-values", difftest.Result{Value: "1"}, difftest.Result{Value: "2"}, false},
+		{"different-outputs", difftest.Result{Value: "1", Output: "a\n"}, difftest.Result{Value: "1"}, false},
+		{"value-and-error", difftest.Result{Value: "1"}, difftest.Result{Err: divisionByZero}, false},
+		{"same-kind", difftest.Result{Err: divisionByZero}, difftest.Result{Err: object.ErrDivisionByZero}, true},
+		{"different-kinds", difftest.Result{Err: divisionByZero}, difftest.Result{Err: object.ErrIntegerOverflow}, false},
+		{"kind-and-no-kind", difftest.Result{Err: divisionByZero}, difftest.Result{Err: object.Error{Message: "type mismatch"}}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.want, tt.a.Agrees(tt.b))
+			assert.Equal(t, tt.want, tt.b.Agrees(tt.a))
+		})
+	}
+}
+
+func TestValues(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"[1, fn() { 2 }, len]", "[1, <function>, builtin function]"},
+		{`{"b": 2, "a": [fn() { 1 }]}`, "{a:[<function>], b:2}"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.input, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, difftest.Result{Value: tt.want}, difftest.Eval(context.Background(), tt.input, evaluator.Options{}))
+			for _, c := range difftest.Compilations {
+				assert.Equal(t, difftest.Result{Value: tt.want}, difftest.Run(context.Background(), tt.input, evaluator.Options{}, c), c)
+			}
+		})
+	}
+}
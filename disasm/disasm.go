@@ -0,0 +1,194 @@
+// Package disasm renders compiled bytecode as a human readable listing.
+//
+// The listing consists of the main instructions followed by the constant pool:
+//
+//	.main
+//		0000 OpConstant 0              ; Integer 1
+//		0003 OpJumpNotTruthy L0
+//		0006 OpNull
+//	L0:
+//		0007 OpPop
+//	.end
+//
+//	.constant 0 Integer 1
+//	.constant 1 String "monkey"
+//
+//	.function 2 "add" parameters=2 locals=2
+//		0000 OpGetLocal 0
+//		...
+//	.end
+//
+// Each instruction is prefixed by its offset. Jump operands are replaced by labels which are
+// placed in front of their targets, and operands referring to constants or builtins are annotated.
+package disasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/object"
+)
+
+// Disassemble writes the listing of b to w.
+func Disassemble(w io.Writer, b compiler.Bytecode) error {
+	d := &disassembler{w: w, constants: b.Constants}
+	fmt.Fprintln(w, ".main")
+	if err := d.instructions(b.Instructions); err != nil {
+		return fmt.Errorf("main: %w", err)
+	}
+	fmt.Fprintln(w, ".end")
+
+	// blocks are separated by blank lines, while consecutive constants are listed together
+	afterBlock := true
+	for i, c := range b.Constants {
+		fn, ok := c.(object.CompiledFunction)
+		if afterBlock || ok {
+			fmt.Fprintln(w)
+		}
+		afterBlock = ok
+		if !ok {
+			fmt.Fprintf(w, ".constant %d %s\n", i, Constant(c))
+			continue
+		}
+		fmt.Fprintf(w, ".function %d %s parameters=%d locals=%d\n", i, strconv.Quote(fn.Name), fn.NumParameters, fn.NumLocals)
+		if err := d.instructions(fn.Instructions); err != nil {
+			return fmt.Errorf("constant %d: %w", i, err)
+		}
+		fmt.Fprintln(w, ".end")
+	}
+	return nil
+}
+
+// Constant renders a constant pool entry as its type followed by its value.
+func Constant(c object.Object) string {
+	switch c := c.(type) {
+	case object.String:
+		return "String " + strconv.Quote(c.Value)
+	case object.CompiledFunction:
+		if c.Name == "" {
+			return "CompiledFunction <anonymous>"
+		}
+		return "CompiledFunction " + c.Name
+	default:
+		return c.Type().String() + " " + c.Inspect()
+	}
+}
+
+type instruction struct {
+	offset   int
+	def      code.Definition
+	op       code.Opcode
+	operands []int64
+}
+
+type disassembler struct {
+	w         io.Writer
+	constants []object.Object
+}
+
+func decode(ins code.Instructions) ([]instruction, error) {
+	var result []instruction
+	r := bytes.NewReader(ins)
+	for {
+		offset := len(ins) - r.Len()
+		op, err := code.ReadOpcode(r)
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("code.ReadOpcode: %w", err)
+		}
+		def, err := code.Lookup(op)
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: code.Lookup: %w", offset, err)
+		}
+		operands, _, err := code.ReadOperands(def, r)
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: code.ReadOperands: %w", offset, err)
+		}
+		result = append(result, instruction{offset: offset, def: def, op: op, operands: operands})
+	}
+}
+
+func (d *disassembler) instructions(ins code.Instructions) error {
+	decoded, err := decode(ins)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	// labels are numbered in the order of their targets
+	var targets []int
+	seen := make(map[int]bool)
+	for _, in := range decoded {
+		if code.IsJump(in.op) && !seen[int(in.operands[0])] {
+			seen[int(in.operands[0])] = true
+			targets = append(targets, int(in.operands[0]))
+		}
+	}
+	sort.Ints(targets)
+	labels := make(map[int]string, len(targets))
+	for i, t := range targets {
+		labels[t] = "L" + strconv.Itoa(i)
+	}
+
+	boundaries := make(map[int]bool, len(decoded)+1)
+	for _, in := range decoded {
+		boundaries[in.offset] = true
+	}
+	boundaries[len(ins)] = true
+
+	for _, in := range decoded {
+		if l, ok := labels[in.offset]; ok {
+			fmt.Fprintf(d.w, "%s:\n", l)
+		}
+		text, comment := d.format(in, labels)
+		if code.IsJump(in.op) && !boundaries[int(in.operands[0])] {
+			comment = fmt.Sprintf("invalid jump target %d", in.operands[0])
+		}
+		if comment == "" {
+			fmt.Fprintf(d.w, "\t%04d %s\n", in.offset, text)
+		} else {
+			fmt.Fprintf(d.w, "\t%04d %-26s; %s\n", in.offset, text, comment)
+		}
+	}
+	// a jump may target the end of the instructions
+	if l, ok := labels[len(ins)]; ok {
+		fmt.Fprintf(d.w, "%s:\n", l)
+	}
+	return nil
+}
+
+func (d *disassembler) format(in instruction, labels map[int]string) (text, comment string) {
+	fields := []string{in.def.Name}
+	for i, o := range in.operands {
+		if i == 0 && code.IsJump(in.op) {
+			fields = append(fields, labels[int(o)])
+			continue
+		}
+		fields = append(fields, strconv.FormatInt(o, 10))
+	}
+	text = strings.Join(fields, " ")
+
+	switch in.op {
+	case code.OpConstant, code.OpConstantWide, code.OpClosure, code.OpClosureWide:
+		idx := int(in.operands[0])
+		if idx >= len(d.constants) {
+			return text, "constant out of range"
+		}
+		return text, Constant(d.constants[idx])
+	case code.OpGetBuiltin:
+		idx := int(in.operands[0])
+		if idx >= len(object.Builtins) {
+			return text, "builtin out of range"
+		}
+		return text, object.Builtins[idx].Name
+	}
+	return text, ""
+}
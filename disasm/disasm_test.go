@@ -0,0 +1,120 @@
+package disasm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/disasm"
+	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/parser"
+	. "github.com/Warashi/monkey/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisassemble(t *testing.T) {
+	t.Parallel()
+	input := `let max = fn(a, b) { if (a > b) { a } else { b } };
+puts(max(1, len("monkey")));`
+	want := `.main
+	0000 OpClosure 0 0             ; CompiledFunction max
+	0004 OpSetGlobal 0
+	0007 OpGetBuiltin 1            ; puts
+	0009 OpGetGlobal 0
+	0012 OpConstant 1              ; Integer 1
+	0015 OpGetBuiltin 0            ; len
+	0017 OpConstant 2              ; String "monkey"
+	0020 OpCall 1
+	0022 OpCall 2
+	0024 OpCall 1
+	0026 OpPop
+.end
+
+.function 0 "max" parameters=2 locals=2
+	0000 OpGetLocal 0
+	0002 OpGetLocal 1
+	0004 OpGreaterThan
+	0005 OpJumpNotTruthy L0
+	0008 OpGetLocal 0
+	0010 OpJump L1
+L0:
+	0013 OpGetLocal 1
+L1:
+	0015 OpReturnValue
+.end
+
+.constant 1 Integer 1
+.constant 2 String "monkey"
+`
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(parser.New(lexer.New(input)).Parse()))
+
+	var got strings.Builder
+	require.NoError(t, disasm.Disassemble(&got, compiler.Bytecode()))
+	assert.Equal(t, want, got.String())
+}
+
+func TestDisassembleBrokenInstructions(t *testing.T) {
+	t.Parallel()
+	var (
+		cat   = ConcatInstructions
+		instr = MakeInstructions
+	)
+	tests := []struct {
+		name     string
+		bytecode compiler.Bytecode
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "jump-into-instruction",
+			bytecode: compiler.Bytecode{
+				Instructions: cat(
+					instr(t, code.OpJump, 4),
+					instr(t, code.OpConstant, 0),
+				),
+				Constants: []object.Object{IntegerObject(1)},
+			},
+			want: ".main\n\t0000 OpJump L0                 ; invalid jump target 4\n\t0003 OpConstant 0              ; Integer 1\n.end\n\n.constant 0 Integer 1\n",
+		},
+		{
+			name: "jump-to-end",
+			bytecode: compiler.Bytecode{
+				Instructions: cat(instr(t, code.OpJump, 3)),
+			},
+			want: ".main\n\t0000 OpJump L0\nL0:\n.end\n",
+		},
+		{
+			name:     "constant-out-of-range",
+			bytecode: compiler.Bytecode{Instructions: cat(instr(t, code.OpConstant, 1))},
+			want:     ".main\n\t0000 OpConstant 1              ; constant out of range\n.end\n",
+		},
+		{
+			name:     "unknown-opcode",
+			bytecode: compiler.Bytecode{Instructions: code.Instructions{0xff}},
+			wantErr:  "offset 0: code.Lookup",
+		},
+		{
+			name:     "truncated-operand",
+			bytecode: compiler.Bytecode{Instructions: code.Instructions{byte(code.OpConstant), 0}},
+			wantErr:  "offset 0: code.ReadOperands",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var got strings.Builder
+			err := disasm.Disassemble(&got, tt.bytecode)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
@@ -1,10 +1,15 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
 	"github.com/Warashi/monkey/ast"
 	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/token"
 )
 
 var (
@@ -13,12 +18,72 @@ var (
 	NULL  = object.Null{}
 )
 
+// Options configures the evaluation of a program.
+type Options struct {
+	// CheckedArithmetic makes integer operations whose result does not fit in an Integer fail
+	// instead of wrapping around.
+	CheckedArithmetic bool
+	// Limits bounds the resources used by the evaluation. Exceeding a limit results in an Error
+	// which wraps object.ErrStepLimit, object.ErrCallDepthLimit or object.ErrAllocationLimit.
+	Limits object.Limits
+	// Output is where builtins such as `puts` print to. It is os.Stdout if nil.
+	Output io.Writer
+}
+
+// DefaultMaxCallDepth is the number of function calls which may be active at once if
+// Options.Limits.MaxCallDepth is zero. Every call is evaluated on the Go stack, which overflows fatally
+// at tens of thousands of calls.
+const DefaultMaxCallDepth = 1 << 10
+
+// MainFunctionName is the name of the top level of the program in the call chain of errors.
+const MainFunctionName = "<main>"
+
+// cancelCheckInterval is the number of nodes evaluated between checks for the cancellation of
+// the context, which are too slow to do for every node.
+const cancelCheckInterval = 1 << 10
+
 func Eval(n ast.Node, env object.Environment) object.Object {
+	return EvalContext(context.Background(), n, env, Options{})
+}
+
+// EvalWithOptions evaluates n in env like Eval, configured by opts.
+func EvalWithOptions(n ast.Node, env object.Environment, opts Options) object.Object {
+	return EvalContext(context.Background(), n, env, opts)
+}
+
+// EvalContext evaluates n in env like EvalWithOptions, but stops with an Error which wraps the error
+// of ctx once ctx is done.
+func EvalContext(ctx context.Context, n ast.Node, env object.Environment, opts Options) object.Object {
+	e := &evaluator{ctx: ctx, opts: opts, function: MainFunctionName}
+	return e.eval(n, env)
+}
+
+type evaluator struct {
+	ctx  context.Context
+	opts Options
+
+	steps    int64
+	elements int64
+
+	calls    []call // the calls being evaluated, outermost first
+	function string // the name of the function being evaluated
+}
+
+// call is a function call being evaluated: the function which made it, and where.
+type call struct {
+	function string
+	pos      token.Position
+}
+
+func (e *evaluator) eval(n ast.Node, env object.Environment) object.Object {
+	if err := e.step(); err != nil {
+		return err
+	}
 	switch n := n.(type) {
 	case *ast.Program:
-		return evalProgram(n, env)
+		return e.evalProgram(n, env)
 	case *ast.ExpressionStatement:
-		return Eval(n.Expression, env)
+		return e.eval(n.Expression, env)
 	case *ast.IntegerLiteral:
 		return object.Integer{Value: n.Value}
 	case *ast.StringLiteral:
@@ -26,69 +91,75 @@ func Eval(n ast.Node, env object.Environment) object.Object {
 	case *ast.BooleanLiteral:
 		return booleanObject(n.Value)
 	case *ast.PrefixExpression:
-		right := Eval(n.Right, env)
+		right := e.eval(n.Right, env)
 		if isError(right) {
 			return right
 		}
-		return evalPrefixExpression(n.Operator, right)
+		return withPosition(e.evalPrefixExpression(n.Operator, right), n.Pos())
 	case *ast.InfixExpression:
-		left := Eval(n.Left, env)
+		left := e.eval(n.Left, env)
 		if isError(left) {
 			return left
 		}
-		right := Eval(n.Right, env)
+		right := e.eval(n.Right, env)
 		if isError(right) {
 			return right
 		}
-		return evalInfixExpression(n.Operator, left, right)
+		return withPosition(e.evalInfixExpression(n.Operator, left, right), n.Pos())
 	case *ast.BlockStatement:
-		return evalBlockStatement(n, env)
+		return e.evalBlockStatement(n, env)
 	case *ast.IfExpression:
-		return evalIfExpression(n, env)
+		return e.evalIfExpression(n, env)
 	case *ast.ReturnStatement:
-		result := Eval(n.Value, env)
+		result := e.eval(n.Value, env)
 		if isError(result) {
 			return result
 		}
 		return object.Return{Value: result}
 	case *ast.LetStatement:
-		result := Eval(n.Value, env)
+		result := e.eval(n.Value, env)
 		if isError(result) {
 			return result
 		}
 		return env.Set(n.Name.Value, result)
 	case *ast.Identifier:
-		return evalIdentifier(n, env)
+		return withPosition(evalIdentifier(n, env), n.Pos())
 	case *ast.FunctionLiteral:
-		return object.Function{Parameters: n.Parameters, Body: n.Body, Env: env}
+		return object.Function{Parameters: n.Parameters, Body: n.Body, Env: env, Name: n.Name}
 	case *ast.CallExpression:
-		fn := Eval(n.Function, env)
+		fn := e.eval(n.Function, env)
 		if isError(fn) {
 			return fn
 		}
-		args := evalExpresssions(n.Arguments, env)
+		args := e.evalExpresssions(n.Arguments, env)
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
-		return applyFunciton(fn, args)
+		return withPosition(e.applyFunciton(fn, args, n.Pos()), n.Pos())
 	case *ast.ArrayLiteral:
-		elements := evalExpresssions(n.Elements, env)
+		elements := e.evalExpresssions(n.Elements, env)
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
+		if err := e.allocate(len(elements)); err != nil {
+			return withPosition(err, n.Pos())
+		}
 		return object.Array{Elements: elements}
 	case *ast.HashLiteral:
+		if err := e.allocate(len(n.Pairs)); err != nil {
+			return withPosition(err, n.Pos())
+		}
 		pairs := make(map[object.Hashable]object.Object, len(n.Pairs))
 		for k, v := range n.Pairs {
-			key := Eval(k, env)
+			key := e.eval(k, env)
 			if isError(key) {
 				return key
 			}
 			keyHashable, ok := key.(object.Hashable)
 			if !ok {
-				return newErrorf("%s cannot used as hash key", key.Type())
+				return withPosition(newErrorf("%s cannot used as hash key", key.Type()), k.Pos())
 			}
-			value := Eval(v, env)
+			value := e.eval(v, env)
 			if isError(value) {
 				return value
 			}
@@ -96,15 +167,15 @@ func Eval(n ast.Node, env object.Environment) object.Object {
 		}
 		return object.Hash{Pairs: pairs}
 	case *ast.IndexExpression:
-		left := Eval(n.Left, env)
+		left := e.eval(n.Left, env)
 		if isError(left) {
 			return left
 		}
-		right := Eval(n.Right, env)
+		right := e.eval(n.Right, env)
 		if isError(right) {
 			return right
 		}
-		return evalIndexExpression(left, right)
+		return withPosition(evalIndexExpression(left, right), n.Pos())
 	default:
 		return newErrorf("unknown node: %T", n)
 	}
@@ -121,14 +192,51 @@ func newErrorf(format string, a ...any) object.Object {
 	return object.Error{Message: fmt.Sprintf(format, a...)}
 }
 
+// newError returns an Error which wraps err, so that its kind can be told with errors.Is.
+func newError(err error) object.Object {
+	return object.Error{Message: err.Error(), Err: err}
+}
+
+// step counts the evaluation of a node, and returns an Error if the evaluation must stop.
+func (e *evaluator) step() object.Object {
+	e.steps++
+	if max := e.opts.Limits.MaxSteps; max > 0 && e.steps > max {
+		return newError(fmt.Errorf("%w: %d nodes", object.ErrStepLimit, max))
+	}
+	if e.steps%cancelCheckInterval == 0 {
+		if err := e.ctx.Err(); err != nil {
+			return newError(err)
+		}
+	}
+	return nil
+}
+
+// allocate counts n elements allocated by the program, and returns an Error if they exceed the limit.
+func (e *evaluator) allocate(n int) object.Object {
+	e.elements += int64(n)
+	if max := e.opts.Limits.MaxElements; max > 0 && e.elements > max {
+		return newError(fmt.Errorf("%w: %d elements", object.ErrAllocationLimit, max))
+	}
+	return nil
+}
+
+// withPosition sets pos to o if it is an error which does not know where it happened yet.
+func withPosition(o object.Object, pos token.Position) object.Object {
+	if err, ok := o.(object.Error); ok && !err.Pos.IsValid() {
+		err.Pos = pos
+		return err
+	}
+	return o
+}
+
 func isError(o object.Object) bool {
 	return o.Type() == object.TypeError
 }
 
-func evalProgram(p *ast.Program, env object.Environment) object.Object {
+func (e *evaluator) evalProgram(p *ast.Program, env object.Environment) object.Object {
 	var result object.Object
 	for _, stmt := range p.Statements {
-		result = Eval(stmt, env)
+		result = e.eval(stmt, env)
 		switch result := result.(type) {
 		case object.Return:
 			return result.Value
@@ -139,10 +247,10 @@ func evalProgram(p *ast.Program, env object.Environment) object.Object {
 	return result
 }
 
-func evalBlockStatement(s *ast.BlockStatement, env object.Environment) object.Object {
-	var result object.Object
+func (e *evaluator) evalBlockStatement(s *ast.BlockStatement, env object.Environment) object.Object {
+	var result object.Object = NULL
 	for _, stmt := range s.Statements {
-		result = Eval(stmt, env)
+		result = e.eval(stmt, env)
 		if t := result.Type(); t == object.TypeReturn || t == object.TypeError {
 			return result
 		}
@@ -150,12 +258,12 @@ func evalBlockStatement(s *ast.BlockStatement, env object.Environment) object.Ob
 	return result
 }
 
-func evalPrefixExpression(op string, right object.Object) object.Object {
+func (e *evaluator) evalPrefixExpression(op string, right object.Object) object.Object {
 	switch op {
 	case "!":
 		return evalBangOperatorExpression(right)
 	case "-":
-		return evalMinusOperatorExpression(right)
+		return e.evalMinusOperatorExpression(right)
 	default:
 		return newErrorf("unknown operator %s", op)
 	}
@@ -174,21 +282,25 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 	}
 }
 
-func evalMinusOperatorExpression(right object.Object) object.Object {
+func (e *evaluator) evalMinusOperatorExpression(right object.Object) object.Object {
 	if right.Type() != object.TypeInteger {
 		return newErrorf("unknown operator: -%s", right.Type())
 	}
-	return object.Integer{Value: -right.(object.Integer).Value}
+	value, err := object.IntegerNegation(right.(object.Integer).Value, e.opts.CheckedArithmetic)
+	if err != nil {
+		return newError(err)
+	}
+	return object.Integer{Value: value}
 }
 
-func evalInfixExpression(op string, left, right object.Object) object.Object {
+func (e *evaluator) evalInfixExpression(op string, left, right object.Object) object.Object {
 	switch {
-	case op == "==":
+	case op == "==" && isComparable(left, right):
 		return booleanObject(left == right)
-	case op == "!=":
+	case op == "!=" && isComparable(left, right):
 		return booleanObject(left != right)
 	case left.Type() == object.TypeInteger && right.Type() == object.TypeInteger:
-		return evalIntegerInfixExpression(op, left.(object.Integer), right.(object.Integer))
+		return e.evalIntegerInfixExpression(op, left.(object.Integer), right.(object.Integer))
 	case left.Type() == object.TypeString && right.Type() == object.TypeString:
 		return evalStringInfixExpression(op, left.(object.String), right.(object.String))
 	case left.Type() != right.Type():
@@ -198,6 +310,21 @@ func evalInfixExpression(op string, left, right object.Object) object.Object {
 	}
 }
 
+// isComparable reports whether left and right can be compared with == and !=. Values of different types
+// are never equal, but two arrays, hashes or functions cannot be compared.
+func isComparable(left, right object.Object) bool {
+	return left.Type() != right.Type() || isScalar(left)
+}
+
+func isScalar(o object.Object) bool {
+	switch o.(type) {
+	case object.Hashable, object.Null:
+		return true
+	default:
+		return false
+	}
+}
+
 func evalIndexExpression(left, right object.Object) object.Object {
 	switch {
 	case left.Type() == object.TypeArray && right.Type() == object.TypeInteger:
@@ -222,16 +349,14 @@ func evalIndexExpression(left, right object.Object) object.Object {
 	}
 }
 
-func evalIntegerInfixExpression(op string, left, right object.Integer) object.Object {
+func (e *evaluator) evalIntegerInfixExpression(op string, left, right object.Integer) object.Object {
 	switch op {
-	case "+":
-		return object.Integer{Value: left.Value + right.Value}
-	case "-":
-		return object.Integer{Value: left.Value - right.Value}
-	case "*":
-		return object.Integer{Value: left.Value * right.Value}
-	case "/":
-		return object.Integer{Value: left.Value / right.Value}
+	case "+", "-", "*", "/", "%":
+		value, err := object.IntegerOperation(op, left.Value, right.Value, e.opts.CheckedArithmetic)
+		if err != nil {
+			return newError(err)
+		}
+		return object.Integer{Value: value}
 	case "<":
 		return booleanObject(left.Value < right.Value)
 	case ">":
@@ -254,16 +379,16 @@ func evalStringInfixExpression(op string, left, right object.String) object.Obje
 	}
 }
 
-func evalIfExpression(n *ast.IfExpression, env object.Environment) object.Object {
-	cond := Eval(n.Condition, env)
+func (e *evaluator) evalIfExpression(n *ast.IfExpression, env object.Environment) object.Object {
+	cond := e.eval(n.Condition, env)
 	if isError(cond) {
 		return cond
 	}
 	if isTruthy(cond) {
-		return Eval(n.Consequence, env)
+		return e.eval(n.Consequence, env)
 	}
 	if n.Alternative != nil {
-		return Eval(n.Alternative, env)
+		return e.eval(n.Alternative, env)
 	}
 	return NULL
 }
@@ -272,16 +397,16 @@ func evalIdentifier(n *ast.Identifier, env object.Environment) object.Object {
 	if val, ok := env.Get(n.Value); ok {
 		return val
 	}
-	if val, ok := builtins[n.Value]; ok {
+	if val, ok := object.GetBuiltinByName(n.Value); ok {
 		return val
 	}
 	return newErrorf("identifier not found: %s", n.Value)
 }
 
-func evalExpresssions(e []ast.Expression, env object.Environment) []object.Object {
-	result := make([]object.Object, 0, len(e))
-	for _, e := range e {
-		r := Eval(e, env)
+func (e *evaluator) evalExpresssions(exps []ast.Expression, env object.Environment) []object.Object {
+	result := make([]object.Object, 0, len(exps))
+	for _, exp := range exps {
+		r := e.eval(exp, env)
 		if isError(r) {
 			return []object.Object{r}
 		}
@@ -290,19 +415,194 @@ func evalExpresssions(e []ast.Expression, env object.Environment) []object.Objec
 	return result
 }
 
-func applyFunciton(fn object.Object, args []object.Object) object.Object {
+// applyFunciton calls fn with args from the call at pos.
+func (e *evaluator) applyFunciton(fn object.Object, args []object.Object, pos token.Position) object.Object {
 	switch fn.Type() {
 	case object.TypeFunction:
 		f := fn.(object.Function)
-		return unwrapReturnValue(Eval(f.Body, extendFunctionEnv(f, args)))
+		if err := checkArity(f, args); err != nil {
+			return err
+		}
+		if len(e.calls) >= e.maxCallDepth() {
+			return e.recursionError(pos)
+		}
+		e.calls = append(e.calls, call{function: e.function, pos: pos})
+		caller := e.function
+		result := e.callFunction(f, args)
+		e.function = caller
+		e.calls = e.calls[:len(e.calls)-1]
+		return result
 	case object.TypeBuiltin:
 		f := fn.(object.Builtin)
-		return f.Fn(args...)
+		result := f.Fn(e.output(), args...)
+		if array, ok := result.(object.Array); ok && f.Allocates {
+			if err := e.allocate(len(array.Elements)); err != nil {
+				return err
+			}
+		}
+		return result
 	default:
 		return newErrorf("not a function: %s", fn.Type())
 	}
 }
 
+// callFunction evaluates the body of f with args, and then the bodies of the functions called in tail
+// position in turn, so that a chain of tail calls does not grow the Go stack.
+func (e *evaluator) callFunction(f object.Function, args []object.Object) object.Object {
+	for {
+		e.function = functionName(f)
+		result := unwrapReturnValue(e.evalFunctionBlock(f.Body, extendFunctionEnv(f, args), true))
+		tailCall, ok := result.(object.TailCall)
+		if !ok {
+			return result
+		}
+		f, args = tailCall.Fn, tailCall.Args
+	}
+}
+
+// evalFunctionBlock evaluates a block of a function body like evalBlockStatement. The value of a return
+// statement, and that of the last statement if last is true, are in tail position: a call to a function
+// there results in a TailCall to be made by callFunction instead.
+func (e *evaluator) evalFunctionBlock(s *ast.BlockStatement, env object.Environment, last bool) object.Object {
+	if err := e.step(); err != nil {
+		return err
+	}
+	var result object.Object = NULL
+	for i, stmt := range s.Statements {
+		result = e.evalFunctionStatement(stmt, env, last && i == len(s.Statements)-1)
+		if t := result.Type(); t == object.TypeReturn || t == object.TypeError {
+			return result
+		}
+	}
+	return result
+}
+
+func (e *evaluator) evalFunctionStatement(stmt ast.Statement, env object.Environment, last bool) object.Object {
+	switch stmt := stmt.(type) {
+	case *ast.ReturnStatement:
+		if err := e.step(); err != nil {
+			return err
+		}
+		result := e.evalTail(stmt.Value, env, true)
+		if isError(result) {
+			return result
+		}
+		return object.Return{Value: result}
+	case *ast.ExpressionStatement:
+		if err := e.step(); err != nil {
+			return err
+		}
+		return e.evalTail(stmt.Expression, env, last)
+	default:
+		return e.eval(stmt, env)
+	}
+}
+
+// evalTail evaluates the expression n of a function body, which is in tail position if tail is true.
+// The branches of if expressions are evaluated by evalFunctionBlock, as return statements in them are
+// in tail position even if the if expression is not.
+func (e *evaluator) evalTail(n ast.Expression, env object.Environment, tail bool) object.Object {
+	switch n := n.(type) {
+	case *ast.IfExpression:
+		if err := e.step(); err != nil {
+			return err
+		}
+		cond := e.eval(n.Condition, env)
+		if isError(cond) {
+			return cond
+		}
+		if isTruthy(cond) {
+			return e.evalFunctionBlock(n.Consequence, env, tail)
+		}
+		if n.Alternative != nil {
+			return e.evalFunctionBlock(n.Alternative, env, tail)
+		}
+		return NULL
+	case *ast.CallExpression:
+		if !tail {
+			break
+		}
+		if err := e.step(); err != nil {
+			return err
+		}
+		fn := e.eval(n.Function, env)
+		if isError(fn) {
+			return fn
+		}
+		args := e.evalExpresssions(n.Arguments, env)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+		if f, ok := fn.(object.Function); ok {
+			if err := checkArity(f, args); err != nil {
+				return withPosition(err, n.Pos())
+			}
+			return object.TailCall{Fn: f, Args: args}
+		}
+		return withPosition(e.applyFunciton(fn, args, n.Pos()), n.Pos())
+	}
+	return e.eval(n, env)
+}
+
+// checkArity returns an Error if f is called with fewer arguments than parameters, which would be
+// left unbound. Extra arguments are ignored.
+func checkArity(f object.Function, args []object.Object) object.Object {
+	if len(args) < len(f.Parameters) {
+		return newErrorf("wrong number of arguments. got=%d, want=%d", len(args), len(f.Parameters))
+	}
+	return nil
+}
+
+func (e *evaluator) output() io.Writer {
+	if e.opts.Output != nil {
+		return e.opts.Output
+	}
+	return os.Stdout
+}
+
+func (e *evaluator) maxCallDepth() int {
+	if max := e.opts.Limits.MaxCallDepth; max > 0 {
+		return max
+	}
+	return DefaultMaxCallDepth
+}
+
+func functionName(f object.Function) string {
+	if f.Name == "" {
+		return "<anonymous>"
+	}
+	return f.Name
+}
+
+// maxTraceLines is the number of lines of the call chain shown at each end of a recursion error.
+const maxTraceLines = 10
+
+// recursionError returns the Error for the call at pos which exceeds the maximum call depth. The message
+// lists the calls being evaluated like the stack trace of the vm, innermost first, with consecutive calls
+// from the same place shown once.
+func (e *evaluator) recursionError(pos token.Position) object.Object {
+	calls := append(e.calls[:len(e.calls):len(e.calls)], call{function: e.function, pos: pos})
+	var lines []string
+	for i := len(calls) - 1; i >= 0; {
+		j := i
+		for j > 0 && calls[j-1] == calls[i] {
+			j--
+		}
+		line := fmt.Sprintf("\tat %s (%s)", calls[i].function, calls[i].pos)
+		if n := i - j + 1; n > 1 {
+			line += fmt.Sprintf(" [%d times]", n)
+		}
+		lines = append(lines, line)
+		i = j - 1
+	}
+	if len(lines) > 2*maxTraceLines {
+		omitted := fmt.Sprintf("\t... %d more", len(lines)-2*maxTraceLines)
+		lines = append(append(lines[:maxTraceLines:maxTraceLines], omitted), lines[len(lines)-maxTraceLines:]...)
+	}
+	err := fmt.Errorf("%w: %d calls\n%s", object.ErrCallDepthLimit, e.maxCallDepth(), strings.Join(lines, "\n"))
+	return newError(err)
+}
+
 func unwrapReturnValue(o object.Object) object.Object {
 	if o.Type() == object.TypeReturn {
 		return o.(object.Return).Value
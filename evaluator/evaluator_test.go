@@ -1,6 +1,8 @@
 package evaluator_test
 
 import (
+	"context"
+	"strings"
 	"testing"
 
 	"github.com/Warashi/monkey/evaluator"
@@ -8,11 +10,13 @@ import (
 	"github.com/Warashi/monkey/object"
 	"github.com/Warashi/monkey/parser"
 	. "github.com/Warashi/monkey/testutil"
+	"github.com/Warashi/monkey/token"
 	"github.com/stretchr/testify/assert"
 )
 
+// Eval evaluates input and clears source positions from the result; they are tested in TestErrorPosition.
 func Eval(input string) object.Object {
-	return evaluator.Eval(parser.New(lexer.New(input)).Parse(), object.NewEnvironment())
+	return ClearPositions(evaluator.Eval(parser.New(lexer.New(input)).Parse(), object.NewEnvironment()))
 }
 
 func TestEvalIntegerExpression(t *testing.T) {
@@ -35,6 +39,11 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{input: "3 * 3 * 3 + 10", want: IntegerObject(37)},
 		{input: "3 * (3 * 3) + 10", want: IntegerObject(37)},
 		{input: "(5 + 10 * 2 + 15 / 3) * 2 + -10", want: IntegerObject(50)},
+		{input: "7 % 3", want: IntegerObject(1)},
+		{input: "-7 % 3", want: IntegerObject(-1)},
+		{input: "1 + 7 % 3 * 2", want: IntegerObject(3)},
+		{input: "9223372036854775807 + 1", want: IntegerObject(-9223372036854775808)},
+		{input: "(-9223372036854775807 - 1) % -1", want: IntegerObject(0)},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -86,6 +95,12 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{input: "(1 < 2) == false", want: BooleanObject(false)},
 		{input: "(1 > 2) == true", want: BooleanObject(false)},
 		{input: "(1 > 2) == false", want: BooleanObject(true)},
+		{input: "1 == true", want: BooleanObject(false)},
+		{input: "1 != true", want: BooleanObject(true)},
+		{input: `"1" == 1`, want: BooleanObject(false)},
+		{input: "[1] != 1", want: BooleanObject(true)},
+		{input: "fn(x) { x } == len", want: BooleanObject(false)},
+		{input: "if (false) { 1 } == if (false) { 2 }", want: BooleanObject(true)},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -169,6 +184,10 @@ func TestErrorHandling(t *testing.T) {
 		{input: "if (10 > 1) { if (10 > 1) { return true + false; } return 1; }", want: ErrorObject("unknown operator: Boolean + Boolean")},
 		{input: "foobar", want: ErrorObject("identifier not found: foobar")},
 		{input: `"Hello" - "world"`, want: ErrorObject("unknown operator: String - String")},
+		{input: "[1] == [1]", want: ErrorObject("unknown operator: Array == Array")},
+		{input: "len == len", want: ErrorObject("unknown operator: Builtin == Builtin")},
+		{input: "fn(x) { x }()", want: ErrorObject("wrong number of arguments. got=0, want=1")},
+		{input: "let f = fn(x) { f() }; f(1)", want: ErrorObject("wrong number of arguments. got=0, want=1")},
 	}
 
 	for _, tt := range tests {
@@ -178,6 +197,220 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestArithmeticErrors(t *testing.T) {
+	tests := []struct {
+		input   string
+		checked bool
+		want    error
+		message string
+	}{
+		{"1 / 0", false, object.ErrDivisionByZero, "division by zero: 1 / 0"},
+		{"1 % 0", false, object.ErrDivisionByZero, "division by zero: 1 % 0"},
+		{"9223372036854775807 + 1", true, object.ErrIntegerOverflow, "integer overflow: 9223372036854775807 + 1"},
+		{"-9223372036854775807 - 2", true, object.ErrIntegerOverflow, "integer overflow: -9223372036854775807 - 2"},
+		{"4611686018427387904 * 2", true, object.ErrIntegerOverflow, "integer overflow: 4611686018427387904 * 2"},
+		{"(-9223372036854775807 - 1) / -1", true, object.ErrIntegerOverflow, "integer overflow: -9223372036854775808 / -1"},
+		{"-(-9223372036854775807 - 1)", true, object.ErrIntegerOverflow, "integer overflow: -(-9223372036854775808)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program := parser.New(lexer.New(tt.input)).Parse()
+			got := evaluator.EvalWithOptions(program, object.NewEnvironment(), evaluator.Options{CheckedArithmetic: tt.checked})
+			err, ok := got.(object.Error)
+			if assert.True(t, ok, "got %T", got) {
+				assert.ErrorIs(t, err, tt.want)
+				assert.Equal(t, tt.message, err.Message)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	const countDown = "let countDown = fn(x) { if (x == 0) { 0 } else { 1 + countDown(x - 1) } };"
+	tests := []struct {
+		name   string
+		input  string
+		limits object.Limits
+		want   error
+	}{
+		{"steps", countDown + "countDown(10)", object.Limits{MaxSteps: 1000}, nil},
+		{"steps/exceeded", countDown + "countDown(100)", object.Limits{MaxSteps: 1000}, object.ErrStepLimit},
+		{"call-depth", countDown + "countDown(10)", object.Limits{MaxCallDepth: 11}, nil},
+		{"call-depth/exceeded", countDown + "countDown(10)", object.Limits{MaxCallDepth: 10}, object.ErrCallDepthLimit},
+		{"call-depth/infinite", "let f = fn() { 1 + f() }; f()", object.Limits{MaxCallDepth: 100}, object.ErrCallDepthLimit},
+		{"elements/array", "[1, 2]; [3, 4]", object.Limits{MaxElements: 4}, nil},
+		{"elements/array/exceeded", "[1, 2]; [3, 4, 5]", object.Limits{MaxElements: 4}, object.ErrAllocationLimit},
+		{"elements/hash/exceeded", "{1: 2, 3: 4}", object.Limits{MaxElements: 1}, object.ErrAllocationLimit},
+		{"elements/builtin/exceeded", "push([1, 2], 3)", object.Limits{MaxElements: 4}, object.ErrAllocationLimit},
+		{"elements/rest", "rest(rest(rest([1, 2, 3, 4])))", object.Limits{MaxElements: 4}, nil},
+		{"elements/rest-loop", "let sum = fn(a, acc) { if (len(a) == 0) { acc } else { sum(rest(a), acc + first(a)) } }; sum([1, 2, 3, 4, 5], 0)", object.Limits{MaxElements: 5}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program := parser.New(lexer.New(tt.input)).Parse()
+			got := evaluator.EvalWithOptions(program, object.NewEnvironment(), evaluator.Options{Limits: tt.limits})
+			err, isErr := got.(object.Error)
+			if tt.want == nil {
+				assert.False(t, isErr, "got %v", got)
+			} else if assert.True(t, isErr, "got %T", got) {
+				assert.ErrorIs(t, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecursionDepth(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		limits object.Limits
+		want   string
+	}{
+		{
+			name:  "default",
+			input: "let f = fn(x) { 1 + f(x + 1) }; f(0)",
+			want:  "maximum recursion depth exceeded: 1024 calls\n\tat f (1:22) [1024 times]\n\tat <main> (1:34)",
+		},
+		{
+			name:   "chain",
+			input:  "let a = fn() { b() + 0 }; let b = fn() { a() + 0 }; a()",
+			limits: object.Limits{MaxCallDepth: 3},
+			want:   "maximum recursion depth exceeded: 3 calls\n\tat a (1:17)\n\tat b (1:43)\n\tat a (1:17)\n\tat <main> (1:54)",
+		},
+		{
+			name:   "anonymous",
+			input:  "let apply = fn(f) { f() + 0 }; apply(fn() { apply(fn() { 1 }) + 0 })",
+			limits: object.Limits{MaxCallDepth: 3},
+			want:   "maximum recursion depth exceeded: 3 calls\n\tat apply (1:22)\n\tat <anonymous> (1:50)\n\tat apply (1:22)\n\tat <main> (1:37)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program := parser.New(lexer.New(tt.input)).Parse()
+			got := evaluator.EvalWithOptions(program, object.NewEnvironment(), evaluator.Options{Limits: tt.limits})
+			err, ok := got.(object.Error)
+			if assert.True(t, ok, "got %T", got) {
+				assert.ErrorIs(t, err, object.ErrCallDepthLimit)
+				assert.Equal(t, tt.want, err.Message)
+			}
+		})
+	}
+}
+
+func TestRecursionDepthElided(t *testing.T) {
+	program := parser.New(lexer.New("let a = fn() { b() + 0 }; let b = fn() { a() + 0 }; a()")).Parse()
+	got := evaluator.Eval(program, object.NewEnvironment())
+	err, ok := got.(object.Error)
+	if assert.True(t, ok, "got %T", got) {
+		lines := strings.Split(err.Message, "\n")
+		assert.Len(t, lines, 22, "the message, 10 calls at each end, and the number of calls omitted")
+		assert.Equal(t, "\t... 1005 more", lines[11])
+		assert.Equal(t, "\tat <main> (1:54)", lines[21])
+	}
+}
+
+func TestRecursionDepthConfigurable(t *testing.T) {
+	program := parser.New(lexer.New("let countDown = fn(x) { if (x == 0) { 0 } else { 1 + countDown(x - 1) } }; countDown(2000)")).Parse()
+	got := evaluator.Eval(program, object.NewEnvironment())
+	assert.ErrorIs(t, got.(object.Error), object.ErrCallDepthLimit)
+
+	got = evaluator.EvalWithOptions(program, object.NewEnvironment(), evaluator.Options{Limits: object.Limits{MaxCallDepth: 2001}})
+	assert.Equal(t, IntegerObject(2000), got)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  object.Object
+	}{
+		{
+			name:  "count-down",
+			input: "let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } }; countDown(100000)",
+			want:  IntegerObject(0),
+		},
+		{
+			name:  "return",
+			input: "let countDown = fn(x) { if (x == 0) { return 0; }; return countDown(x - 1); }; countDown(100000)",
+			want:  IntegerObject(0),
+		},
+		{
+			name:  "mutual",
+			input: "let even = fn(x, odd) { if (x == 0) { true } else { odd(x - 1, even) } }; let odd = fn(x, even) { if (x == 0) { false } else { even(x - 1, odd) } }; even(100001, odd)",
+			want:  BooleanObject(false),
+		},
+		{
+			name:  "builtin",
+			input: "let f = fn(x) { len(x) }; f([1, 2])",
+			want:  IntegerObject(2),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program := parser.New(lexer.New(tt.input)).Parse()
+			assert.Equal(t, tt.want, evaluator.Eval(program, object.NewEnvironment()))
+		})
+	}
+}
+
+func TestTailCallsOverLargeArray(t *testing.T) {
+	const n = 1000000
+	elements := make([]object.Object, n)
+	for i := range elements {
+		elements[i] = IntegerObject(int64(i + 1))
+	}
+	env := object.NewEnvironment()
+	env.Set("numbers", ArrayObject(elements...))
+
+	program := parser.New(lexer.New(`
+let sum = fn(xs, acc) {
+  if (len(xs) == 0) { return acc; }
+  sum(rest(xs), acc + first(xs))
+};
+sum(numbers, 0)`)).Parse()
+	assert.Equal(t, IntegerObject(n*(n+1)/2), evaluator.Eval(program, env))
+}
+
+func TestEvalContext(t *testing.T) {
+	program := parser.New(lexer.New("let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } }; countDown(1000)")).Parse()
+
+	got := evaluator.EvalContext(context.Background(), program, object.NewEnvironment(), evaluator.Options{})
+	assert.Equal(t, IntegerObject(0), got)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	got = evaluator.EvalContext(ctx, program, object.NewEnvironment(), evaluator.Options{})
+	if err, ok := got.(object.Error); assert.True(t, ok, "got %T", got) {
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.True(t, err.Pos.IsValid(), "cancellation is reported where the evaluation stopped")
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	tests := []struct {
+		input string
+		want  token.Position
+	}{
+		{input: "5 + true;", want: token.Position{Offset: 2, Line: 1, Column: 3}},
+		{input: "-true", want: token.Position{Offset: 0, Line: 1, Column: 1}},
+		{input: "let a = 1;\nfoobar", want: token.Position{Offset: 11, Line: 2, Column: 1}},
+		{input: "let f = fn() {\n  true + false;\n};\nf();", want: token.Position{Offset: 22, Line: 2, Column: 8}},
+		{input: "[1, 2][5]", want: token.Position{Offset: 6, Line: 1, Column: 7}},
+		{input: "len(1)", want: token.Position{Offset: 3, Line: 1, Column: 4}},
+		{input: "let a = 1;\na / 0", want: token.Position{Offset: 13, Line: 2, Column: 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got := evaluator.Eval(parser.New(lexer.New(tt.input)).Parse(), object.NewEnvironment())
+			err, ok := got.(object.Error)
+			if assert.True(t, ok, "got %T", got) {
+				assert.Equal(t, tt.want, err.Pos)
+			}
+		})
+	}
+}
+
 func TestLetStatement(t *testing.T) {
 	tests := []struct {
 		input string
@@ -228,6 +461,10 @@ func TestFunctionApplication(t *testing.T) {
 		{input: "let add = fn(x, y) { x + y; }; add(5, 5);", want: IntegerObject(10)},
 		{input: "let add = fn(x, y) { x + y; }; add(5 + 5, add(5, 5));", want: IntegerObject(20)},
 		{input: "fn(x) { x; }(5);", want: IntegerObject(5)},
+		{input: "fn(x) { x; }(5, 6);", want: IntegerObject(5)},
+		{input: "fn() { }();", want: NullObject()},
+		{input: "fn() { let x = 5; }();", want: IntegerObject(5)},
+		{input: "fn() { if (true) { let x = 5; } }();", want: IntegerObject(5)},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -250,6 +487,17 @@ func TestBuiltinFunctions(t *testing.T) {
 		{input: `len([])`, want: IntegerObject(0)},
 		{input: `len([1])`, want: IntegerObject(1)},
 		{input: `len([1, 2])`, want: IntegerObject(2)},
+		{input: `first([1, 2, 3])`, want: IntegerObject(1)},
+		{input: `first([])`, want: NullObject()},
+		{input: `first(1)`, want: ErrorObject("argument to `first` not supported, got Integer")},
+		{input: `last([1, 2, 3])`, want: IntegerObject(3)},
+		{input: `last([])`, want: NullObject()},
+		{input: `last(1)`, want: ErrorObject("argument to `last` not supported, got Integer")},
+		{input: `rest([1, 2, 3])`, want: ArrayObject(IntegerObject(2), IntegerObject(3))},
+		{input: `rest([])`, want: NullObject()},
+		{input: `push([], 1)`, want: ArrayObject(IntegerObject(1))},
+		{input: `push([1], 2)`, want: ArrayObject(IntegerObject(1), IntegerObject(2))},
+		{input: `push(1, 1)`, want: ErrorObject("argument to `push` must be Array, got Integer")},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -258,6 +506,14 @@ func TestBuiltinFunctions(t *testing.T) {
 	}
 }
 
+func TestPuts(t *testing.T) {
+	var out strings.Builder
+	program := parser.New(lexer.New(`puts("a", 1); puts([2])`)).Parse()
+	got := evaluator.EvalWithOptions(program, object.NewEnvironment(), evaluator.Options{Output: &out})
+	assert.Equal(t, NullObject(), got)
+	assert.Equal(t, "a\n1\n[2]\n", out.String())
+}
+
 func TestArrayLiteral(t *testing.T) {
 	tests := []struct {
 		input string
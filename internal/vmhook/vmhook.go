@@ -0,0 +1,8 @@
+// Package vmhook gives packages of this module access to settings of the vm which are not part of its
+// public API, because they would let any caller weaken its checks.
+package vmhook
+
+// SetVerifiedConstants makes machine, a *vm.VM, skip verifying the first n constants, which were
+// verified by the run of another VM sharing the constant pool, such as the one of the previous line
+// of the repl. It is set by package vm, which cannot be imported here.
+var SetVerifiedConstants func(machine any, n int)
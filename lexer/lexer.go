@@ -5,19 +5,36 @@ import (
 )
 
 type Lexer struct {
+	filename      string
 	input         string
 	position      int
 	readPosisiton int
 	ch            byte
+
+	line      int // line of the current char
+	lineStart int // offset where the current line starts
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewFile("", input)
+}
+
+// NewFile returns a Lexer whose token positions refer to the given filename.
+func NewFile(filename, input string) *Lexer {
+	l := &Lexer{filename: filename, input: input, line: 1}
 	l.readChar()
 	return l
 }
 
+func (l *Lexer) Input() string {
+	return l.input
+}
+
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.lineStart = l.readPosisiton
+	}
 	if l.readPosisiton >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -36,6 +53,18 @@ func (l *Lexer) peekChar() byte {
 
 func (l *Lexer) NextToken() token.Token {
 	l.skipWhitespace()
+	pos := token.Position{
+		Filename: l.filename,
+		Offset:   l.position,
+		Line:     l.line,
+		Column:   l.position - l.lineStart + 1,
+	}
+	tok := l.nextToken()
+	tok.Pos = pos
+	return tok
+}
+
+func (l *Lexer) nextToken() token.Token {
 	defer l.readChar()
 	switch l.ch {
 	case '=':
@@ -76,6 +105,8 @@ func (l *Lexer) NextToken() token.Token {
 		return newToken(token.BANG, l.ch)
 	case '/':
 		return newToken(token.SLASH, l.ch)
+	case '%':
+		return newToken(token.PERCENT, l.ch)
 	case '*':
 		return newToken(token.ASTERISK, l.ch)
 	case '<':
@@ -30,6 +30,7 @@ func TestNextToken(t *testing.T) {
 				Token(token.RBRACE, "}"),
 				Token(token.COMMA, ","),
 				Token(token.SEMICOLON, ";"),
+				Token(token.PERCENT, "%"),
 			},
 		},
 		{
@@ -180,10 +181,28 @@ func TestNextToken(t *testing.T) {
 					for i := 0; i < waste; i++ {
 						l.NextToken()
 					}
-					got := l.NextToken()
+					got := ClearPositions(l.NextToken())
 					assert.Equal(t, want, got)
 				})
 			}
 		})
 	}
 }
+
+func TestNextTokenPosition(t *testing.T) {
+	l := lexer.NewFile("test.monkey", "let x = 5;\n\tx + 10;")
+	wants := []token.Position{
+		{Filename: "test.monkey", Offset: 0, Line: 1, Column: 1},
+		{Filename: "test.monkey", Offset: 4, Line: 1, Column: 5},
+		{Filename: "test.monkey", Offset: 6, Line: 1, Column: 7},
+		{Filename: "test.monkey", Offset: 8, Line: 1, Column: 9},
+		{Filename: "test.monkey", Offset: 9, Line: 1, Column: 10},
+		{Filename: "test.monkey", Offset: 12, Line: 2, Column: 2},
+		{Filename: "test.monkey", Offset: 14, Line: 2, Column: 4},
+		{Filename: "test.monkey", Offset: 16, Line: 2, Column: 6},
+		{Filename: "test.monkey", Offset: 18, Line: 2, Column: 8},
+	}
+	for i, want := range wants {
+		assert.Equal(t, want, l.NextToken().Pos, "token %d", i)
+	}
+}
@@ -1,20 +1,9 @@
 package main
 
 import (
-	"fmt"
-	"log"
 	"os"
-	"os/user"
-
-	"github.com/Warashi/monkey/repl"
 )
 
 func main() {
-	user, err := user.Current()
-	if err != nil {
-		log.Fatalf("user.Current: %v", err)
-	}
-	fmt.Printf("Hello, %s!, This is the Monkey programming language!\n", user.Username)
-	fmt.Println("Fell free to type in commands")
-	repl.Start(os.Stdin, os.Stdout)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,59 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	// ErrDivisionByZero is returned by IntegerOperation when the right operand of / or % is 0.
+	ErrDivisionByZero = errors.New("division by zero")
+	// ErrIntegerOverflow is returned by IntegerOperation and IntegerNegation in checked mode
+	// when the result does not fit in an Integer.
+	ErrIntegerOverflow = errors.New("integer overflow")
+)
+
+// IntegerOperation returns left op right for the arithmetic operators +, -, *, / and %, with the
+// semantics shared by the evaluator and the VM. Division and modulo by zero are errors. Results which
+// do not fit in an Integer wrap around, unless checked is true, in which case they are errors.
+func IntegerOperation(op string, left, right int64, checked bool) (int64, error) {
+	var result int64
+	overflow := false
+	switch op {
+	case "+":
+		result = left + right
+		overflow = (right > 0 && result < left) || (right < 0 && result > left)
+	case "-":
+		result = left - right
+		overflow = (right < 0 && result < left) || (right > 0 && result > left)
+	case "*":
+		result = left * right
+		overflow = left != 0 && (result/left != right || (left == -1 && right == math.MinInt64))
+	case "/":
+		if right == 0 {
+			return 0, fmt.Errorf("%w: %d / %d", ErrDivisionByZero, left, right)
+		}
+		result = left / right
+		overflow = left == math.MinInt64 && right == -1
+	case "%":
+		if right == 0 {
+			return 0, fmt.Errorf("%w: %d %% %d", ErrDivisionByZero, left, right)
+		}
+		result = left % right
+	default:
+		return 0, fmt.Errorf("unknown operator: %s", op)
+	}
+	if checked && overflow {
+		return 0, fmt.Errorf("%w: %d %s %d", ErrIntegerOverflow, left, op, right)
+	}
+	return result, nil
+}
+
+// IntegerNegation returns -value, which wraps around for the minimum Integer unless checked is true.
+func IntegerNegation(value int64, checked bool) (int64, error) {
+	if checked && value == math.MinInt64 {
+		return 0, fmt.Errorf("%w: -(%d)", ErrIntegerOverflow, value)
+	}
+	return -value, nil
+}
@@ -0,0 +1,112 @@
+package object
+
+import (
+	"fmt"
+	"io"
+)
+
+// Builtins is the ordered list of builtin functions shared by the evaluator and the VM.
+// The compiler refers to them by index, so new builtins must be appended to the end.
+var Builtins = []struct {
+	Name    string
+	Builtin Builtin
+}{
+	{"len", Builtin{Fn: builtinLen}},
+	{"puts", Builtin{Fn: builtinPuts}},
+	{"first", Builtin{Fn: builtinFirst}},
+	{"last", Builtin{Fn: builtinLast}},
+	{"rest", Builtin{Fn: builtinRest}},
+	{"push", Builtin{Fn: builtinPush, Allocates: true}},
+}
+
+func GetBuiltinByName(name string) (Builtin, bool) {
+	for _, b := range Builtins {
+		if b.Name == name {
+			return b.Builtin, true
+		}
+	}
+	return Builtin{}, false
+}
+
+func newErrorf(format string, a ...any) Error {
+	return Error{Message: fmt.Sprintf(format, a...)}
+}
+
+func builtinLen(_ io.Writer, args ...Object) Object {
+	if len(args) != 1 {
+		return newErrorf("wrong number of arguments. got=%d, want=%d", len(args), 1)
+	}
+	switch args[0].Type() {
+	case TypeString:
+		return Integer{Value: int64(len(args[0].(String).Value))}
+	case TypeArray:
+		return Integer{Value: int64(len(args[0].(Array).Elements))}
+	default:
+		return newErrorf("argument to `len` not supported, got %s", args[0].Type())
+	}
+}
+
+func builtinPuts(out io.Writer, args ...Object) Object {
+	for _, arg := range args {
+		fmt.Fprintln(out, arg.Inspect())
+	}
+	return Null{}
+}
+
+func builtinFirst(_ io.Writer, args ...Object) Object {
+	if len(args) != 1 {
+		return newErrorf("wrong number of arguments. got=%d, want=%d", len(args), 1)
+	}
+	if args[0].Type() != TypeArray {
+		return newErrorf("argument to `first` not supported, got %s", args[0].Type())
+	}
+	arr := args[0].(Array)
+	if len(arr.Elements) == 0 {
+		return Null{}
+	}
+	return arr.Elements[0]
+}
+
+func builtinLast(_ io.Writer, args ...Object) Object {
+	if len(args) != 1 {
+		return newErrorf("wrong number of arguments. got=%d, want=%d", len(args), 1)
+	}
+	if args[0].Type() != TypeArray {
+		return newErrorf("argument to `last` not supported, got %s", args[0].Type())
+	}
+	arr := args[0].(Array)
+	if len(arr.Elements) == 0 {
+		return Null{}
+	}
+	return arr.Elements[len(arr.Elements)-1]
+}
+
+func builtinRest(_ io.Writer, args ...Object) Object {
+	if len(args) != 1 {
+		return newErrorf("wrong number of arguments. got=%d, want=%d", len(args), 1)
+	}
+	if args[0].Type() != TypeArray {
+		return newErrorf("argument to `rest` not supported, got %s", args[0].Type())
+	}
+	arr := args[0].(Array)
+	if len(arr.Elements) == 0 {
+		return Null{}
+	}
+	// arrays are never modified, so the rest can share the elements instead of copying them, which would
+	// make a loop over an array with rest take quadratic time.
+	return Array{Elements: arr.Elements[1:]}
+}
+
+func builtinPush(_ io.Writer, args ...Object) Object {
+	if len(args) != 2 {
+		return newErrorf("wrong number of arguments. got=%d, want=%d", len(args), 2)
+	}
+	if args[0].Type() != TypeArray {
+		return newErrorf("argument to `push` must be Array, got %s", args[0].Type())
+	}
+	arr := args[0].(Array)
+	elements := make([]Object, len(arr.Elements), len(arr.Elements)+1)
+	copy(elements, arr.Elements)
+	elements = append(elements, args[1])
+	return Array{Elements: elements}
+}
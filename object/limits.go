@@ -0,0 +1,25 @@
+package object
+
+import "errors"
+
+// Limits bounds the resources which the evaluator and the VM may use to run a program.
+// A zero field means no limit, except for MaxCallDepth.
+type Limits struct {
+	// MaxSteps is the number of instructions executed by the VM, or nodes evaluated by the evaluator.
+	MaxSteps int64
+	// MaxCallDepth is the number of function calls which may be active at once. Zero means the default
+	// of each engine, since calls cannot nest indefinitely on either of them. The defaults are the same,
+	// evaluator.DefaultMaxCallDepth and vm.MaxFrames.
+	MaxCallDepth int
+	// MaxElements is the total number of array elements and hash pairs which may be allocated.
+	MaxElements int64
+}
+
+var (
+	// ErrStepLimit is returned when a program runs more steps than Limits.MaxSteps.
+	ErrStepLimit = errors.New("step limit exceeded")
+	// ErrCallDepthLimit is returned when calls nest deeper than Limits.MaxCallDepth.
+	ErrCallDepthLimit = errors.New("maximum recursion depth exceeded")
+	// ErrAllocationLimit is returned when a program allocates more elements than Limits.MaxElements.
+	ErrAllocationLimit = errors.New("allocation limit exceeded")
+)
@@ -2,15 +2,19 @@ package object
 
 import (
 	"fmt"
+	"io"
 	"reflect"
 	"strconv"
 	"strings"
 
 	"github.com/Warashi/monkey/ast"
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/token"
 	"golang.org/x/exp/slices"
 )
 
-type BuiltinFunction func(args ...Object) Object
+// BuiltinFunction is the implementation of a builtin, which prints to out.
+type BuiltinFunction func(out io.Writer, args ...Object) Object
 
 //go:generate go run golang.org/x/tools/cmd/stringer -type Type -trimprefix Type
 type Type int
@@ -27,6 +31,9 @@ const (
 	TypeBuiltin
 	TypeArray
 	TypeHash
+	TypeCompiledFunction
+	TypeClosure
+	TypeTailCall
 )
 
 type Object interface {
@@ -57,18 +64,30 @@ type Return struct {
 	Value Object
 }
 
+// TailCall is a call in tail position, which the evaluator makes in place of the call being evaluated.
+type TailCall struct {
+	Fn   Function
+	Args []Object
+}
+
 type Error struct {
 	Message string
+	Pos     token.Position
+	Err     error // the cause of the error if it has a kind, such as ErrDivisionByZero
 }
 
 type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        Environment
+	Name       string // empty for anonymous functions
 }
 
 type Builtin struct {
 	Fn BuiltinFunction
+	// Allocates is whether the arrays returned by Fn have newly allocated elements, which count
+	// against Limits.MaxElements. It is false for builtins which share the elements of their arguments.
+	Allocates bool
 }
 
 type Array struct {
@@ -79,6 +98,19 @@ type Hash struct {
 	Pairs map[Hashable]Object
 }
 
+type CompiledFunction struct {
+	Name          string // empty for anonymous functions
+	Instructions  code.Instructions
+	NumLocals     int
+	NumParameters int
+	SourceMap     code.SourceMap
+}
+
+type Closure struct {
+	Fn   CompiledFunction
+	Free []Object
+}
+
 func (o Integer) Type() Type      { return TypeInteger }
 func (o Integer) Inspect() string { return strconv.FormatInt(o.Value, 10) }
 func (o Integer) hashable()       {}
@@ -97,8 +129,13 @@ func (o Null) Inspect() string { return "null" }
 func (o Return) Type() Type      { return TypeReturn }
 func (o Return) Inspect() string { return o.Value.Inspect() }
 
+func (o TailCall) Type() Type      { return TypeTailCall }
+func (o TailCall) Inspect() string { return "tail call of " + o.Fn.Inspect() }
+
 func (o Error) Type() Type      { return TypeError }
 func (o Error) Inspect() string { return "ERROR: " + o.Message }
+func (o Error) Error() string   { return o.Message }
+func (o Error) Unwrap() error   { return o.Err }
 
 func (o Function) Type() Type { return TypeFunction }
 func (o Function) Inspect() string {
@@ -132,11 +169,13 @@ func (o Array) Inspect() string {
 }
 
 func (o Hash) Type() Type { return TypeHash }
+
+// Inspect lists the pairs sorted by key, so that a hash is inspected the same on every run.
 func (o Hash) Inspect() string {
 	var b strings.Builder
 	pairs := make([]string, 0, len(o.Pairs))
-	for k, v := range o.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s:%s", k.Inspect(), v.Inspect()))
+	for _, p := range o.pairs() {
+		pairs = append(pairs, fmt.Sprintf("%s:%s", p[0].Inspect(), p[1].Inspect()))
 	}
 	b.WriteString("{")
 	b.WriteString(strings.Join(pairs, ", "))
@@ -152,3 +191,11 @@ func (o Hash) pairs() [][2]Object {
 	slices.SortFunc(pairs, func(a, b [2]Object) bool { return a[0].Inspect() < b[0].Inspect() })
 	return pairs
 }
+
+func (o CompiledFunction) Type() Type { return TypeCompiledFunction }
+func (o CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", o.Instructions)
+}
+
+func (o Closure) Type() Type      { return TypeClosure }
+func (o Closure) Inspect() string { return fmt.Sprintf("Closure[%p]", o.Fn.Instructions) }
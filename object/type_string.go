@@ -18,11 +18,14 @@ func _() {
 	_ = x[TypeBuiltin-8]
 	_ = x[TypeArray-9]
 	_ = x[TypeHash-10]
+	_ = x[TypeCompiledFunction-11]
+	_ = x[TypeClosure-12]
+	_ = x[TypeTailCall-13]
 }
 
-const _Type_name = "IntegerStringBooleanNullReturnErrorFunctionBuiltinArrayHash"
+const _Type_name = "IntegerStringBooleanNullReturnErrorFunctionBuiltinArrayHashCompiledFunctionClosureTailCall"
 
-var _Type_index = [...]uint8{0, 7, 13, 20, 24, 30, 35, 43, 50, 55, 59}
+var _Type_index = [...]uint8{0, 7, 13, 20, 24, 30, 35, 43, 50, 55, 59, 75, 82, 90}
 
 func (i Type) String() string {
 	i -= 1
@@ -36,6 +36,7 @@ var precedences = map[token.Type]precedence{
 	token.MINUS:    SUM,
 	token.ASTERISK: PRODUCT,
 	token.SLASH:    PRODUCT,
+	token.PERCENT:  PRODUCT,
 	token.LPAREN:   CALL,
 	token.LBLACKET: INDEX,
 }
@@ -64,6 +65,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
 	p.registerInfix(token.ASTERISK, p.parseInfixExpression)
 	p.registerInfix(token.SLASH, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBLACKET, p.parseIndexExpression)
 
@@ -106,7 +108,7 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	value, err := strconv.ParseInt(p.current.Literal, 10, 64)
 	if err != nil {
-		p.errors = append(p.errors, fmt.Sprintf("could not parse %q as integer", p.current.Literal))
+		p.errorf(p.current.Pos, "could not parse %q as integer", p.current.Literal)
 		return nil
 	}
 	return &ast.IntegerLiteral{Token: p.current, Value: value}
@@ -327,6 +329,9 @@ func (p *Parser) parseLetStatement() ast.Statement {
 	}
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
 	for p.peekIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -355,7 +360,7 @@ func (p *Parser) parseExpressionStatement() ast.Statement {
 func (p *Parser) parseExpression(prec precedence) ast.Expression {
 	prefix, ok := p.prefixParseFns[p.current.Type]
 	if !ok {
-		p.errors = append(p.errors, fmt.Sprintf("no prefixParseFn found: %s", p.current.Type))
+		p.errorf(p.current.Pos, "no prefixParseFn found: %s", p.current.Type)
 		return nil
 	}
 	left := prefix()
@@ -383,6 +388,12 @@ func (p *Parser) expectPeek(t token.Type) bool {
 		p.nextToken()
 		return true
 	}
-	p.errors = append(p.errors, fmt.Sprintf("expect next token is %s but %s instead", t, p.peek.Type))
+	p.errorf(p.peek.Pos, "expect next token is %s but %s instead", t, p.peek.Type)
 	return false
 }
+
+// errorf records an error at pos, followed by the excerpt of the source around it.
+func (p *Parser) errorf(pos token.Position, format string, a ...any) {
+	err := token.FormatError(p.l.Input(), &token.Error{Pos: pos, Err: fmt.Errorf(format, a...)})
+	p.errors = append(p.errors, err)
+}
@@ -17,7 +17,7 @@ import (
 
 func TestLetStatement(t *testing.T) {
 	p := parser.New(lexer.New(testdata.Let))
-	program := p.Parse()
+	program := ClearPositions(p.Parse())
 	require.Empty(t, p.Errors())
 	require.NotNil(t, program)
 
@@ -31,7 +31,7 @@ func TestLetStatement(t *testing.T) {
 
 func TestReturnStatement(t *testing.T) {
 	p := parser.New(lexer.New(testdata.Return))
-	program := p.Parse()
+	program := ClearPositions(p.Parse())
 	require.Empty(t, p.Errors())
 	require.NotNil(t, program)
 
@@ -45,7 +45,7 @@ func TestReturnStatement(t *testing.T) {
 
 func TestIdentifierExpression(t *testing.T) {
 	p := parser.New(lexer.New(testdata.IdentifierExpression))
-	program := p.Parse()
+	program := ClearPositions(p.Parse())
 	require.Empty(t, p.Errors())
 	require.NotNil(t, program)
 
@@ -55,7 +55,7 @@ func TestIdentifierExpression(t *testing.T) {
 
 func TestIntegerLiteralExpression(t *testing.T) {
 	p := parser.New(lexer.New(testdata.IntegerLiteralExpression))
-	program := p.Parse()
+	program := ClearPositions(p.Parse())
 	require.Empty(t, p.Errors())
 	require.NotNil(t, program)
 
@@ -65,7 +65,7 @@ func TestIntegerLiteralExpression(t *testing.T) {
 
 func TestStringLiteralExpression(t *testing.T) {
 	p := parser.New(lexer.New(testdata.StringLiteralExpression))
-	program := p.Parse()
+	program := ClearPositions(p.Parse())
 	require.Empty(t, p.Errors())
 	require.NotNil(t, program)
 
@@ -75,7 +75,7 @@ func TestStringLiteralExpression(t *testing.T) {
 
 func TestBooleanLiteralExpression(t *testing.T) {
 	p := parser.New(lexer.New(testdata.BooleanLiteralExpression))
-	program := p.Parse()
+	program := ClearPositions(p.Parse())
 	require.Empty(t, p.Errors())
 	require.NotNil(t, program)
 
@@ -87,7 +87,7 @@ func TestBooleanLiteralExpression(t *testing.T) {
 
 func TestFunctionLiteralExpression(t *testing.T) {
 	p := parser.New(lexer.New(testdata.FunctionLiteralExpression))
-	program := p.Parse()
+	program := ClearPositions(p.Parse())
 	require.Empty(t, p.Errors())
 	require.NotNil(t, program)
 
@@ -122,7 +122,7 @@ func TestFunctionParameterParsing(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			p := parser.New(lexer.New(tt.input))
-			program := p.Parse()
+			program := ClearPositions(p.Parse())
 			require.Empty(t, p.Errors())
 			require.NotNil(t, program)
 			assert.Equal(t, tt.want, program.Statements)
@@ -130,6 +130,18 @@ func TestFunctionParameterParsing(t *testing.T) {
 	}
 }
 
+func TestFunctionLiteralWithName(t *testing.T) {
+	p := parser.New(lexer.New("let myFunction = fn() { };"))
+	program := ClearPositions(p.Parse())
+	require.Empty(t, p.Errors())
+	require.NotNil(t, program)
+
+	fn := FunctionLiteral(BlockStatement())
+	fn.Name = "myFunction"
+	wants := []ast.Statement{LetStatement(Identifier("myFunction"), fn)}
+	assert.Equal(t, wants, program.Statements)
+}
+
 func TestArrayLiteralParsing(t *testing.T) {
 	tests := []struct {
 		input string
@@ -150,7 +162,7 @@ func TestArrayLiteralParsing(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			p := parser.New(lexer.New(tt.input))
-			program := p.Parse()
+			program := ClearPositions(p.Parse())
 			require.Empty(t, p.Errors())
 			require.NotNil(t, program)
 			assert.Equal(t, tt.want, program.Statements)
@@ -178,7 +190,7 @@ func TestHashLiteralParsing(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			p := parser.New(lexer.New(tt.input))
-			program := p.Parse()
+			program := ClearPositions(p.Parse())
 			require.Empty(t, p.Errors())
 			require.NotNil(t, program)
 			if !cmp.Equal(tt.want, program.Statements) {
@@ -202,7 +214,7 @@ func TestPrefixExpression(t *testing.T) {
 	for i, tt := range tests {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
 			p := parser.New(lexer.New(tt.input))
-			program := p.Parse()
+			program := ClearPositions(p.Parse())
 			require.Empty(t, p.Errors())
 			require.NotNil(t, program)
 			assert.Equal(t, tt.want, program.Statements)
@@ -222,6 +234,7 @@ func TestInfixExpression(t *testing.T) {
 		{input: "5 - 6", want: []ast.Statement{in(Minus, 5, 6)}},
 		{input: "5 * 6", want: []ast.Statement{in(Asterisk, 5, 6)}},
 		{input: "5 / 6", want: []ast.Statement{in(Slash, 5, 6)}},
+		{input: "5 % 6", want: []ast.Statement{in(Percent, 5, 6)}},
 		{input: "5 > 6", want: []ast.Statement{in(GT, 5, 6)}},
 		{input: "5 < 6", want: []ast.Statement{in(LT, 5, 6)}},
 		{input: "5 == 6", want: []ast.Statement{in(Equal, 5, 6)}},
@@ -230,7 +243,7 @@ func TestInfixExpression(t *testing.T) {
 	for i, tt := range tests {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
 			p := parser.New(lexer.New(tt.input))
-			program := p.Parse()
+			program := ClearPositions(p.Parse())
 			require.Empty(t, p.Errors())
 			require.NotNil(t, program)
 			assert.Equal(t, tt.want, program.Statements)
@@ -274,7 +287,7 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			p := parser.New(lexer.New(tt.input))
-			program := p.Parse()
+			program := ClearPositions(p.Parse())
 			require.Empty(t, p.Errors())
 			require.NotNil(t, program)
 			assert.Equal(t, tt.want, program.String())
@@ -316,7 +329,7 @@ func TestIfExpression(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			p := parser.New(lexer.New(tt.input))
-			program := p.Parse()
+			program := ClearPositions(p.Parse())
 			require.Empty(t, p.Errors())
 			require.NotNil(t, program)
 			assert.Equal(t, tt.want, program.Statements)
@@ -347,7 +360,7 @@ func TestCallExpression(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			p := parser.New(lexer.New(tt.input))
-			program := p.Parse()
+			program := ClearPositions(p.Parse())
 			require.Empty(t, p.Errors())
 			require.NotNil(t, program)
 			assert.Equal(t, tt.want, program.Statements)
@@ -371,10 +384,37 @@ func TestIndexExpressionParsing(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			p := parser.New(lexer.New(tt.input))
-			program := p.Parse()
+			program := ClearPositions(p.Parse())
 			require.Empty(t, p.Errors())
 			require.NotNil(t, program)
 			assert.Equal(t, tt.want, program.Statements)
 		})
 	}
 }
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "expect-peek",
+			input: "let x 5;",
+			want:  []string{"test.monkey:1:7: expect next token is ASSIGN but INT instead\n\tlet x 5;\n\t      ^"},
+		},
+		{
+			name:  "no-prefix",
+			input: "let x = 1;\n\tx + );",
+			want:  []string{"test.monkey:2:6: no prefixParseFn found: RPAREN\n\t\tx + );\n\t\t    ^"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := parser.New(lexer.NewFile("test.monkey", tt.input))
+			p.Parse()
+			assert.Equal(t, tt.want, p.Errors())
+		})
+	}
+}
@@ -2,41 +2,120 @@ package repl
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 
+	"github.com/Warashi/monkey/ast"
 	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/evaluator"
+	"github.com/Warashi/monkey/internal/vmhook"
 	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/object"
 	"github.com/Warashi/monkey/parser"
+	"github.com/Warashi/monkey/token"
 	"github.com/Warashi/monkey/vm"
 )
 
 const PROMPT = ">> "
 
-func Start(r io.Reader, w io.Writer) {
+type Engine string
+
+const (
+	EngineVM   Engine = "vm"
+	EngineEval Engine = "eval"
+)
+
+func ParseEngine(s string) (Engine, error) {
+	switch e := Engine(s); e {
+	case EngineVM, EngineEval:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unknown engine: %q, want %q or %q", s, EngineVM, EngineEval)
+	}
+}
+
+func Start(r io.Reader, w io.Writer, engine Engine) {
+	var run func(program *ast.Program, src string) (object.Object, error)
+	switch engine {
+	case EngineEval:
+		run = newEvaluator(w)
+	default:
+		run = newVM(w)
+	}
+
 	s := bufio.NewScanner(r)
 	fmt.Fprint(w, PROMPT)
-	for s.Scan() {
-		l := lexer.New(s.Text())
-		p := parser.New(l)
+	for ; s.Scan(); fmt.Fprint(w, PROMPT) {
+		src := s.Text()
+		p := parser.New(lexer.New(src))
 		program := p.Parse()
 		if errs := p.Errors(); len(errs) != 0 {
 			for _, err := range errs {
-				fmt.Fprintf(w, "\t%s\n", err)
-				continue
+				fmt.Fprintln(w, err)
 			}
+			continue
+		}
+		result, err := run(program, src)
+		if err != nil {
+			fmt.Fprintln(w, err)
+			continue
+		}
+		if result != nil {
+			fmt.Fprintln(w, result.Inspect())
 		}
-		compiler := compiler.New()
+	}
+}
+
+// newVM returns a function which compiles and runs programs on the VM,
+// carrying the symbol table, constant pool and globals over to the next call.
+// A program which fails to compile or run carries nothing over, so that later programs
+// cannot refer to globals it defined but did not set. Programs print to w.
+func newVM(w io.Writer) func(*ast.Program, string) (object.Object, error) {
+	var constants []object.Object
+	var numGlobals int
+	globals := make([]object.Object, vm.GlobalsSize)
+	symbolTable := compiler.NewSymbolTable()
+	for i, b := range object.Builtins {
+		symbolTable.DefineBuiltin(i, b.Name)
+	}
+
+	return func(program *ast.Program, src string) (object.Object, error) {
+		saved := symbolTable.Clone()
+		compiler := compiler.NewWithState(symbolTable, constants)
 		if err := compiler.Compile(program); err != nil {
-			fmt.Fprintf(w, "failed compile: %+v", err)
+			symbolTable = saved
+			return nil, fmt.Errorf("failed compile: %s", token.FormatError(src, err))
 		}
+		bytecode := compiler.Bytecode()
 
-		machine := vm.New(compiler.Bytecode())
+		machine := vm.NewWithGlobalsStore(bytecode, globals)
+		machine.SetOutput(w)
+		// the constants of the previous lines were verified when they were run
+		vmhook.SetVerifiedConstants(machine, len(constants))
 		if err := machine.Run(); err != nil {
-			fmt.Fprintf(w, "failed run: %+v", err)
+			symbolTable = saved
+			// the slots are given to the next definitions, which must not see the values set here
+			for i := numGlobals; i < len(bytecode.Globals); i++ {
+				globals[i] = nil
+			}
+			return nil, fmt.Errorf("failed run: %s", vm.FormatError(src, err))
 		}
+		constants = bytecode.Constants
+		numGlobals = len(bytecode.Globals)
+		return machine.LastPopedStackElem(), nil
+	}
+}
 
-		fmt.Fprintln(w, machine.LastPopedStackElem().Inspect())
-		fmt.Fprint(w, PROMPT)
+// newEvaluator returns a function which evaluates programs with the tree-walking evaluator
+// in an environment shared between calls. Programs print to w.
+func newEvaluator(w io.Writer) func(*ast.Program, string) (object.Object, error) {
+	env := object.NewEnvironment()
+	return func(program *ast.Program, src string) (object.Object, error) {
+		result := evaluator.EvalWithOptions(program, env, evaluator.Options{Output: w})
+		if err, ok := result.(object.Error); ok {
+			return nil, errors.New(token.FormatError(src, &token.Error{Pos: err.Pos, Err: err}))
+		}
+		return result, nil
 	}
 }
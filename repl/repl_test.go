@@ -0,0 +1,91 @@
+package repl_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Warashi/monkey/repl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartKeepsState(t *testing.T) {
+	t.Parallel()
+	input := strings.Join([]string{
+		"let x = 5;",
+		"let double = fn(a) { a * 2 }; double(x)",
+		"double(x) + 1",
+		"let len = fn(a) { 42 }; len([])",
+		"len([])",
+		"y",
+		"x",
+	}, "\n")
+
+	tests := []struct {
+		engine    repl.Engine
+		wantError string
+	}{
+		{repl.EngineVM, "undefined variable: y"},
+		{repl.EngineEval, "identifier not found: y"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(string(tt.engine), func(t *testing.T) {
+			t.Parallel()
+			var out strings.Builder
+			repl.Start(strings.NewReader(input), &out, tt.engine)
+
+			lines := strings.Split(out.String(), repl.PROMPT)
+			assert.Equal(t, []string{"", "5\n", "10\n", "11\n", "42\n", "42\n"}, lines[:6])
+			assert.Contains(t, lines[6], tt.wantError)
+			assert.Equal(t, []string{"5\n", ""}, lines[7:])
+		})
+	}
+}
+
+func TestStartPrintsToWriter(t *testing.T) {
+	t.Parallel()
+	for _, engine := range []repl.Engine{repl.EngineVM, repl.EngineEval} {
+		engine := engine
+		t.Run(string(engine), func(t *testing.T) {
+			t.Parallel()
+			var out strings.Builder
+			repl.Start(strings.NewReader(`puts("hello")`), &out, engine)
+			assert.Equal(t, repl.PROMPT+"hello\nnull\n"+repl.PROMPT, out.String())
+		})
+	}
+}
+
+func TestStartDiscardsFailedLines(t *testing.T) {
+	t.Parallel()
+	input := strings.Join([]string{
+		"let a = len(1);",
+		"a + 1",
+		"let b = 2; let c = len(1);",
+		"if (false) { let d = 3; }; d",
+		"let a = 1; a + 1",
+	}, "\n")
+
+	tests := []struct {
+		engine     repl.Engine
+		wantErrors []string
+	}{
+		{repl.EngineVM, []string{"argument to `len` not supported", "undefined variable: a", "argument to `len` not supported", "identifier not found: d"}},
+		{repl.EngineEval, []string{"argument to `len` not supported", "identifier not found: a", "argument to `len` not supported", "identifier not found: d"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(string(tt.engine), func(t *testing.T) {
+			t.Parallel()
+			var out strings.Builder
+			repl.Start(strings.NewReader(input), &out, tt.engine)
+
+			lines := strings.Split(out.String(), repl.PROMPT)
+			require.Len(t, lines, 7)
+			for i, want := range tt.wantErrors {
+				assert.Contains(t, lines[i+1], want)
+			}
+			assert.Equal(t, []string{"2\n", ""}, lines[5:])
+		})
+	}
+}
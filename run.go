@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/Warashi/monkey/asm"
+	"github.com/Warashi/monkey/ast"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/disasm"
+	"github.com/Warashi/monkey/evaluator"
+	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/parser"
+	"github.com/Warashi/monkey/repl"
+	"github.com/Warashi/monkey/token"
+	"github.com/Warashi/monkey/vm"
+)
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const usage = `Usage:
+	monkey [repl] [-engine=vm|eval]
+		start an interactive session
+	monkey run [-engine=vm|eval] [-nofold] [-nopeephole] [-checked] [FILE | -]
+		run a program read from FILE, or from stdin if FILE is omitted or "-"
+	monkey run [-engine=vm|eval] [-nofold] [-nopeephole] [-checked] -e EXPRESSION
+		run EXPRESSION and print its value
+	monkey run [-checked] FILE.mkc
+		run a compiled bytecode file on the vm
+	monkey compile [-o OUTPUT] [-nofold] [-nopeephole] FILE
+		compile FILE into bytecode, written to OUTPUT (FILE with the extension .mkc by default)
+	monkey asm [-o OUTPUT] FILE
+		assemble FILE written in the format printed by disasm into bytecode, written like compile
+	monkey disasm [-nofold] [-nopeephole] FILE
+		print the disassembled bytecode of a program or a compiled bytecode file
+
+The flags -nofold and -nopeephole disable constant folding and peephole optimization in the compiler,
+to debug the instructions as they are emitted. The flag -checked makes integer overflow a runtime error
+instead of wrapping around.
+`
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	cmd := "repl"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "repl":
+		return runRepl(args, stdin, stdout, stderr)
+	case "run":
+		return runProgram(args, stdin, stdout, stderr)
+	case "compile":
+		return runCompile(cmd, args, stderr, compile)
+	case "asm":
+		return runCompile(cmd, args, stderr, assemble)
+	case "disasm":
+		return runDisasm(args, stdout, stderr)
+	case "help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	default:
+		fmt.Fprintf(stderr, "unknown command: %s\n%s", cmd, usage)
+		return exitUsage
+	}
+}
+
+func newFlagSet(name string, stderr io.Writer) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	engine := fs.String("engine", string(repl.EngineVM), "execution engine: vm or eval")
+	return fs, engine
+}
+
+// compileOptions disables optimizations of the compiler.
+type compileOptions struct {
+	noFold     bool
+	noPeephole bool
+}
+
+func addCompileFlags(fs *flag.FlagSet) *compileOptions {
+	opts := &compileOptions{}
+	fs.BoolVar(&opts.noFold, "nofold", false, "disable constant folding")
+	fs.BoolVar(&opts.noPeephole, "nopeephole", false, "disable peephole optimization")
+	return opts
+}
+
+func runRepl(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs, engineName := newFlagSet("repl", stderr)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	engine, err := repl.ParseEngine(*engineName)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	name := "there"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	fmt.Fprintf(stdout, "Hello, %s!, This is the Monkey programming language!\n", name)
+	fmt.Fprintln(stdout, "Fell free to type in commands")
+	repl.Start(stdin, stdout, engine)
+	return exitOK
+}
+
+func runProgram(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs, engineName := newFlagSet("run", stderr)
+	expression := fs.String("e", "", "expression to run instead of a file")
+	checked := fs.Bool("checked", false, "report integer overflow as an error instead of wrapping around")
+	opts := addCompileFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	engine, err := repl.ParseEngine(*engineName)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	var name, src string
+	switch {
+	case *expression != "" && fs.NArg() != 0:
+		fmt.Fprintf(stderr, "-e cannot be combined with a file\n%s", usage)
+		return exitUsage
+	case *expression != "":
+		name, src = "-e", *expression
+	case fs.NArg() > 1:
+		fmt.Fprintf(stderr, "too many arguments\n%s", usage)
+		return exitUsage
+	case fs.NArg() == 0 || fs.Arg(0) == "-":
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to read stdin: %v\n", err)
+			return exitError
+		}
+		name, src = "<stdin>", string(b)
+	default:
+		b, err := os.ReadFile(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to read file: %v\n", err)
+			return exitError
+		}
+		if compiler.IsEncodedBytecode(b) {
+			return runBytecode(engine, b, *checked, stdout, stderr)
+		}
+		name, src = fs.Arg(0), string(b)
+	}
+
+	result, err := execute(engine, name, src, *opts, *checked, stdout)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if *expression != "" && result != nil {
+		fmt.Fprintln(stdout, result.Inspect())
+	}
+	return exitOK
+}
+
+func runBytecode(engine repl.Engine, b []byte, checked bool, stdout, stderr io.Writer) int {
+	if engine != repl.EngineVM {
+		fmt.Fprintf(stderr, "compiled bytecode can only be run on the vm engine\n")
+		return exitUsage
+	}
+	var bytecode compiler.Bytecode
+	if err := bytecode.UnmarshalBinary(b); err != nil {
+		fmt.Fprintf(stderr, "failed to load bytecode: %v\n", err)
+		return exitError
+	}
+	machine := vm.New(bytecode)
+	machine.SetOutput(stdout)
+	if checked {
+		machine.EnableCheckedArithmetic()
+	}
+	if err := machine.Run(); err != nil {
+		// Run verifies the bytecode before executing it
+		var verifyErr *vm.VerifyError
+		if errors.As(err, &verifyErr) {
+			fmt.Fprintf(stderr, "invalid bytecode: %v\n", verifyErr)
+			return exitError
+		}
+		// the source is not available, so only positions and the stack trace are shown
+		fmt.Fprintf(stderr, "runtime error: %s\n", vm.FormatError("", err))
+		return exitError
+	}
+	return exitOK
+}
+
+// runCompile translates a file into bytecode with translate and writes it in the bytecode file format.
+func runCompile(cmd string, args []string, stderr io.Writer, translate func(name, src string, opts compileOptions) (compiler.Bytecode, error)) int {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	output := fs.String("o", "", "output file")
+	opts := &compileOptions{}
+	if cmd == "compile" {
+		opts = addCompileFlags(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(stderr, "%s takes exactly one file\n%s", cmd, usage)
+		return exitUsage
+	}
+	name := fs.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(name, filepath.Ext(name)) + ".mkc"
+	}
+
+	src, err := os.ReadFile(name)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to read file: %v\n", err)
+		return exitError
+	}
+	bytecode, err := translate(name, string(src), *opts)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	b, err := bytecode.MarshalBinary()
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to encode bytecode: %v\n", err)
+		return exitError
+	}
+	if err := os.WriteFile(*output, b, 0o644); err != nil {
+		fmt.Fprintf(stderr, "failed to write file: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func runDisasm(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	opts := addCompileFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(stderr, "disasm takes exactly one file\n%s", usage)
+		return exitUsage
+	}
+
+	b, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to read file: %v\n", err)
+		return exitError
+	}
+	var bytecode compiler.Bytecode
+	if compiler.IsEncodedBytecode(b) {
+		err = bytecode.UnmarshalBinary(b)
+	} else {
+		bytecode, err = compile(fs.Arg(0), string(b), *opts)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if err := disasm.Disassemble(stdout, bytecode); err != nil {
+		fmt.Fprintf(stderr, "failed to disassemble: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// parse parses src. The returned error lists every syntax error with its excerpt.
+func parse(name, src string) (*ast.Program, error) {
+	p := parser.New(lexer.NewFile(name, src))
+	program := p.Parse()
+	if errs := p.Errors(); len(errs) != 0 {
+		return nil, fmt.Errorf("parse error: %s", strings.Join(errs, "\n"))
+	}
+	return program, nil
+}
+
+// compile parses and compiles src with the optimizations not disabled by opts.
+// The returned error is rendered with the excerpt of the source where it happened.
+func compile(name, src string, opts compileOptions) (compiler.Bytecode, error) {
+	program, err := parse(name, src)
+	if err != nil {
+		return compiler.Bytecode{}, err
+	}
+	c := compiler.New()
+	if opts.noFold {
+		c.DisableConstantFolding()
+	}
+	if opts.noPeephole {
+		c.DisablePeepholeOptimization()
+	}
+	if err := c.Compile(program); err != nil {
+		return compiler.Bytecode{}, fmt.Errorf("compile error: %s", token.FormatError(src, err))
+	}
+	return c.Bytecode(), nil
+}
+
+// assemble assembles src. opts is ignored, since assembled instructions are taken as written.
+// The returned error is rendered with the excerpt of the source where it happened.
+func assemble(name, src string, opts compileOptions) (compiler.Bytecode, error) {
+	bytecode, err := asm.AssembleFile(name, src)
+	if err != nil {
+		return compiler.Bytecode{}, fmt.Errorf("assemble error: %s", token.FormatError(src, err))
+	}
+	return bytecode, nil
+}
+
+// execute runs src with engine, which prints to stdout. opts applies to the vm, and checked to both
+// engines. The returned error is rendered with the excerpt of the source where it happened.
+func execute(engine repl.Engine, name, src string, opts compileOptions, checked bool, stdout io.Writer) (object.Object, error) {
+	switch engine {
+	case repl.EngineEval:
+		program, err := parse(name, src)
+		if err != nil {
+			return nil, err
+		}
+		result := evaluator.EvalWithOptions(program, object.NewEnvironment(), evaluator.Options{CheckedArithmetic: checked, Output: stdout})
+		if err, ok := result.(object.Error); ok {
+			return nil, fmt.Errorf("runtime error: %s", token.FormatError(src, &token.Error{Pos: err.Pos, Err: err}))
+		}
+		return result, nil
+	default:
+		bytecode, err := compile(name, src, opts)
+		if err != nil {
+			return nil, err
+		}
+		machine := vm.New(bytecode)
+		machine.SetOutput(stdout)
+		if checked {
+			machine.EnableCheckedArithmetic()
+		}
+		if err := machine.Run(); err != nil {
+			return nil, fmt.Errorf("runtime error: %s", vm.FormatError(src, err))
+		}
+		return machine.LastPopedStackElem(), nil
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		stdin      string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{"expression/vm", []string{"run", "-e", "1 + 2"}, "", exitOK, "3\n", ""},
+		{"expression/eval", []string{"run", "-engine=eval", "-e", "1 + 2"}, "", exitOK, "3\n", ""},
+		{"expression/nofold", []string{"run", "-nofold", "-e", "2 * 3"}, "", exitOK, "6\n", ""},
+		{"expression/nopeephole", []string{"run", "-nopeephole", "-e", "if (1 > 2) { 3 }"}, "", exitOK, "null\n", ""},
+		{"file/vm", []string{"run", "testdata/hello.monkey"}, "", exitOK, "hello, monkey\n", ""},
+		{"file/eval", []string{"run", "-engine=eval", "testdata/hello.monkey"}, "", exitOK, "hello, monkey\n", ""},
+		{"stdin", []string{"run", "-"}, `puts(len("four"))`, exitOK, "4\n", ""},
+		{"stdin/implicit", []string{"run", "-engine=eval"}, `puts(len("four"))`, exitOK, "4\n", ""},
+		{"parse-error", []string{"run", "-e", "let = 1"}, "", exitError, "", "parse error"},
+		{"compile-error", []string{"run", "-e", "x"}, "", exitError, "", "compile error: -e:1:1: undefined variable: x"},
+		{"runtime-error/vm", []string{"run", "-e", "1 + true"}, "", exitError, "", "runtime error: -e:1:3: type mismatch: Integer + Boolean\n\t1 + true\n\t  ^\n\tat <main> (-e:1:3)\n"},
+		{"tail-call-error/vm", []string{"run", "-e", "let f = fn(x) { x(1) }; f(2)"}, "", exitError, "", "runtime error: -e:1:18: not a function: Integer\n\tlet f = fn(x) { x(1) }; f(2)\n\t                 ^\n\tat f (-e:1:18)\n\tat <main> (-e:1:26)\n"},
+		{"runtime-error/eval", []string{"run", "-engine=eval", "-e", "1 + true"}, "", exitError, "", "runtime error: -e:1:3: type mismatch: Integer + Boolean\n\t1 + true\n\t  ^\n"},
+		{"division-by-zero", []string{"run", "-e", "10 % 0"}, "", exitError, "", "runtime error: -e:1:4: division by zero: 10 % 0\n"},
+		{"overflow", []string{"run", "-e", "9223372036854775807 + 1"}, "", exitOK, "-9223372036854775808\n", ""},
+		{"checked/vm", []string{"run", "-checked", "-e", "9223372036854775807 + 1"}, "", exitError, "", "runtime error: -e:1:21: integer overflow: 9223372036854775807 + 1\n"},
+		{"checked/eval", []string{"run", "-engine=eval", "-checked", "-e", "9223372036854775807 + 1"}, "", exitError, "", "runtime error: -e:1:21: integer overflow: 9223372036854775807 + 1"},
+		{"missing-file", []string{"run", "testdata/missing.monkey"}, "", exitError, "", "failed to read file"},
+		{"unknown-engine", []string{"run", "-engine=jit", "-e", "1"}, "", exitUsage, "", "unknown engine"},
+		{"unknown-command", []string{"jit"}, "", exitUsage, "", "unknown command: jit"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			code := run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			assert.Equal(t, tt.wantCode, code)
+			assert.Equal(t, tt.wantStdout, stdout.String())
+			assert.Contains(t, stderr.String(), tt.wantStderr)
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "hello.mkc")
+
+	var stdout, stderr strings.Builder
+
+	require.Equal(t, exitOK, run([]string{"compile", "-o", output, "testdata/hello.monkey"}, strings.NewReader(""), &stdout, &stderr), stderr.String())
+	assert.Empty(t, stdout.String())
+
+	assert.Equal(t, exitOK, run([]string{"run", output}, strings.NewReader(""), &stdout, &stderr), stderr.String())
+	assert.Equal(t, "hello, monkey\n", stdout.String())
+
+	stderr.Reset()
+	assert.Equal(t, exitUsage, run([]string{"run", "-engine=eval", output}, strings.NewReader(""), &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "only be run on the vm")
+
+	var fromSource, fromBytecode strings.Builder
+	assert.Equal(t, exitOK, run([]string{"disasm", "testdata/hello.monkey"}, strings.NewReader(""), &fromSource, &stderr), stderr.String())
+	assert.Equal(t, exitOK, run([]string{"disasm", output}, strings.NewReader(""), &fromBytecode, &stderr), stderr.String())
+	assert.Contains(t, fromSource.String(), "OpGetBuiltin 1            ; puts")
+	assert.Equal(t, fromSource.String(), fromBytecode.String())
+
+	b, err := os.ReadFile(output)
+	require.NoError(t, err)
+	b[len(b)-1] ^= 0xff
+	corrupted := filepath.Join(t.TempDir(), "corrupted.mkc")
+	require.NoError(t, os.WriteFile(corrupted, b, 0o644))
+	stderr.Reset()
+	assert.Equal(t, exitError, run([]string{"run", corrupted}, strings.NewReader(""), &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "checksum mismatch")
+}
+
+func TestDisasmOptimizations(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "optimize.monkey")
+	require.NoError(t, os.WriteFile(src, []byte("60 * 60 * 24; if (true) { 1 } else { 2 }; 3"), 0o644))
+
+	disassemble := func(args ...string) string {
+		var stdout, stderr strings.Builder
+		require.Equal(t, exitOK, run(append(append([]string{"disasm"}, args...), src), strings.NewReader(""), &stdout, &stderr), stderr.String())
+		return stdout.String()
+	}
+	optimized := disassemble()
+	assert.Contains(t, optimized, ".constant 0 Integer 86400")
+	assert.NotContains(t, optimized, "OpMul")
+	assert.NotContains(t, optimized, "OpJump")
+
+	assert.Contains(t, disassemble("-nofold"), "OpMul")
+	unoptimized := disassemble("-nofold", "-nopeephole")
+	assert.Contains(t, unoptimized, "OpTrue")
+	assert.Contains(t, unoptimized, "OpJumpNotTruthy")
+}
+
+func TestAssemble(t *testing.T) {
+	dir := t.TempDir()
+	listing := filepath.Join(dir, "hello.masm")
+	output := filepath.Join(dir, "hello.mkc")
+
+	var stdout, stderr strings.Builder
+
+	require.Equal(t, exitOK, run([]string{"disasm", "testdata/hello.monkey"}, strings.NewReader(""), &stdout, &stderr), stderr.String())
+	require.NoError(t, os.WriteFile(listing, []byte(stdout.String()), 0o644))
+	stdout.Reset()
+
+	require.Equal(t, exitOK, run([]string{"asm", listing}, strings.NewReader(""), &stdout, &stderr), stderr.String())
+	assert.Equal(t, exitOK, run([]string{"run", output}, strings.NewReader(""), &stdout, &stderr), stderr.String())
+	assert.Equal(t, "hello, monkey\n", stdout.String())
+
+	invalid := filepath.Join(dir, "invalid.masm")
+	require.NoError(t, os.WriteFile(invalid, []byte(".main\n\tOpAdd\n.end\n"), 0o644))
+	require.Equal(t, exitOK, run([]string{"asm", invalid}, strings.NewReader(""), &stdout, &stderr), stderr.String())
+	assert.Equal(t, exitError, run([]string{"run", filepath.Join(dir, "invalid.mkc")}, strings.NewReader(""), &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "invalid bytecode: <main> at 0000: OpAdd pops 2 values from a stack of depth 0")
+
+	broken := filepath.Join(dir, "broken.masm")
+	require.NoError(t, os.WriteFile(broken, []byte(".main\n\tOpNop\n.end\n"), 0o644))
+	assert.Equal(t, exitError, run([]string{"asm", broken}, strings.NewReader(""), &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "assemble error: "+broken+":2:2: unknown opcode OpNop\n\t\tOpNop\n\t\t^")
+}
@@ -0,0 +1,14 @@
+package testutil
+
+import (
+	"testing"
+
+	"github.com/Warashi/monkey/asm"
+	"github.com/Warashi/monkey/compiler"
+)
+
+// Assemble assembles src written in the format of package asm.
+func Assemble(t testing.TB, src string) compiler.Bytecode {
+	t.Helper()
+	return NoError(t, func() (compiler.Bytecode, error) { return asm.Assemble(src) })
+}
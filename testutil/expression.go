@@ -18,6 +18,7 @@ var (
 	}
 	Asterisk = Token(token.ASTERISK, "*")
 	Slash    = Token(token.SLASH, "/")
+	Percent  = Token(token.PERCENT, "%")
 	Plus     = Token(token.PLUS, "+")
 	Minus    = Token(token.MINUS, "-")
 	GT       = Token(token.GT, ">")
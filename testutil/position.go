@@ -0,0 +1,63 @@
+package testutil
+
+import (
+	"reflect"
+
+	"github.com/Warashi/monkey/token"
+)
+
+var positionType = reflect.TypeOf(token.Position{})
+
+// ClearPositions zeroes every token.Position reachable from v,
+// so that parsed results can be compared with nodes built by this package.
+// Values reachable through pointers are modified in place.
+func ClearPositions[T any](v T) T {
+	clearPositions(reflect.ValueOf(&v).Elem())
+	return v
+}
+
+func clearPositions(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			clearPositions(v.Elem())
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		clearPositions(elem)
+		if v.CanSet() {
+			v.Set(elem)
+		}
+	case reflect.Struct:
+		if v.Type() == positionType {
+			if v.CanSet() {
+				v.Set(reflect.Zero(positionType))
+			}
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				clearPositions(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			clearPositions(v.Index(i))
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if iter.Key().Kind() == reflect.Pointer || iter.Key().Kind() == reflect.Interface {
+				clearPositions(iter.Key())
+			}
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			clearPositions(elem)
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func NoError[T any](t *testing.T, f func() (T, error)) T {
+func NoError[T any](t testing.TB, f func() (T, error)) T {
 	t.Helper()
 	r, err := f()
 	require.NoError(t, err)
@@ -0,0 +1,83 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Position is a location in the source code.
+type Position struct {
+	Filename string
+	Offset   int // byte offset, starting at 0
+	Line     int // line number, starting at 1
+	Column   int // column number in bytes, starting at 1
+}
+
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+// String returns "file:line:col", or "line:col" when there is no filename.
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.Filename != "" {
+			return p.Filename
+		}
+		return "-"
+	}
+	if p.Filename == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+// Excerpt returns the line of src containing p followed by a line with a caret under its column.
+func (p Position) Excerpt(src string) string {
+	if !p.IsValid() || p.Offset > len(src) {
+		return ""
+	}
+	start := strings.LastIndexByte(src[:p.Offset], '\n') + 1
+	end := strings.IndexByte(src[start:], '\n')
+	if end < 0 {
+		end = len(src)
+	} else {
+		end += start
+	}
+	line := src[start:end]
+
+	var b strings.Builder
+	b.WriteString("\t")
+	b.WriteString(line)
+	b.WriteString("\n\t")
+	for _, ch := range []byte(src[start:p.Offset]) {
+		// keep tabs so that the caret lines up with the excerpt
+		if ch == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	b.WriteString("^")
+	return b.String()
+}
+
+// Error is an error which occurred at a position in the source code.
+type Error struct {
+	Pos Position
+	Err error
+}
+
+func (e *Error) Error() string { return e.Pos.String() + ": " + e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// FormatError renders err with the source excerpt of its position, if it has one.
+func FormatError(src string, err error) string {
+	var e *Error
+	if !errors.As(err, &e) || !e.Pos.IsValid() {
+		return err.Error()
+	}
+	excerpt := e.Pos.Excerpt(src)
+	if excerpt == "" {
+		return e.Error()
+	}
+	return e.Error() + "\n" + excerpt
+}
@@ -19,6 +19,7 @@ const (
 	BANG     // !
 	ASTERISK // *
 	SLASH    // /
+	PERCENT  // %
 
 	LT     // <
 	GT     // >
@@ -49,4 +50,5 @@ const (
 type Token struct {
 	Type    Type
 	Literal string
+	Pos     Position
 }
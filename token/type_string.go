@@ -19,31 +19,32 @@ func _() {
 	_ = x[BANG-8]
 	_ = x[ASTERISK-9]
 	_ = x[SLASH-10]
-	_ = x[LT-11]
-	_ = x[GT-12]
-	_ = x[EQ-13]
-	_ = x[NOT_EQ-14]
-	_ = x[COMMA-15]
-	_ = x[SEMICOLON-16]
-	_ = x[LPAREN-17]
-	_ = x[RPAREN-18]
-	_ = x[LBRACE-19]
-	_ = x[RBRACE-20]
-	_ = x[LBLACKET-21]
-	_ = x[RBLACKET-22]
-	_ = x[COLON-23]
-	_ = x[FUNCTION-24]
-	_ = x[LET-25]
-	_ = x[TRUE-26]
-	_ = x[FALSE-27]
-	_ = x[IF-28]
-	_ = x[ELSE-29]
-	_ = x[RETURN-30]
+	_ = x[PERCENT-11]
+	_ = x[LT-12]
+	_ = x[GT-13]
+	_ = x[EQ-14]
+	_ = x[NOT_EQ-15]
+	_ = x[COMMA-16]
+	_ = x[SEMICOLON-17]
+	_ = x[LPAREN-18]
+	_ = x[RPAREN-19]
+	_ = x[LBRACE-20]
+	_ = x[RBRACE-21]
+	_ = x[LBLACKET-22]
+	_ = x[RBLACKET-23]
+	_ = x[COLON-24]
+	_ = x[FUNCTION-25]
+	_ = x[LET-26]
+	_ = x[TRUE-27]
+	_ = x[FALSE-28]
+	_ = x[IF-29]
+	_ = x[ELSE-30]
+	_ = x[RETURN-31]
 }
 
-const _Type_name = "ILLEGALEOFIDENTINTSTRINGASSIGNPLUSMINUSBANGASTERISKSLASHLTGTEQNOT_EQCOMMASEMICOLONLPARENRPARENLBRACERBRACELBLACKETRBLACKETCOLONFUNCTIONLETTRUEFALSEIFELSERETURN"
+const _Type_name = "ILLEGALEOFIDENTINTSTRINGASSIGNPLUSMINUSBANGASTERISKSLASHPERCENTLTGTEQNOT_EQCOMMASEMICOLONLPARENRPARENLBRACERBRACELBLACKETRBLACKETCOLONFUNCTIONLETTRUEFALSEIFELSERETURN"
 
-var _Type_index = [...]uint8{0, 7, 10, 15, 18, 24, 30, 34, 39, 43, 51, 56, 58, 60, 62, 68, 73, 82, 88, 94, 100, 106, 114, 122, 127, 135, 138, 142, 147, 149, 153, 159}
+var _Type_index = [...]uint8{0, 7, 10, 15, 18, 24, 30, 34, 39, 43, 51, 56, 63, 65, 67, 69, 75, 80, 89, 95, 101, 107, 113, 121, 129, 134, 142, 145, 149, 154, 156, 160, 166}
 
 func (i Type) String() string {
 	if i < 0 || i >= Type(len(_Type_index)-1) {
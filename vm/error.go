@@ -0,0 +1,71 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/token"
+)
+
+// StackFrame is a Monkey-level call frame which was active when a runtime error occurred.
+type StackFrame struct {
+	Function string
+	Pos      token.Position
+}
+
+func (f StackFrame) String() string { return fmt.Sprintf("%s (%s)", f.Function, f.Pos) }
+
+// RuntimeError is an error which occurred while running bytecode. Err wraps the error the program
+// failed with, whose message is the one the evaluator gives for the same failure.
+type RuntimeError struct {
+	Err        *token.Error
+	StackTrace []StackFrame // innermost frame first
+}
+
+func (e *RuntimeError) Error() string { return e.Err.Error() }
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// maxTraceLines is the number of lines of the stack trace shown at each end by Trace.
+const maxTraceLines = 10
+
+// Trace renders the stack trace, one frame per line like the call chain of the recursion errors of the
+// evaluator: consecutive frames at the same place are shown once, and a long trace shows only both ends.
+func (e *RuntimeError) Trace() string {
+	var lines []string
+	for i := 0; i < len(e.StackTrace); {
+		j := i
+		for j+1 < len(e.StackTrace) && e.StackTrace[j+1] == e.StackTrace[i] {
+			j++
+		}
+		line := "\tat " + e.StackTrace[i].String()
+		if n := j - i + 1; n > 1 {
+			line += fmt.Sprintf(" [%d times]", n)
+		}
+		lines = append(lines, line)
+		i = j + 1
+	}
+	if len(lines) > 2*maxTraceLines {
+		omitted := fmt.Sprintf("\t... %d more", len(lines)-2*maxTraceLines)
+		lines = append(append(lines[:maxTraceLines:maxTraceLines], omitted), lines[len(lines)-maxTraceLines:]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// newErrorf returns an error a program fails with, as object.Error like the errors of the evaluator.
+// A %w verb in format gives the error a kind, which can be told with errors.Is.
+func newErrorf(format string, a ...any) error {
+	err := fmt.Errorf(format, a...)
+	return object.Error{Message: err.Error(), Err: errors.Unwrap(err)}
+}
+
+// FormatError renders err like token.FormatError, followed by the stack trace if err is a *RuntimeError.
+func FormatError(src string, err error) string {
+	msg := token.FormatError(src, err)
+	var re *RuntimeError
+	if errors.As(err, &re) {
+		msg += "\n" + re.Trace()
+	}
+	return msg
+}
@@ -0,0 +1,30 @@
+package vm
+
+import (
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/token"
+)
+
+type Frame struct {
+	cl          object.Closure
+	ip          int // offset of the next instruction to execute
+	current     int // offset of the instruction being executed
+	basePointer int
+}
+
+func NewFrame(cl object.Closure, basePointer int) *Frame {
+	return &Frame{cl: cl, basePointer: basePointer}
+}
+
+// Pos returns the source position of the instruction being executed.
+func (f *Frame) Pos() token.Position {
+	return f.cl.Fn.SourceMap[f.current]
+}
+
+// Name returns the name of the function being executed.
+func (f *Frame) Name() string {
+	if f.cl.Fn.Name == "" {
+		return "<anonymous>"
+	}
+	return f.cl.Fn.Name
+}
@@ -0,0 +1,262 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/token"
+)
+
+// VerifyError reports an instruction which was rejected by Verify.
+type VerifyError struct {
+	Function string // name of the function, MainFunctionName for the main instructions
+	Constant int    // constant index of the function, -1 for the main instructions
+	Offset   int
+	Pos      token.Position
+	Err      error
+}
+
+func (e *VerifyError) Error() string {
+	where := e.Function
+	if e.Constant >= 0 {
+		where = fmt.Sprintf("constant %d (%s)", e.Constant, e.Function)
+	}
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("%s at %04d (%s): %v", where, e.Offset, e.Pos, e.Err)
+	}
+	return fmt.Sprintf("%s at %04d: %v", where, e.Offset, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error { return e.Err }
+
+// Verify checks that bytecode can be run without corrupting the VM. It rejects unknown opcodes,
+// truncated operands, out-of-range constant, local, free and builtin indices, jumps into the middle
+// of an instruction, functions falling off their end and inconsistent stack depth.
+//
+// The stack depth of every reachable instruction must be the same along all paths reaching it,
+// and no instruction may pop more values than the current function has pushed.
+func Verify(bytecode compiler.Bytecode) error {
+	return verify(bytecode, 0)
+}
+
+// verify is like Verify, but only verifies the constants from the index verified on, the ones
+// before having been verified already.
+func verify(bytecode compiler.Bytecode, verified int) error {
+	v := &verifier{constants: bytecode.Constants, numFree: make(map[int]int)}
+
+	functions := []verifiedFunction{{
+		constant: -1,
+		fn:       object.CompiledFunction{Name: MainFunctionName, Instructions: bytecode.Instructions, SourceMap: bytecode.SourceMap},
+	}}
+	for i, c := range bytecode.Constants[verified:] {
+		if fn, ok := c.(object.CompiledFunction); ok {
+			functions = append(functions, verifiedFunction{constant: verified + i, fn: fn})
+		}
+	}
+	for i := range functions {
+		if err := functions[i].decode(); err != nil {
+			return err
+		}
+		v.numFree[functions[i].constant] = functions[i].numFree()
+	}
+	for _, f := range functions {
+		if err := v.verify(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type decodedInstruction struct {
+	offset   int
+	op       code.Opcode
+	def      code.Definition
+	operands []int64
+	next     int
+}
+
+type verifiedFunction struct {
+	constant     int
+	fn           object.CompiledFunction
+	instructions map[int]decodedInstruction
+	order        []int
+}
+
+func (f verifiedFunction) main() bool { return f.constant < 0 }
+
+func (f verifiedFunction) errorf(offset int, format string, args ...any) error {
+	return &VerifyError{
+		Function: f.fn.Name,
+		Constant: f.constant,
+		Offset:   offset,
+		Pos:      f.fn.SourceMap[offset],
+		Err:      fmt.Errorf(format, args...),
+	}
+}
+
+func (f *verifiedFunction) decode() error {
+	f.instructions = make(map[int]decodedInstruction)
+	r := bytes.NewReader(f.fn.Instructions)
+	for {
+		offset := len(f.fn.Instructions) - r.Len()
+		op, err := code.ReadOpcode(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return f.errorf(offset, "code.ReadOpcode: %w", err)
+		}
+		def, err := code.Lookup(op)
+		if err != nil {
+			return f.errorf(offset, "unknown opcode %d", op)
+		}
+		operands, n, err := code.ReadOperands(def, r)
+		if err != nil {
+			return f.errorf(offset, "truncated operands of %s", def.Name)
+		}
+		f.instructions[offset] = decodedInstruction{offset: offset, op: op, def: def, operands: operands, next: offset + 1 + n}
+		f.order = append(f.order, offset)
+	}
+}
+
+// numFree returns the number of free variables the function refers to.
+func (f verifiedFunction) numFree() int {
+	n := 0
+	for _, in := range f.instructions {
+		if in.op == code.OpGetFree && n <= int(in.operands[0]) {
+			n = int(in.operands[0]) + 1
+		}
+	}
+	return n
+}
+
+type verifier struct {
+	constants []object.Object
+	numFree   map[int]int // constant index of a function to the number of its free variables
+}
+
+// numFreeOf returns the number of free variables of the function at the constant index idx, which
+// is decoded here if it was verified before.
+func (v *verifier) numFreeOf(idx int) (int, error) {
+	if n, ok := v.numFree[idx]; ok {
+		return n, nil
+	}
+	f := verifiedFunction{constant: idx, fn: v.constants[idx].(object.CompiledFunction)}
+	if err := f.decode(); err != nil {
+		return 0, err
+	}
+	v.numFree[idx] = f.numFree()
+	return v.numFree[idx], nil
+}
+
+func (v *verifier) verify(f verifiedFunction) error {
+	if !f.main() && f.fn.NumLocals < f.fn.NumParameters {
+		return f.errorf(0, "%d locals cannot hold %d parameters", f.fn.NumLocals, f.fn.NumParameters)
+	}
+	for _, offset := range f.order {
+		if err := v.verifyOperands(f, f.instructions[offset]); err != nil {
+			return err
+		}
+	}
+	return v.verifyStack(f)
+}
+
+func (v *verifier) verifyOperands(f verifiedFunction, in decodedInstruction) error {
+	switch in.op {
+	case code.OpConstant, code.OpConstantWide:
+		if idx := int(in.operands[0]); idx >= len(v.constants) {
+			return f.errorf(in.offset, "constant index %d out of range [0, %d)", idx, len(v.constants))
+		}
+	case code.OpClosure, code.OpClosureWide:
+		idx, numFree := int(in.operands[0]), int(in.operands[1])
+		if idx >= len(v.constants) {
+			return f.errorf(in.offset, "constant index %d out of range [0, %d)", idx, len(v.constants))
+		}
+		if _, ok := v.constants[idx].(object.CompiledFunction); !ok {
+			return f.errorf(in.offset, "constant %d is %s, not CompiledFunction", idx, v.constants[idx].Type())
+		}
+		want, err := v.numFreeOf(idx)
+		if err != nil {
+			return err
+		}
+		if numFree < want {
+			return f.errorf(in.offset, "closure of constant %d needs %d free variables, got %d", idx, want, numFree)
+		}
+	case code.OpHash:
+		if n := int(in.operands[0]); n%2 != 0 {
+			return f.errorf(in.offset, "OpHash of %d values, which are not key-value pairs", n)
+		}
+	case code.OpGetLocal, code.OpSetLocal:
+		if idx := int(in.operands[0]); idx >= f.fn.NumLocals {
+			return f.errorf(in.offset, "local index %d out of range [0, %d)", idx, f.fn.NumLocals)
+		}
+	case code.OpGetFree:
+		if f.main() {
+			return f.errorf(in.offset, "free variable in the main instructions")
+		}
+	case code.OpGetBuiltin:
+		if idx := int(in.operands[0]); idx >= len(object.Builtins) {
+			return f.errorf(in.offset, "builtin index %d out of range [0, %d)", idx, len(object.Builtins))
+		}
+	case code.OpReturn:
+		if f.main() {
+			return f.errorf(in.offset, "OpReturn in the main instructions")
+		}
+	}
+	if code.IsJump(in.op) {
+		target := int(in.operands[0])
+		if _, ok := f.instructions[target]; !ok && !(f.main() && target == len(f.fn.Instructions)) {
+			return f.errorf(in.offset, "jump to %d which is not the start of an instruction", target)
+		}
+	}
+	return nil
+}
+
+// verifyStack follows every path from the entry, computing the stack depth before each instruction.
+func (v *verifier) verifyStack(f verifiedFunction) error {
+	depths := make(map[int]int, len(f.instructions))
+	type state struct{ offset, depth int }
+	work := []state{{0, 0}}
+	for len(work) > 0 {
+		s := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		if s.offset == len(f.fn.Instructions) {
+			if !f.main() {
+				return f.errorf(s.offset, "falls off the end of the function")
+			}
+			continue
+		}
+		if d, ok := depths[s.offset]; ok {
+			if d != s.depth {
+				return f.errorf(s.offset, "inconsistent stack depth: %d and %d", d, s.depth)
+			}
+			continue
+		}
+		depths[s.offset] = s.depth
+
+		in := f.instructions[s.offset]
+		pop, push := in.def.StackEffect(in.operands)
+		if s.depth < pop {
+			return f.errorf(in.offset, "%s pops %d values from a stack of depth %d", in.def.Name, pop, s.depth)
+		}
+		depth := s.depth - pop + push
+
+		switch in.op {
+		case code.OpReturnValue, code.OpReturn:
+			// the frame ends here
+		case code.OpJump, code.OpJumpWide:
+			work = append(work, state{int(in.operands[0]), depth})
+		case code.OpJumpNotTruthy, code.OpJumpNotTruthyWide:
+			work = append(work, state{in.next, depth}, state{int(in.operands[0]), depth})
+		default:
+			work = append(work, state{in.next, depth})
+		}
+	}
+	return nil
+}
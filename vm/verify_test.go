@@ -0,0 +1,255 @@
+package vm_test
+
+import (
+	"testing"
+
+	"github.com/Warashi/monkey/code"
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/internal/vmhook"
+	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/parser"
+	. "github.com/Warashi/monkey/testutil"
+	"github.com/Warashi/monkey/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCompiledPrograms(t *testing.T) {
+	t.Parallel()
+	tests := []string{
+		"",
+		"1; 2; 3",
+		"if (true) { 1 } else { 2 }; if (false) { 3 }",
+		`let a = [1, 2, 3]; let h = {"a": a, "b": len(a)}; h["a"][0]`,
+		"let newAdder = fn(a, b) { fn(c) { a + b + c }; }; newAdder(1, 2)(3)",
+		"let fib = fn(n) { if (n < 2) { return n; } fib(n - 1) + fib(n - 2) }; fib(5)",
+		"let f = fn() { return 1; 2 }; f()",
+		"let f = fn() { }; f()",
+		"return 1; 2",
+	}
+	for _, input := range tests {
+		input := input
+		t.Run(input, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(input)).Parse()))
+			assert.NoError(t, vm.Verify(compiler.Bytecode()))
+		})
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		bytecode compiler.Bytecode
+		want     string
+	}{
+		{
+			name:     "unknown-opcode",
+			bytecode: compiler.Bytecode{Instructions: code.Instructions{byte(code.OpTrue), 0xff}},
+			want:     "<main> at 0001: unknown opcode 255",
+		},
+		{
+			name:     "truncated-operands",
+			bytecode: compiler.Bytecode{Instructions: code.Instructions{byte(code.OpConstant), 0}},
+			want:     "<main> at 0000: truncated operands of OpConstant",
+		},
+		{
+			name:     "constant-index",
+			bytecode: Assemble(t, ".constant 0 Integer 1\n.main\n\tOpConstant 1\n\tOpPop\n.end"),
+			want:     "<main> at 0000: constant index 1 out of range [0, 1)",
+		},
+		{
+			name:     "closure-of-integer",
+			bytecode: Assemble(t, ".constant 0 Integer 1\n.main\n\tOpClosure 0 0\n\tOpPop\n.end"),
+			want:     "<main> at 0000: constant 0 is Integer, not CompiledFunction",
+		},
+		{
+			name: "closure-free-count",
+			bytecode: Assemble(t, `
+.main
+	OpConstant 1
+	OpClosure 0 0
+	OpPop
+.end
+.function 0 "" parameters=0 locals=0
+	OpGetFree 0
+	OpReturnValue
+.end
+.constant 1 Integer 1`),
+			want: "<main> at 0003: closure of constant 0 needs 1 free variables, got 0",
+		},
+		{
+			name:     "jump-into-instruction",
+			bytecode: Assemble(t, ".constant 0 Integer 1\n.main\n\tOpJump 4\n\tOpConstant 0\n\tOpPop\n.end"),
+			want:     "<main> at 0000: jump to 4 which is not the start of an instruction",
+		},
+		{
+			name:     "jump-out-of-range",
+			bytecode: Assemble(t, ".main\n\tOpJump 100\n.end"),
+			want:     "<main> at 0000: jump to 100 which is not the start of an instruction",
+		},
+		{
+			name:     "local-in-main",
+			bytecode: Assemble(t, ".main\n\tOpGetLocal 0\n\tOpPop\n.end"),
+			want:     "<main> at 0000: local index 0 out of range [0, 0)",
+		},
+		{
+			name:     "free-in-main",
+			bytecode: Assemble(t, ".main\n\tOpGetFree 0\n\tOpPop\n.end"),
+			want:     "<main> at 0000: free variable in the main instructions",
+		},
+		{
+			name:     "builtin-index",
+			bytecode: Assemble(t, ".main\n\tOpGetBuiltin 200\n\tOpPop\n.end"),
+			want:     "<main> at 0000: builtin index 200 out of range [0, 6)",
+		},
+		{
+			name:     "return-in-main",
+			bytecode: Assemble(t, ".main\n\tOpReturn\n.end"),
+			want:     "<main> at 0000: OpReturn in the main instructions",
+		},
+		{
+			name:     "stack-underflow",
+			bytecode: Assemble(t, ".main\n\tOpTrue\n\tOpAdd\n.end"),
+			want:     "<main> at 0001: OpAdd pops 2 values from a stack of depth 1",
+		},
+		{
+			name:     "array-underflow",
+			bytecode: Assemble(t, ".main\n\tOpTrue\n\tOpArray 2\n\tOpPop\n.end"),
+			want:     "<main> at 0001: OpArray pops 2 values from a stack of depth 1",
+		},
+		{
+			name:     "hash-odd-count",
+			bytecode: Assemble(t, ".main\n\tOpTrue\n\tOpHash 1\n\tOpTrue\n\tOpIndex\n\tOpMinus\n\tOpPop\n.end"),
+			want:     "<main> at 0001: OpHash of 1 values, which are not key-value pairs",
+		},
+		{
+			name: "inconsistent-depth",
+			bytecode: Assemble(t, `
+.main
+	OpTrue
+	OpJumpNotTruthy end
+	OpTrue
+end:
+	OpNull
+	OpPop
+.end`),
+			want: "<main> at 0005: inconsistent stack depth: 0 and 1",
+		},
+		{
+			name:     "falls-off-function",
+			bytecode: Assemble(t, ".main\n\tOpClosure 0 0\n\tOpPop\n.end\n.function 0 \"f\" parameters=0 locals=0\n\tOpTrue\n.end"),
+			want:     "constant 0 (f) at 0001: falls off the end of the function",
+		},
+		{
+			name:     "parameters-exceed-locals",
+			bytecode: Assemble(t, ".function 0 \"f\" parameters=2 locals=1\n\tOpReturn\n.end"),
+			want:     "constant 0 (f) at 0000: 1 locals cannot hold 2 parameters",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := vm.Verify(tt.bytecode)
+			var verifyErr *vm.VerifyError
+			require.ErrorAs(t, err, &verifyErr)
+			assert.EqualError(t, err, tt.want)
+
+			assert.ErrorAs(t, vm.New(tt.bytecode).Run(), &verifyErr, "Run must verify before executing")
+		})
+	}
+}
+
+// TestRunVerifiedErrors runs bytecode which is valid but fails when run, with a runtime error
+// instead of a panic of the vm.
+func TestRunVerifiedErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		bytecode compiler.Bytecode
+		want     string
+	}{
+		{
+			name:     "unset-global",
+			bytecode: Assemble(t, ".main\n\tOpGetGlobal 0\n\tOpMinus\n\tOpPop\n.end"),
+			want:     "identifier not found: global 0",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.NoError(t, vm.Verify(tt.bytecode))
+			err := vm.New(tt.bytecode).Run()
+			var runtimeErr *vm.RuntimeError
+			require.ErrorAs(t, err, &runtimeErr)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestVerifiedConstants(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		bytecode compiler.Bytecode
+		verified int
+		want     string
+	}{
+		{
+			name:     "skips-verified",
+			bytecode: Assemble(t, ".main\n\tOpTrue\n\tOpPop\n.end\n.function 0 \"f\" parameters=0 locals=0\n\tOpTrue\n.end"),
+			verified: 1,
+		},
+		{
+			name:     "verifies-new",
+			bytecode: Assemble(t, ".main\n\tOpTrue\n\tOpPop\n.end\n.constant 0 Integer 1\n.function 1 \"f\" parameters=0 locals=0\n\tOpTrue\n.end"),
+			verified: 1,
+			want:     "constant 1 (f) at 0001: falls off the end of the function",
+		},
+		{
+			name: "free-variables-of-verified",
+			bytecode: Assemble(t, `
+.main
+	OpClosure 0 0
+	OpPop
+.end
+.function 0 "" parameters=0 locals=0
+	OpGetFree 0
+	OpReturnValue
+.end`),
+			verified: 1,
+			want:     "<main> at 0000: closure of constant 0 needs 1 free variables, got 0",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			machine := vm.New(tt.bytecode)
+			vmhook.SetVerifiedConstants(machine, tt.verified)
+			err := machine.Run()
+			if tt.want == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var verifyErr *vm.VerifyError
+			require.ErrorAs(t, err, &verifyErr)
+			assert.EqualError(t, verifyErr, tt.want)
+		})
+	}
+}
+
+func TestVerifyErrorPosition(t *testing.T) {
+	t.Parallel()
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(parser.New(lexer.NewFile("test.monkey", "1;\n2")).Parse()))
+	bytecode := compiler.Bytecode()
+	bytecode.Constants = []object.Object{IntegerObject(1)}
+
+	assert.EqualError(t, vm.Verify(bytecode), "<main> at 0004 (test.monkey:2:1): constant index 1 out of range [0, 1)")
+}
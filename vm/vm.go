@@ -1,17 +1,34 @@
 package vm
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 
 	"github.com/Warashi/monkey/code"
 	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/internal/vmhook"
 	"github.com/Warashi/monkey/object"
+	"github.com/Warashi/monkey/token"
 )
 
-const StackSize = 1 << 11
+const (
+	// StackSize is the initial size of the stack, which grows for deeper calls and larger literals.
+	StackSize   = 1 << 11
+	GlobalsSize = 1 << 16
+	// MaxFrames is the number of function calls which may be active at once if Limits.MaxCallDepth
+	// is zero, the same as evaluator.DefaultMaxCallDepth.
+	MaxFrames = 1 << 10
+)
+
+// MainFunctionName is the name of the top-level frame in stack traces.
+const MainFunctionName = "<main>"
+
+// cancelCheckInterval is the number of instructions executed between checks for the cancellation of
+// the context, which are too slow to do for every instruction.
+const cancelCheckInterval = 1 << 10
 
 var (
 	True  = object.Boolean{Value: true}
@@ -20,102 +37,387 @@ var (
 )
 
 type VM struct {
-	constants    []object.Object
-	instructions code.Instructions
+	constants []object.Object
 
 	stack []object.Object
 	sp    int // Always points to the next value. Top of stack is stack[sp-1]
+
+	globals     []object.Object
+	globalNames []string
+
+	frames      []*Frame
+	framesIndex int
+
+	checkedArithmetic bool
+	output            io.Writer
+	verifiedConstants int // constants verified by a previous run, set through vmhook
+
+	limits   object.Limits
+	steps    int64
+	elements int64
 }
 
-func New(code compiler.Bytecode) *VM {
+func init() {
+	vmhook.SetVerifiedConstants = func(machine any, n int) { machine.(*VM).verifiedConstants = n }
+}
+
+func New(bytecode compiler.Bytecode) *VM {
+	mainFn := object.CompiledFunction{Name: MainFunctionName, Instructions: bytecode.Instructions, SourceMap: bytecode.SourceMap}
+	frames := make([]*Frame, MaxFrames+1)
+	frames[0] = NewFrame(object.Closure{Fn: mainFn}, 0)
+
 	return &VM{
-		constants:    code.Constants,
-		instructions: code.Instructions,
+		constants: bytecode.Constants,
 
 		stack: make([]object.Object, StackSize),
 		sp:    0,
+
+		globals:     make([]object.Object, GlobalsSize),
+		globalNames: bytecode.Globals,
+
+		frames:      frames,
+		framesIndex: 1,
+
+		output: os.Stdout,
 	}
 }
 
+// NewWithGlobalsStore returns a VM which reads and writes global bindings in the given store,
+// so that successive runs can share their globals.
+func NewWithGlobalsStore(bytecode compiler.Bytecode, globals []object.Object) *VM {
+	vm := New(bytecode)
+	vm.globals = globals
+	return vm
+}
+
+// EnableCheckedArithmetic makes integer operations whose result does not fit in an Integer fail
+// with object.ErrIntegerOverflow instead of wrapping around.
+func (vm *VM) EnableCheckedArithmetic() {
+	vm.checkedArithmetic = true
+}
+
+// SetOutput makes builtins such as `puts` print to w instead of os.Stdout.
+func (vm *VM) SetOutput(w io.Writer) {
+	vm.output = w
+}
+
+// SetLimits bounds the resources used by Run and RunContext. Exceeding a limit fails the run with
+// object.ErrStepLimit, object.ErrCallDepthLimit or object.ErrAllocationLimit.
+// If limits.MaxCallDepth is zero, the call depth is bounded by MaxFrames.
+func (vm *VM) SetLimits(limits object.Limits) {
+	vm.limits = limits
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+func (vm *VM) pushFrame(f *Frame) error {
+	limit := MaxFrames
+	if vm.limits.MaxCallDepth > 0 {
+		limit = vm.limits.MaxCallDepth
+	}
+	// the main frame is not a call
+	if vm.framesIndex > limit {
+		return newErrorf("%w: %d calls", object.ErrCallDepthLimit, limit)
+	}
+	if vm.framesIndex == len(vm.frames) {
+		vm.frames = append(vm.frames, f)
+	} else {
+		vm.frames[vm.framesIndex] = f
+	}
+	vm.framesIndex++
+	return nil
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
+}
+
+// Run verifies and executes the bytecode. Bytecode rejected by Verify is reported as *VerifyError,
+// and errors while running are reported as *RuntimeError at the position of the instruction which caused them.
 func (vm *VM) Run() error {
-	r := bytes.NewReader(vm.instructions)
+	return vm.RunContext(context.Background())
+}
+
+// RunContext is like Run, but stops with the error of ctx once ctx is done.
+func (vm *VM) RunContext(ctx context.Context) error {
+	main := vm.frames[0].cl.Fn
+	if err := verify(compiler.Bytecode{Instructions: main.Instructions, Constants: vm.constants, SourceMap: main.SourceMap}, vm.verifiedConstants); err != nil {
+		return fmt.Errorf("Verify: %w", err)
+	}
+	if err := vm.run(ctx); err != nil {
+		// the message is the one of the program's failure, without the Go functions it was returned through
+		var e object.Error
+		if errors.As(err, &e) {
+			err = e
+		}
+		return &RuntimeError{
+			Err:        &token.Error{Pos: vm.currentFrame().Pos(), Err: err},
+			StackTrace: vm.stackTrace(),
+		}
+	}
+	return nil
+}
+
+// stackTrace returns the active frames, innermost first.
+func (vm *VM) stackTrace() []StackFrame {
+	trace := make([]StackFrame, 0, vm.framesIndex)
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		f := vm.frames[i]
+		trace = append(trace, StackFrame{Function: f.Name(), Pos: f.Pos()})
+	}
+	return trace
+}
+
+// run executes instructions until the main instructions end. Operands are decoded in place,
+// which relies on Verify having checked that every instruction is complete.
+func (vm *VM) run(ctx context.Context) error {
 	for {
-		op, err := code.ReadOpcode(r)
-		if errors.Is(err, io.EOF) {
+		frame := vm.currentFrame()
+		ins := frame.cl.Fn.Instructions
+		ip := frame.ip
+		if ip >= len(ins) {
 			return nil
 		}
-		if err != nil {
-			return fmt.Errorf("code.ReadOpcode: %w", err)
+		frame.current = ip
+
+		vm.steps++
+		if vm.limits.MaxSteps > 0 && vm.steps > vm.limits.MaxSteps {
+			return newErrorf("%w: %d instructions", object.ErrStepLimit, vm.limits.MaxSteps)
+		}
+		if vm.steps%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return newErrorf("%w", err)
+			}
 		}
+		op := code.Opcode(ins[ip])
 
 		switch op {
 		case code.OpConstant:
-			idx, err := code.ReadUint16(r)
-			if err != nil {
-				return fmt.Errorf("code.ReadUint16: %w", err)
+			idx := ins.Uint16(ip + 1)
+			frame.ip = ip + 3
+			if err := vm.push(vm.constants[idx]); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
 			}
+		case code.OpConstantWide:
+			idx := ins.Uint32(ip + 1)
+			frame.ip = ip + 5
 			if err := vm.push(vm.constants[idx]); err != nil {
 				return fmt.Errorf("vm.push: %w", err)
 			}
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod:
+			frame.ip = ip + 1
 			if err := vm.executeBinaryOperation(op); err != nil {
 				return fmt.Errorf("vm.executeBinaryOperation: %w", err)
 			}
 		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+			frame.ip = ip + 1
 			if err := vm.executeComparison(op); err != nil {
 				return fmt.Errorf("vm.executeComparison: %w", err)
 			}
 		case code.OpBang:
+			frame.ip = ip + 1
 			if err := vm.executeBangOperator(); err != nil {
 				return fmt.Errorf("vm.executeBangOperator: %w", err)
 			}
 		case code.OpMinus:
+			frame.ip = ip + 1
 			if err := vm.executeMinusOperator(); err != nil {
 				return fmt.Errorf("vm.executeMinusOperator: %w", err)
 			}
 		case code.OpTrue:
+			frame.ip = ip + 1
 			if err := vm.push(True); err != nil {
 				return fmt.Errorf("vm.push: %w", err)
 			}
 		case code.OpFalse:
+			frame.ip = ip + 1
 			if err := vm.push(False); err != nil {
 				return fmt.Errorf("vm.push: %w", err)
 			}
 		case code.OpPop:
+			frame.ip = ip + 1
 			if _, err := vm.pop(); err != nil {
 				return fmt.Errorf("vm.pop: %w", err)
 			}
 		case code.OpJump:
-			pos, err := code.ReadUint16(r)
+			frame.ip = int(ins.Uint16(ip + 1))
+		case code.OpJumpNotTruthy:
+			frame.ip = ip + 3
+			condition, err := vm.pop()
 			if err != nil {
-				return fmt.Errorf("code.ReadUint16: %w", err)
+				return fmt.Errorf("vm.pop: %w", err)
 			}
-			r.Seek(pos, 0)
-		case code.OpJumpNotTruthy:
-			pos, err := code.ReadUint16(r)
-
+			if !isTruthy(condition) {
+				frame.ip = int(ins.Uint16(ip + 1))
+			}
+		case code.OpJumpWide:
+			frame.ip = int(ins.Uint32(ip + 1))
+		case code.OpJumpNotTruthyWide:
+			frame.ip = ip + 5
 			condition, err := vm.pop()
 			if err != nil {
 				return fmt.Errorf("vm.pop: %w", err)
 			}
-
 			if !isTruthy(condition) {
-				r.Seek(pos, 0)
+				frame.ip = int(ins.Uint32(ip + 1))
 			}
 		case code.OpNull:
+			frame.ip = ip + 1
+			if err := vm.push(Null); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
+			}
+		case code.OpSetGlobal:
+			idx := ins.Uint16(ip + 1)
+			frame.ip = ip + 3
+			obj, err := vm.pop()
+			if err != nil {
+				return fmt.Errorf("vm.pop: %w", err)
+			}
+			vm.globals[idx] = obj
+		case code.OpGetGlobal:
+			idx := ins.Uint16(ip + 1)
+			frame.ip = ip + 3
+			obj := vm.globals[idx]
+			if obj == nil {
+				// the let statement of the global has not run, such as one in an if expression
+				return newErrorf("identifier not found: %s", vm.globalName(int(idx)))
+			}
+			if err := vm.push(obj); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
+			}
+		case code.OpArray:
+			n := int(ins.Uint16(ip + 1))
+			frame.ip = ip + 3
+			if err := vm.allocate(n); err != nil {
+				return fmt.Errorf("vm.allocate: %w", err)
+			}
+			array := vm.buildArray(vm.sp-n, vm.sp)
+			vm.sp -= n
+			if err := vm.push(array); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
+			}
+		case code.OpHash:
+			n := int(ins.Uint16(ip + 1))
+			frame.ip = ip + 3
+			if err := vm.allocate(n / 2); err != nil {
+				return fmt.Errorf("vm.allocate: %w", err)
+			}
+			hash, err := vm.buildHash(vm.sp-n, vm.sp)
+			if err != nil {
+				return fmt.Errorf("vm.buildHash: %w", err)
+			}
+			vm.sp -= n
+			if err := vm.push(hash); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
+			}
+		case code.OpIndex:
+			frame.ip = ip + 1
+			if err := vm.executeIndexExpression(); err != nil {
+				return fmt.Errorf("vm.executeIndexExpression: %w", err)
+			}
+		case code.OpCall:
+			numArgs := int(ins.Uint8(ip + 1))
+			frame.ip = ip + 2
+			if err := vm.executeCall(numArgs); err != nil {
+				return fmt.Errorf("vm.executeCall: %w", err)
+			}
+		case code.OpTailCall:
+			numArgs := int(ins.Uint8(ip + 1))
+			frame.ip = ip + 2
+			if err := vm.executeTailCall(numArgs); err != nil {
+				return fmt.Errorf("vm.executeTailCall: %w", err)
+			}
+		case code.OpReturnValue:
+			frame.ip = ip + 1
+			returnValue, err := vm.pop()
+			if err != nil {
+				return fmt.Errorf("vm.pop: %w", err)
+			}
+			if vm.framesIndex == 1 {
+				// top-level return halts the program, leaving the value as the last popped element
+				return nil
+			}
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+			if err := vm.push(returnValue); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
+			}
+		case code.OpReturn:
+			frame.ip = ip + 1
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
 			if err := vm.push(Null); err != nil {
 				return fmt.Errorf("vm.push: %w", err)
 			}
+		case code.OpSetLocal:
+			idx := int(ins.Uint8(ip + 1))
+			frame.ip = ip + 2
+			obj, err := vm.pop()
+			if err != nil {
+				return fmt.Errorf("vm.pop: %w", err)
+			}
+			vm.stack[frame.basePointer+idx] = obj
+		case code.OpGetLocal:
+			idx := int(ins.Uint8(ip + 1))
+			frame.ip = ip + 2
+			if err := vm.push(vm.stack[frame.basePointer+idx]); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
+			}
+		case code.OpClosure:
+			constIndex, numFree := int(ins.Uint16(ip+1)), int(ins.Uint8(ip+3))
+			frame.ip = ip + 4
+			if err := vm.pushClosure(constIndex, numFree); err != nil {
+				return fmt.Errorf("vm.pushClosure: %w", err)
+			}
+		case code.OpClosureWide:
+			constIndex, numFree := int(ins.Uint32(ip+1)), int(ins.Uint8(ip+5))
+			frame.ip = ip + 6
+			if err := vm.pushClosure(constIndex, numFree); err != nil {
+				return fmt.Errorf("vm.pushClosure: %w", err)
+			}
+		case code.OpGetFree:
+			idx := ins.Uint8(ip + 1)
+			frame.ip = ip + 2
+			if err := vm.push(frame.cl.Free[idx]); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
+			}
+		case code.OpGetBuiltin:
+			idx := ins.Uint8(ip + 1)
+			frame.ip = ip + 2
+			if err := vm.push(object.Builtins[idx].Builtin); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
+			}
+		case code.OpCurrentClosure:
+			frame.ip = ip + 1
+			if err := vm.push(frame.cl); err != nil {
+				return fmt.Errorf("vm.push: %w", err)
+			}
 		default:
 			return fmt.Errorf("unknown opcode: %s", op.String())
 		}
 	}
 }
 
-func (vm *VM) push(obj object.Object) error {
-	if vm.sp >= StackSize {
-		return errors.New("stack overflow")
+// globalName returns the name of the global binding at idx, which is unknown to assembled bytecode.
+func (vm *VM) globalName(idx int) string {
+	if idx < len(vm.globalNames) {
+		return vm.globalNames[idx]
 	}
+	return fmt.Sprintf("global %d", idx)
+}
+
+// growStack makes the stack hold at least n values.
+func (vm *VM) growStack(n int) {
+	for len(vm.stack) < n {
+		vm.stack = append(vm.stack, make([]object.Object, len(vm.stack))...)
+	}
+}
+
+func (vm *VM) push(obj object.Object) error {
+	vm.growStack(vm.sp + 1)
 	vm.stack[vm.sp] = obj
 	vm.sp++
 	return nil
@@ -156,25 +458,47 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		if err := vm.executeBinaryIntegerOperation(op, left, right); err != nil {
 			return fmt.Errorf("vm.executeBinaryIntegerOperation: %w", err)
 		}
+	case left.Type() == object.TypeString && right.Type() == object.TypeString:
+		left, right := left.(object.String), right.(object.String)
+		if err := vm.executeBinaryStringOperation(op, left, right); err != nil {
+			return fmt.Errorf("vm.executeBinaryStringOperation: %w", err)
+		}
 	default:
-		return fmt.Errorf("unsupported types: op=%s, left: %s, right: %s", op.String(), left.Type().String(), right.Type().String())
+		return operatorError(op, left, right)
 	}
 	return nil
 }
 
+// operators are the operators of the infix opcodes as they are written in programs. The operands of
+// `<` are swapped by the compiler, which makes it OpGreaterThan.
+var operators = map[code.Opcode]string{
+	code.OpAdd:         "+",
+	code.OpSub:         "-",
+	code.OpMul:         "*",
+	code.OpDiv:         "/",
+	code.OpMod:         "%",
+	code.OpEqual:       "==",
+	code.OpNotEqual:    "!=",
+	code.OpGreaterThan: ">",
+}
+
+// operatorError returns the error of applying op to operands it does not support, with the message
+// of the evaluator.
+func operatorError(op code.Opcode, left, right object.Object) error {
+	if left.Type() != right.Type() {
+		return newErrorf("type mismatch: %s %s %s", left.Type(), operators[op], right.Type())
+	}
+	return newErrorf("unknown operator: %s %s %s", left.Type(), operators[op], right.Type())
+}
+
 func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.Integer) error {
-	var result int64
-	switch op {
-	case code.OpAdd:
-		result = left.Value + right.Value
-	case code.OpSub:
-		result = left.Value - right.Value
-	case code.OpMul:
-		result = left.Value * right.Value
-	case code.OpDiv:
-		result = left.Value / right.Value
-	default:
-		return fmt.Errorf("uknown operator: %s", op.String())
+	operator, ok := operators[op]
+	if !ok {
+		return operatorError(op, left, right)
+	}
+	result, err := object.IntegerOperation(operator, left.Value, right.Value, vm.checkedArithmetic)
+	if err != nil {
+		return newErrorf("%w", err)
 	}
 
 	if err := vm.push(object.Integer{Value: result}); err != nil {
@@ -183,6 +507,16 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.I
 	return nil
 }
 
+func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.String) error {
+	if op != code.OpAdd {
+		return operatorError(op, left, right)
+	}
+	if err := vm.push(object.String{Value: left.Value + right.Value}); err != nil {
+		return fmt.Errorf("vm.push: %w", err)
+	}
+	return nil
+}
+
 func (vm *VM) executeComparison(op code.Opcode) error {
 	right, err := vm.pop()
 	if err != nil {
@@ -203,12 +537,38 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 		if err := vm.executeBooleanComparison(op, left, right); err != nil {
 			return fmt.Errorf("vm.executeBooleanComparison: %w", err)
 		}
+	case left.Type() == object.TypeString && right.Type() == object.TypeString:
+		left, right := left.(object.String), right.(object.String)
+		if err := vm.executeStringComparison(op, left, right); err != nil {
+			return fmt.Errorf("vm.executeStringComparison: %w", err)
+		}
+	case (op == code.OpEqual || op == code.OpNotEqual) && isComparable(left, right):
+		// nulls, and values of different types which are never equal
+		if err := vm.push(booleanObject((left == right) == (op == code.OpEqual))); err != nil {
+			return fmt.Errorf("vm.push: %w", err)
+		}
 	default:
-		return fmt.Errorf("unsupported types: op=%s, left: %s, right: %s", op.String(), left.Type().String(), right.Type().String())
+		return operatorError(op, left, right)
 	}
 	return nil
 }
 
+// isComparable reports whether left and right can be compared with OpEqual and OpNotEqual, as the
+// evaluator does. Values of different types are never equal, but two arrays, hashes or functions
+// cannot be compared.
+func isComparable(left, right object.Object) bool {
+	return left.Type() != right.Type() || isScalar(left)
+}
+
+func isScalar(o object.Object) bool {
+	switch o.(type) {
+	case object.Hashable, object.Null:
+		return true
+	default:
+		return false
+	}
+}
+
 func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Integer) error {
 	var result bool
 	switch op {
@@ -219,7 +579,7 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Intege
 	case code.OpGreaterThan:
 		result = left.Value > right.Value
 	default:
-		return fmt.Errorf("uknown operator: %s", op.String())
+		return operatorError(op, left, right)
 	}
 	if err := vm.push(booleanObject(result)); err != nil {
 		return fmt.Errorf("vm.push: %w", err)
@@ -235,7 +595,25 @@ func (vm *VM) executeBooleanComparison(op code.Opcode, left, right object.Boolea
 	case code.OpNotEqual:
 		result = left.Value != right.Value
 	default:
-		return fmt.Errorf("uknown operator: %s", op.String())
+		return operatorError(op, left, right)
+	}
+	if err := vm.push(booleanObject(result)); err != nil {
+		return fmt.Errorf("vm.push: %w", err)
+	}
+	return nil
+}
+
+func (vm *VM) executeStringComparison(op code.Opcode, left, right object.String) error {
+	var result bool
+	switch op {
+	case code.OpEqual:
+		result = left.Value == right.Value
+	case code.OpNotEqual:
+		result = left.Value != right.Value
+	case code.OpGreaterThan:
+		result = left.Value > right.Value
+	default:
+		return operatorError(op, left, right)
 	}
 	if err := vm.push(booleanObject(result)); err != nil {
 		return fmt.Errorf("vm.push: %w", err)
@@ -266,15 +644,166 @@ func (vm *VM) executeMinusOperator() error {
 		return fmt.Errorf("vm.pop: %w", err)
 	}
 	if operand.Type() != object.TypeInteger {
-		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+		return newErrorf("unknown operator: -%s", operand.Type())
+	}
+	val, err := object.IntegerNegation(operand.(object.Integer).Value, vm.checkedArithmetic)
+	if err != nil {
+		return newErrorf("%w", err)
 	}
-	val := operand.(object.Integer).Value
-	if err := vm.push(object.Integer{Value: -val}); err != nil {
+	if err := vm.push(object.Integer{Value: val}); err != nil {
 		return fmt.Errorf("vm.push: %w", err)
 	}
 	return nil
 }
 
+func (vm *VM) executeCall(numArgs int) error {
+	switch callee := vm.stack[vm.sp-1-numArgs].(type) {
+	case object.Closure:
+		if err := vm.callClosure(callee, numArgs); err != nil {
+			return fmt.Errorf("vm.callClosure: %w", err)
+		}
+	case object.Builtin:
+		if err := vm.callBuiltin(callee, numArgs); err != nil {
+			return fmt.Errorf("vm.callBuiltin: %w", err)
+		}
+	default:
+		return newErrorf("not a function: %s", callee.Type())
+	}
+	return nil
+}
+
+// callClosure calls cl in a new frame. Extra arguments are ignored as the evaluator ignores them,
+// which leaves them in the slots of the other locals.
+func (vm *VM) callClosure(cl object.Closure, numArgs int) error {
+	if numArgs < cl.Fn.NumParameters {
+		return newErrorf("wrong number of arguments. got=%d, want=%d", numArgs, cl.Fn.NumParameters)
+	}
+	frame := NewFrame(cl, vm.sp-numArgs)
+	if err := vm.pushFrame(frame); err != nil {
+		return fmt.Errorf("vm.pushFrame: %w", err)
+	}
+	vm.growStack(frame.basePointer + cl.Fn.NumLocals)
+	vm.sp = frame.basePointer + cl.Fn.NumLocals
+	return nil
+}
+
+// executeTailCall calls a closure in the frame of the caller, whose instructions only return the value
+// of the call afterwards, so that tail-recursive loops run in constant stack space. Builtins are called
+// as usual.
+func (vm *VM) executeTailCall(numArgs int) error {
+	callee, ok := vm.stack[vm.sp-1-numArgs].(object.Closure)
+	if !ok || vm.framesIndex == 1 {
+		return vm.executeCall(numArgs)
+	}
+	if numArgs < callee.Fn.NumParameters {
+		return newErrorf("wrong number of arguments. got=%d, want=%d", numArgs, callee.Fn.NumParameters)
+	}
+	// the callee and the arguments replace the ones of the caller
+	basePointer := vm.currentFrame().basePointer
+	copy(vm.stack[basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.growStack(basePointer + callee.Fn.NumLocals)
+	vm.frames[vm.framesIndex-1] = NewFrame(callee, basePointer)
+	vm.sp = basePointer + callee.Fn.NumLocals
+	return nil
+}
+
+func (vm *VM) callBuiltin(fn object.Builtin, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp]
+	result := fn.Fn(vm.output, args...)
+	vm.sp = vm.sp - numArgs - 1
+	if err, ok := result.(object.Error); ok {
+		return err
+	}
+	if array, ok := result.(object.Array); ok && fn.Allocates {
+		if err := vm.allocate(len(array.Elements)); err != nil {
+			return fmt.Errorf("vm.allocate: %w", err)
+		}
+	}
+	if err := vm.push(result); err != nil {
+		return fmt.Errorf("vm.push: %w", err)
+	}
+	return nil
+}
+
+func (vm *VM) pushClosure(constIndex, numFree int) error {
+	fn, ok := vm.constants[constIndex].(object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %s", vm.constants[constIndex].Type())
+	}
+	free := make([]object.Object, numFree)
+	copy(free, vm.stack[vm.sp-numFree:vm.sp])
+	vm.sp -= numFree
+	if err := vm.push(object.Closure{Fn: fn, Free: free}); err != nil {
+		return fmt.Errorf("vm.push: %w", err)
+	}
+	return nil
+}
+
+// allocate counts n elements allocated by the program against the limit.
+func (vm *VM) allocate(n int) error {
+	vm.elements += int64(n)
+	if vm.limits.MaxElements > 0 && vm.elements > vm.limits.MaxElements {
+		return newErrorf("%w: %d elements", object.ErrAllocationLimit, vm.limits.MaxElements)
+	}
+	return nil
+}
+
+func (vm *VM) buildArray(start, end int) object.Array {
+	elements := make([]object.Object, end-start)
+	copy(elements, vm.stack[start:end])
+	return object.Array{Elements: elements}
+}
+
+func (vm *VM) buildHash(start, end int) (object.Hash, error) {
+	pairs := make(map[object.Hashable]object.Object, (end-start)/2)
+	for i := start; i < end; i += 2 {
+		key, value := vm.stack[i], vm.stack[i+1]
+		keyHashable, ok := key.(object.Hashable)
+		if !ok {
+			return object.Hash{}, newErrorf("%s cannot used as hash key", key.Type())
+		}
+		pairs[keyHashable] = value
+	}
+	return object.Hash{Pairs: pairs}, nil
+}
+
+func (vm *VM) executeIndexExpression() error {
+	index, err := vm.pop()
+	if err != nil {
+		return fmt.Errorf("vm.pop: %w", err)
+	}
+	left, err := vm.pop()
+	if err != nil {
+		return fmt.Errorf("vm.pop: %w", err)
+	}
+	switch {
+	case left.Type() == object.TypeArray && index.Type() == object.TypeInteger:
+		left, index := left.(object.Array), index.(object.Integer)
+		if index.Value < 0 || int64(len(left.Elements)) <= index.Value {
+			return newErrorf("index out of range. index=%d, len=%d", index.Value, len(left.Elements))
+		}
+		if err := vm.push(left.Elements[index.Value]); err != nil {
+			return fmt.Errorf("vm.push: %w", err)
+		}
+	case left.Type() == object.TypeHash:
+		left := left.(object.Hash)
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newErrorf("%s cannot used as hash key", index.Type())
+		}
+		val, ok := left.Pairs[key]
+		if !ok {
+			return newErrorf("key not found. key=%s", index.Inspect())
+		}
+		if err := vm.push(val); err != nil {
+			return fmt.Errorf("vm.push: %w", err)
+		}
+	default:
+		return newErrorf("type mismatch: %s[%s]", left.Type(), index.Type())
+	}
+	return nil
+}
+
 func booleanObject(value bool) object.Boolean {
 	switch value {
 	case true:
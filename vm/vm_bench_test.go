@@ -0,0 +1,79 @@
+package vm_test
+
+import (
+	"testing"
+
+	"github.com/Warashi/monkey/compiler"
+	"github.com/Warashi/monkey/lexer"
+	"github.com/Warashi/monkey/parser"
+	. "github.com/Warashi/monkey/testutil"
+	"github.com/Warashi/monkey/vm"
+	"github.com/stretchr/testify/require"
+)
+
+func compileBench(b *testing.B, input string) compiler.Bytecode {
+	b.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.Parse()
+	require.Empty(b, p.Errors())
+	c := compiler.New()
+	require.NoError(b, c.Compile(program))
+	return c.Bytecode()
+}
+
+func runBench(b *testing.B, bytecode compiler.Bytecode) {
+	b.Helper()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := vm.New(bytecode).Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFibonacci(b *testing.B) {
+	runBench(b, compileBench(b, `
+let fibonacci = fn(x) {
+	if (x < 2) { return x; }
+	fibonacci(x - 1) + fibonacci(x - 2)
+};
+fibonacci(20);`))
+}
+
+func BenchmarkLoop(b *testing.B) {
+	runBench(b, Assemble(b, `
+.constant 0 Integer 0
+.constant 1 Integer 1
+.constant 2 Integer 100000
+
+.main
+	OpConstant 0
+	OpSetGlobal 0
+loop:
+	OpConstant 2
+	OpGetGlobal 0
+	OpGreaterThan
+	OpJumpNotTruthy done
+	OpGetGlobal 0
+	OpConstant 1
+	OpAdd
+	OpSetGlobal 0
+	OpJump loop
+done:
+.end
+`))
+}
+
+func BenchmarkClosures(b *testing.B) {
+	runBench(b, compileBench(b, `
+let map = fn(arr, f) {
+	let iter = fn(arr, acc) {
+		if (len(arr) == 0) { acc } else { iter(rest(arr), push(acc, f(first(arr)))) }
+	};
+	iter(arr, [])
+};
+let double = fn(x) { x * 2 };
+let xs = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16];
+map(map(xs, double), fn(x) { {"x": x}["x"] });`))
+}
@@ -1,6 +1,9 @@
 package vm_test
 
 import (
+	"context"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/Warashi/monkey/compiler"
@@ -8,6 +11,7 @@ import (
 	"github.com/Warashi/monkey/object"
 	"github.com/Warashi/monkey/parser"
 	. "github.com/Warashi/monkey/testutil"
+	"github.com/Warashi/monkey/token"
 	"github.com/Warashi/monkey/vm"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -38,6 +42,10 @@ func TestIntegerArithmetric(t *testing.T) {
 		{"prefix-op/minus/-10", "-10", IntegerObject(-10)},
 		{"multi-calculation/7", "-50 + 100 + -50", IntegerObject(0)},
 		{"multi-calculation/8", "(5 + 10 * 2 + 15 / 3) * 2 + -10", IntegerObject(50)},
+		{"percent", "7 % 3", IntegerObject(1)},
+		{"percent/negative", "-7 % 3", IntegerObject(-1)},
+		{"multi-calculation/9", "1 + 7 % 3 * 2", IntegerObject(3)},
+		{"overflow/wrap", "9223372036854775807 + 1", IntegerObject(-9223372036854775808)},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -82,6 +90,11 @@ func TestBooleanExpressions(t *testing.T) {
 		{"prefix/bang/false", "!5", BooleanObject(false)},
 		{"prefix/bang/true", "!!5", BooleanObject(true)},
 		{"composite/if", "!(if (false) { 5; })", BooleanObject(true)},
+		{"eq/mixed", "1 == true", BooleanObject(false)},
+		{"neq/mixed", `"1" != 1`, BooleanObject(true)},
+		{"eq/array-and-integer", "[1] == 1", BooleanObject(false)},
+		{"neq/function-and-builtin", "fn(x) { x } != len", BooleanObject(true)},
+		{"eq/null", "if (false) { 1 } == if (false) { 2 }", BooleanObject(true)},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -110,6 +123,11 @@ func TestConditionals(t *testing.T) {
 		{"if-falseexp", "if (1 > 2) { 10 }", NullObject()},
 		{"if-trueexp-else", "if (1 < 2) { 10 } else { 20 }", IntegerObject(10)},
 		{"if-falseexp-else", "if (1 > 2) { 10 } else { 20 }", IntegerObject(20)},
+		{"let-in-branch", "let y = 2; if (y > 1) { let x = 1; }", IntegerObject(1)},
+		{"let-in-branch-then", "let y = 2; if (y > 1) { let x = 1; }; 5", IntegerObject(5)},
+		{"let-in-else", "let y = 2; if (y > 5) { 1 } else { let x = 1; }", IntegerObject(1)},
+		{"let-in-function-branch", "let f = fn(y) { if (y) { let z = 1; } }; [f(true), f(false)]", ArrayObject(IntegerObject(1), NullObject())},
+		{"empty-branch", "let y = 2; if (y > 1) { }", NullObject()},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -125,3 +143,855 @@ func TestConditionals(t *testing.T) {
 		})
 	}
 }
+
+// TestConstantFolding runs programs whose if expressions are folded by the compiler, and checks that
+// they have the same value as when not folded.
+func TestConstantFolding(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"if-true", "if (true) { 10 }"},
+		{"if-false", "if (false) { 10 }"},
+		{"if-false-else", "if (1 > 2) { 10 } else { 20 }"},
+		{"empty-branch", "if (true) { }"},
+		{"let-in-branch", "if (true) { let x = 1; }"},
+		{"let-in-else", "if (false) { 1 } else { let x = 1; }"},
+		{"let-in-branch-then", "if (true) { let x = 1; }; x"},
+		{"let-in-function-branch", "let f = fn() { if (1 < 2) { let z = 1; } }; f()"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			program := parser.New(lexer.New(tt.input)).Parse()
+
+			folded := compiler.New()
+			require.NoError(t, folded.Compile(program))
+			unfolded := compiler.New()
+			unfolded.DisableConstantFolding()
+			require.NoError(t, unfolded.Compile(program))
+
+			want := vm.New(unfolded.Bytecode())
+			require.NoError(t, want.Run())
+			got := vm.New(folded.Bytecode())
+			require.NoError(t, got.Run())
+
+			assert.Equal(t, want.LastPopedStackElem(), got.LastPopedStackElem())
+		})
+	}
+}
+
+func TestArithmeticErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		input   string
+		checked bool
+		want    error
+		message string
+	}{
+		{"division-by-zero", "let a = 0; 1 / a", false, object.ErrDivisionByZero, "division by zero: 1 / 0"},
+		{"modulo-by-zero", "let a = 0; 1 % a", false, object.ErrDivisionByZero, "division by zero: 1 % 0"},
+		{"folded/division-by-zero", "1 / 0", false, object.ErrDivisionByZero, "division by zero: 1 / 0"},
+		{"checked/plus", "9223372036854775807 + 1", true, object.ErrIntegerOverflow, "integer overflow: 9223372036854775807 + 1"},
+		{"checked/minus", "-9223372036854775807 - 2", true, object.ErrIntegerOverflow, "integer overflow: -9223372036854775807 - 2"},
+		{"checked/asterisk", "4611686018427387904 * 2", true, object.ErrIntegerOverflow, "integer overflow: 4611686018427387904 * 2"},
+		{"checked/slash", "(-9223372036854775807 - 1) / -1", true, object.ErrIntegerOverflow, "integer overflow: -9223372036854775808 / -1"},
+		{"checked/negation", "-(-9223372036854775807 - 1)", true, object.ErrIntegerOverflow, "integer overflow: -(-9223372036854775808)"},
+		{"checked/negation-of-global", "let m = -9223372036854775807 - 1; -m", true, object.ErrIntegerOverflow, "integer overflow: -(-9223372036854775808)"},
+		{"checked/slash-of-global", "let m = -9223372036854775807 - 1; m / -1", true, object.ErrIntegerOverflow, "integer overflow: -9223372036854775808 / -1"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			machine := vm.New(compiler.Bytecode())
+			if tt.checked {
+				machine.EnableCheckedArithmetic()
+			}
+			err := machine.Run()
+			assert.ErrorIs(t, err, tt.want)
+			var runtimeErr *vm.RuntimeError
+			require.ErrorAs(t, err, &runtimeErr)
+			assert.EqualError(t, runtimeErr.Err.Err, tt.message)
+		})
+	}
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	t.Parallel()
+	tests := []testcase{
+		{"single", "let one = 1; one", IntegerObject(1)},
+		{"multiple", "let one = 1; let two = 2; one + two", IntegerObject(3)},
+		{"rebind", "let one = 1; let two = one + one; one + two", IntegerObject(3)},
+		{"expression", "let x = 5; x * 2", IntegerObject(10)},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestGlobalLetStatementsErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"unset", "if (false) { let x = 1; }; x", "identifier not found: x"},
+		{"unset-operand", "if (false) { let x = 1; }; x + 1", "identifier not found: x"},
+		{"unset-in-function", "if (false) { let y = 1; }; let f = fn() { y }; f()", "identifier not found: y"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			assert.ErrorContains(t, vm.Run(), tt.want)
+		})
+	}
+}
+
+func TestStringExpressions(t *testing.T) {
+	t.Parallel()
+	tests := []testcase{
+		{"literal", `"monkey"`, StringObject("monkey")},
+		{"concat", `"mon" + "key"`, StringObject("monkey")},
+		{"concat/multi", `"mon" + "key" + "banana"`, StringObject("monkeybanana")},
+		{"concat/global", `let name = "monkey"; "hello, " + name + "!"`, StringObject("hello, monkey!")},
+		{"eq/true", `"monkey" == "monkey"`, BooleanObject(true)},
+		{"eq/false", `"monkey" == "banana"`, BooleanObject(false)},
+		{"neq/true", `"monkey" != "banana"`, BooleanObject(true)},
+		{"neq/false", `"monkey" != "monkey"`, BooleanObject(false)},
+		{"lt", `"a" < "b"`, BooleanObject(true)},
+		{"gt", `"a" > "b"`, BooleanObject(false)},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestStringUnsupportedOperator(t *testing.T) {
+	t.Parallel()
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(parser.New(lexer.New(`"monkey" - "key"`)).Parse()))
+
+	vm := vm.New(compiler.Bytecode())
+	assert.Error(t, vm.Run())
+}
+
+// TestOperatorErrors checks the messages of runtime errors, which are the ones of the evaluator.
+func TestOperatorErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"type-mismatch", "1 + true", "type mismatch: Integer + Boolean"},
+		{"unknown-operator", "true + false", "unknown operator: Boolean + Boolean"},
+		{"string", `"monkey" - "key"`, "unknown operator: String - String"},
+		{"comparison", "true > false", "unknown operator: Boolean > Boolean"},
+		{"equality", "[1] == [1]", "unknown operator: Array == Array"},
+		{"negation", "-true", "unknown operator: -Boolean"},
+		{"not-a-function", "let f = fn(x) { x(1) }; f(2)", "not a function: Integer"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			var runtimeErr *vm.RuntimeError
+			require.ErrorAs(t, vm.New(compiler.Bytecode()).Run(), &runtimeErr)
+			assert.EqualError(t, runtimeErr.Err.Err, tt.want)
+		})
+	}
+}
+
+func TestCompositeLiterals(t *testing.T) {
+	t.Parallel()
+	tests := []testcase{
+		{"array/empty", "[]", object.Array{Elements: []object.Object{}}},
+		{"array", "[1, 2, 3]", ArrayObject(IntegerObject(1), IntegerObject(2), IntegerObject(3))},
+		{"array/expression", "[1 + 2, 3 * 4, 5 + 6]", ArrayObject(IntegerObject(3), IntegerObject(12), IntegerObject(11))},
+		{"hash/empty", "{}", HashObject(map[object.Hashable]object.Object{})},
+		{"hash", "{1: 2, 2: 3}", HashObject(map[object.Hashable]object.Object{
+			IntegerObject(1): IntegerObject(2),
+			IntegerObject(2): IntegerObject(3),
+		})},
+		{"hash/expression", `{1 + 1: 2 * 2, "a" + "b": 6 - 3}`, HashObject(map[object.Hashable]object.Object{
+			IntegerObject(2):   IntegerObject(4),
+			StringObject("ab"): IntegerObject(3),
+		})},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestIndexExpressions(t *testing.T) {
+	t.Parallel()
+	tests := []testcase{
+		{"array", "[1, 2, 3][1]", IntegerObject(2)},
+		{"array/expression", "[1, 2, 3][0 + 2]", IntegerObject(3)},
+		{"array/nested", "[[1, 1, 1]][0][0]", IntegerObject(1)},
+		{"hash", "{1: 1, 2: 2}[1]", IntegerObject(1)},
+		{"hash/string", `{"one": 1, "two": 2}["t" + "wo"]`, IntegerObject(2)},
+		{"hash/global", `let m = {1: "ONE", "one": 1}; let k = m["one"]; m[k]`, StringObject("ONE")},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestIndexExpressionErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"array/out-of-range", "[1, 2, 3][3]", "index out of range. index=3, len=3"},
+		{"array/negative", "[1, 2, 3][-1]", "index out of range. index=-1, len=3"},
+		{"array/empty", "[][0]", "index out of range. index=0, len=0"},
+		{"hash/missing", "{1: 1}[0]", "key not found. key=0"},
+		{"hash/unhashable-key", "{1: 1}[[1]]", "Array cannot used as hash key"},
+		{"hash/unhashable-literal", "{[1]: 1}", "Array cannot used as hash key"},
+		{"type-mismatch", "1[0]", "type mismatch: Integer[Integer]"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			assert.ErrorContains(t, vm.Run(), tt.want)
+		})
+	}
+}
+
+func TestCallingFunctions(t *testing.T) {
+	t.Parallel()
+	tests := []testcase{
+		{"no-arguments", "let fivePlusTen = fn() { 5 + 10; }; fivePlusTen();", IntegerObject(15)},
+		{"multiple", "let one = fn() { 1; }; let two = fn() { 2; }; one() + two()", IntegerObject(3)},
+		{"nested", "let a = fn() { 1 }; let b = fn() { a() + 1 }; let c = fn() { b() + 1 }; c();", IntegerObject(3)},
+		{"early-return", "let earlyExit = fn() { return 99; 100; }; earlyExit();", IntegerObject(99)},
+		{"empty-body", "let noReturn = fn() { }; noReturn();", NullObject()},
+		{"let-at-end", "let lastLet = fn() { let x = 1; }; lastLet();", IntegerObject(1)},
+		{"first-class", "let returnsOne = fn() { 1; }; let returnsOneReturner = fn() { returnsOne; }; returnsOneReturner()();", IntegerObject(1)},
+		{"local", "let one = fn() { let one = 1; one }; one();", IntegerObject(1)},
+		{"locals", "let oneAndTwo = fn() { let one = 1; let two = 2; one + two; }; oneAndTwo();", IntegerObject(3)},
+		{"locals-and-globals", "let globalSeed = 50; let minusOne = fn() { let num = 1; globalSeed - num; }; let minusTwo = fn() { let num = 2; globalSeed - num; }; minusOne() + minusTwo();", IntegerObject(97)},
+		{"argument", "let identity = fn(a) { a; }; identity(4);", IntegerObject(4)},
+		{"arguments", "let sum = fn(a, b) { a + b; }; sum(1, 2);", IntegerObject(3)},
+		{"arguments-and-locals", "let sum = fn(a, b) { let c = a + b; c; }; sum(1, 2) + sum(3, 4);", IntegerObject(10)},
+		{"extra-arguments", "fn() { 1; }(1);", IntegerObject(1)},
+		{"extra-arguments-and-locals", "let sum = fn(a) { let b = 5; let c = a + b; c; }; sum(1, 2, 3, 4);", IntegerObject(6)},
+		{"extra-arguments-in-tail-call", "let f = fn(a, n) { if (n == 0) { a } else { f(a + 1, n - 1, 0) } }; f(0, 10);", IntegerObject(10)},
+		{"nested-arguments", "let sum = fn(a, b) { let c = a + b; c; }; let outer = fn() { sum(1, 2) + sum(3, 4); }; outer();", IntegerObject(10)},
+		{"top-level-return", "return 10; 9;", IntegerObject(10)},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	t.Parallel()
+	tests := []testcase{
+		{"count-down", "let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } }; countDown(100000)", IntegerObject(0)},
+		{"return", "let countDown = fn(x) { if (x == 0) { return 0; }; return countDown(x - 1); }; countDown(100000)", IntegerObject(0)},
+		{"mutual", "let even = fn(x, odd) { if (x == 0) { true } else { odd(x - 1, even) } }; let odd = fn(x, even) { if (x == 0) { false } else { even(x - 1, odd) } }; even(100001, odd)", BooleanObject(false)},
+		{"locals", "let f = fn(x, acc) { let next = acc + x; if (x == 0) { next } else { f(x - 1, next) } }; f(100000, 0)", IntegerObject(5000050000)},
+		{"closure", "let adder = fn(n) { fn(x) { x + n } }; let apply = fn(f, x) { f(x) }; apply(adder(1), 2)", IntegerObject(3)},
+		{"builtin", "let f = fn(x) { len(x) }; f([1, 2])", IntegerObject(2)},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestTailCallsOverLargeArray(t *testing.T) {
+	t.Parallel()
+	const n = 1000000
+	elements := make([]object.Object, n)
+	for i := range elements {
+		elements[i] = IntegerObject(int64(i + 1))
+	}
+	symbolTable := compiler.NewSymbolTable()
+	for i, b := range object.Builtins {
+		symbolTable.DefineBuiltin(i, b.Name)
+	}
+	globals := make([]object.Object, vm.GlobalsSize)
+	globals[symbolTable.Define("numbers").Index] = ArrayObject(elements...)
+
+	compiler := compiler.NewWithState(symbolTable, nil)
+	require.NoError(t, compiler.Compile(parser.New(lexer.New(`
+let sum = fn(xs, acc) {
+  if (len(xs) == 0) { return acc; }
+  sum(rest(xs), acc + first(xs))
+};
+sum(numbers, 0)`)).Parse()))
+
+	vm := vm.NewWithGlobalsStore(compiler.Bytecode(), globals)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, IntegerObject(n*(n+1)/2), vm.LastPopedStackElem())
+}
+
+func TestCallingFunctionsErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"too-few", "fn(a) { a; }();", "wrong number of arguments. got=0, want=1"},
+		{"not-a-function", "1();", "not a function: Integer"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			assert.ErrorContains(t, vm.Run(), tt.want)
+		})
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		want  token.Position
+	}{
+		{"infix", "1 + true", token.Position{Offset: 2, Line: 1, Column: 3}},
+		{"prefix", "let a = 1;\n-true", token.Position{Offset: 11, Line: 2, Column: 1}},
+		{"in-function", "let f = fn() {\n  true + false;\n};\nf();", token.Position{Offset: 22, Line: 2, Column: 8}},
+		{"index", "[1, 2][5]", token.Position{Offset: 6, Line: 1, Column: 7}},
+		{"call", "fn(a) { a; }();", token.Position{Offset: 12, Line: 1, Column: 13}},
+		{"same-function-elsewhere", "let f = fn() { fn() { 1 / 0 } }; let g = fn() { fn() { 1 / 0 } }; g()()", token.Position{Offset: 57, Line: 1, Column: 58}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			var posErr *token.Error
+			if assert.ErrorAs(t, vm.New(compiler.Bytecode()).Run(), &posErr) {
+				assert.Equal(t, tt.want, posErr.Pos)
+			}
+		})
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	t.Parallel()
+	input := `let add = fn(a, b) {
+  a + b
+};
+let twice = fn(x) { 0 + add(x, x) };
+let apply = fn(f) { 0 + fn() { 0 + f(true) }() };
+apply(twice);`
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(parser.New(lexer.New(input)).Parse()))
+
+	var re *vm.RuntimeError
+	require.ErrorAs(t, vm.New(compiler.Bytecode()).Run(), &re)
+
+	pos := func(offset, line, column int) token.Position {
+		return token.Position{Offset: offset, Line: line, Column: column}
+	}
+	want := []vm.StackFrame{
+		{Function: "add", Pos: pos(25, 2, 5)},
+		{Function: "twice", Pos: pos(59, 4, 28)},
+		{Function: "<anonymous>", Pos: pos(105, 5, 37)},
+		{Function: "apply", Pos: pos(113, 5, 45)},
+		{Function: vm.MainFunctionName, Pos: pos(124, 6, 6)},
+	}
+	assert.Equal(t, want, re.StackTrace)
+	assert.Equal(t, "\tat add (2:5)\n\tat twice (4:28)\n\tat <anonymous> (5:37)\n\tat apply (5:45)\n\tat <main> (6:6)", re.Trace())
+}
+
+func TestStackTraceTailCalls(t *testing.T) {
+	t.Parallel()
+	input := `let add = fn(a, b) {
+  a + b
+};
+let twice = fn(x) { add(x, x) };
+let apply = fn(f) { fn() { f(true) }() };
+apply(twice);`
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(parser.New(lexer.New(input)).Parse()))
+
+	var re *vm.RuntimeError
+	require.ErrorAs(t, vm.New(compiler.Bytecode()).Run(), &re)
+	assert.Equal(t, "\tat add (2:5)\n\tat <main> (6:6)", re.Trace(), "the frames of tail calls are replaced by those of the callees")
+}
+
+func TestStackTraceDeepRecursion(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "same-place",
+			input: "let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(5000)",
+			want:  []string{"\tat f (1:47) [1024 times]", "\tat <main> (1:61)"},
+		},
+		{
+			name:  "alternating",
+			input: "let f = fn(n, g) { 0 + g(n, f) }; let g = fn(n, f) { 0 + f(n + 1, g) }; f(0, g)",
+			want: []string{
+				"\tat g (1:59)", "\tat f (1:25)", "\tat g (1:59)", "\tat f (1:25)", "\tat g (1:59)",
+				"\tat f (1:25)", "\tat g (1:59)", "\tat f (1:25)", "\tat g (1:59)", "\tat f (1:25)",
+				"\t... 1005 more",
+				"\tat f (1:25)", "\tat g (1:59)", "\tat f (1:25)", "\tat g (1:59)", "\tat f (1:25)",
+				"\tat g (1:59)", "\tat f (1:25)", "\tat g (1:59)", "\tat f (1:25)", "\tat <main> (1:74)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			var re *vm.RuntimeError
+			require.ErrorAs(t, vm.New(compiler.Bytecode()).Run(), &re)
+			assert.Len(t, re.StackTrace, vm.MaxFrames+1, "the stack trace keeps every frame")
+			assert.Equal(t, strings.Join(tt.want, "\n"), re.Trace())
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	t.Parallel()
+	const countDown = "let countDown = fn(x) { if (x == 0) { 0 } else { 1 + countDown(x - 1) } };"
+	tests := []struct {
+		name   string
+		input  string
+		limits object.Limits
+		want   error
+	}{
+		{"steps", countDown + "countDown(10)", object.Limits{MaxSteps: 200}, nil},
+		{"steps/exceeded", countDown + "countDown(100)", object.Limits{MaxSteps: 200}, object.ErrStepLimit},
+		{"call-depth", countDown + "countDown(10)", object.Limits{MaxCallDepth: 11}, nil},
+		{"call-depth/exceeded", countDown + "countDown(10)", object.Limits{MaxCallDepth: 10}, object.ErrCallDepthLimit},
+		{"call-depth/default", countDown + "countDown(1023)", object.Limits{}, nil},
+		{"call-depth/default/exceeded", countDown + "countDown(1024)", object.Limits{}, object.ErrCallDepthLimit},
+		{"call-depth/above-default", countDown + "countDown(3000)", object.Limits{MaxCallDepth: 3001}, nil},
+		{"call-depth/unbounded", "let f = fn() { 1 + f() }; f()", object.Limits{}, object.ErrCallDepthLimit},
+		{"call-depth/stack", "let f = fn(a, b, c) { 1 + f(a, b, c) }; f(1, 2, 3)", object.Limits{}, object.ErrCallDepthLimit},
+		{"elements/array", "[1, 2]; [3, 4]", object.Limits{MaxElements: 4}, nil},
+		{"elements/array/exceeded", "[1, 2]; [3, 4, 5]", object.Limits{MaxElements: 4}, object.ErrAllocationLimit},
+		{"elements/hash/exceeded", "{1: 2, 3: 4}", object.Limits{MaxElements: 1}, object.ErrAllocationLimit},
+		{"elements/builtin/exceeded", "push([1, 2], 3)", object.Limits{MaxElements: 4}, object.ErrAllocationLimit},
+		{"elements/rest", "rest(rest(rest([1, 2, 3, 4])))", object.Limits{MaxElements: 4}, nil},
+		{"elements/rest-loop", "let sum = fn(a, acc) { if (len(a) == 0) { acc } else { sum(rest(a), acc + first(a)) } }; sum([1, 2, 3, 4, 5], 0)", object.Limits{MaxElements: 5}, nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			vm.SetLimits(tt.limits)
+			if err := vm.Run(); tt.want == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	t.Parallel()
+	input := "let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } }; countDown(1000)"
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(parser.New(lexer.New(input)).Parse()))
+
+	require.NoError(t, vm.New(compiler.Bytecode()).RunContext(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, vm.New(compiler.Bytecode()).RunContext(ctx), context.Canceled)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	var re *vm.RuntimeError
+	err := vm.New(compiler.Bytecode()).RunContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorAs(t, err, &re, "cancellation is reported where the program stopped")
+}
+
+func TestAssembledBytecode(t *testing.T) {
+	t.Parallel()
+	// a loop cannot be written in Monkey, but the VM can run one
+	bytecode := Assemble(t, `
+.constant 0 Integer 0
+.constant 1 Integer 1
+.constant 2 Integer 10
+
+.main
+	OpConstant 0
+	OpSetGlobal 0      ; i = 0
+	OpConstant 0
+	OpSetGlobal 1      ; sum = 0
+loop:
+	OpConstant 2
+	OpGetGlobal 0
+	OpGreaterThan      ; 10 > i
+	OpJumpNotTruthy done
+	OpGetGlobal 1
+	OpGetGlobal 0
+	OpAdd
+	OpSetGlobal 1      ; sum = sum + i
+	OpGetGlobal 0
+	OpConstant 1
+	OpAdd
+	OpSetGlobal 0      ; i = i + 1
+	OpJump loop
+done:
+	OpGetGlobal 1
+	OpPop
+.end
+`)
+	vm := vm.New(bytecode)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, IntegerObject(45), vm.LastPopedStackElem())
+}
+
+func TestWideOperands(t *testing.T) {
+	t.Parallel()
+	var b strings.Builder
+	b.WriteString("let t = true; let x = if (t) { ")
+	for i := 0; i <= 0x10000; i++ {
+		b.WriteString(strconv.Itoa(i))
+		b.WriteString("; ")
+	}
+	b.WriteString("} else { 0 }; if (!t) { 1 } else { x }")
+
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(parser.New(lexer.New(b.String())).Parse()))
+
+	vm := vm.New(compiler.Bytecode())
+	require.NoError(t, vm.Run())
+	assert.Equal(t, IntegerObject(0x10000), vm.LastPopedStackElem())
+}
+
+func TestWideClosure(t *testing.T) {
+	t.Parallel()
+	var b strings.Builder
+	for i := 0; i <= 0x10000; i++ {
+		b.WriteString(strconv.Itoa(i))
+		b.WriteString("; ")
+	}
+	b.WriteString("let a = 1; let f = fn(x) { fn() { a + x } }; f(2)()")
+
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(parser.New(lexer.New(b.String())).Parse()))
+	bytecode := compiler.Bytecode()
+	require.NoError(t, vm.Verify(bytecode))
+
+	vm := vm.New(bytecode)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, IntegerObject(3), vm.LastPopedStackElem())
+}
+
+func TestLargeLiterals(t *testing.T) {
+	t.Parallel()
+	elements := make([]string, 3*vm.StackSize/2)
+	pairs := make([]string, len(elements))
+	for i := range elements {
+		elements[i] = strconv.Itoa(i)
+		pairs[i] = strconv.Itoa(i) + ": " + strconv.Itoa(i)
+	}
+	n := len(elements)
+	tests := []testcase{
+		{"array", "len([" + strings.Join(elements, ", ") + "])", IntegerObject(int64(n))},
+		{"hash", "{" + strings.Join(pairs, ", ") + "}[" + strconv.Itoa(n-1) + "]", IntegerObject(int64(n - 1))},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestClosures(t *testing.T) {
+	t.Parallel()
+	tests := []testcase{
+		{"new-closure", "let newClosure = fn(a) { fn() { a; }; }; let closure = newClosure(99); closure();", IntegerObject(99)},
+		{"new-adder", "let newAdder = fn(a, b) { fn(c) { a + b + c }; }; let adder = newAdder(1, 2); adder(8);", IntegerObject(11)},
+		{"new-adder/local", "let newAdder = fn(a, b) { let c = a + b; fn(d) { c + d }; }; let adder = newAdder(1, 2); adder(8);", IntegerObject(11)},
+		{"nested", `
+let newAdderOuter = fn(a, b) {
+	let c = a + b;
+	fn(d) {
+		let e = d + c;
+		fn(f) { e + f; };
+	};
+};
+let newAdderInner = newAdderOuter(1, 2)
+let adder = newAdderInner(3);
+adder(8);
+`, IntegerObject(14)},
+		{"global-and-free", `
+let a = 1;
+let newAdderOuter = fn(b) {
+	fn(c) {
+		fn(d) { a + b + c + d };
+	};
+};
+let newAdderInner = newAdderOuter(2)
+let adder = newAdderInner(3);
+adder(8);
+`, IntegerObject(14)},
+		{"call-captured", `
+let newClosure = fn(a, b) {
+	let one = fn() { a; };
+	let two = fn() { b; };
+	fn() { one() + two(); };
+};
+let closure = newClosure(9, 90);
+closure();
+`, IntegerObject(99)},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestRecursiveClosures(t *testing.T) {
+	t.Parallel()
+	tests := []testcase{
+		{"global", `
+let countDown = fn(x) {
+	if (x == 0) {
+		return 0;
+	} else {
+		countDown(x - 1);
+	}
+};
+countDown(1);
+`, IntegerObject(0)},
+		{"local", `
+let wrapper = fn() {
+	let countDown = fn(x) {
+		if (x == 0) {
+			return 0;
+		} else {
+			countDown(x - 1);
+		}
+	};
+	countDown(1);
+};
+wrapper();
+`, IntegerObject(0)},
+		{"fibonacci", `
+let wrapper = fn() {
+	let fibonacci = fn(x) {
+		if (x == 0) {
+			return 0;
+		} else {
+			if (x == 1) {
+				return 1;
+			} else {
+				fibonacci(x - 1) + fibonacci(x - 2);
+			}
+		}
+	};
+	fibonacci(15);
+};
+wrapper();
+`, IntegerObject(610)},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	t.Parallel()
+	tests := []testcase{
+		{"len/empty-string", `len("")`, IntegerObject(0)},
+		{"len/string", `len("four")`, IntegerObject(4)},
+		{"len/array", `len([1, 2, 3])`, IntegerObject(3)},
+		{"len/empty-array", `len([])`, IntegerObject(0)},
+		{"first", `first([1, 2, 3])`, IntegerObject(1)},
+		{"first/empty", `first([])`, NullObject()},
+		{"last", `last([1, 2, 3])`, IntegerObject(3)},
+		{"last/empty", `last([])`, NullObject()},
+		{"rest", `rest([1, 2, 3])`, ArrayObject(IntegerObject(2), IntegerObject(3))},
+		{"rest/empty", `rest([])`, NullObject()},
+		{"push/empty", `push([], 1)`, ArrayObject(IntegerObject(1))},
+		{"push", `push([1], 2)`, ArrayObject(IntegerObject(1), IntegerObject(2))},
+		{"local", `let f = fn(a) { len(a) }; f([1, 2])`, IntegerObject(2)},
+		{"closure", `let map = fn(arr, f) { let iter = fn(arr, acc) { if (len(arr) == 0) { acc } else { iter(rest(arr), push(acc, f(first(arr)))) } }; iter(arr, []) }; map([1, 2, 3], fn(x) { x * 2 })`, ArrayObject(IntegerObject(2), IntegerObject(4), IntegerObject(6))},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			require.NoError(t, vm.Run())
+
+			assert.Equal(t, tt.want, vm.LastPopedStackElem())
+		})
+	}
+}
+
+func TestPuts(t *testing.T) {
+	t.Parallel()
+	compiler := compiler.New()
+	require.NoError(t, compiler.Compile(parser.New(lexer.New(`puts("a", 1); puts([2])`)).Parse()))
+
+	var out strings.Builder
+	vm := vm.New(compiler.Bytecode())
+	vm.SetOutput(&out)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, "a\n1\n[2]\n", out.String())
+	assert.Equal(t, NullObject(), vm.LastPopedStackElem())
+}
+
+func TestBuiltinFunctionsErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"len/unsupported", `len(1)`, "argument to `len` not supported, got Integer"},
+		{"len/arguments", `len("one", "two")`, "wrong number of arguments. got=2, want=1"},
+		{"first/unsupported", `first(1)`, "argument to `first` not supported, got Integer"},
+		{"last/unsupported", `last(1)`, "argument to `last` not supported, got Integer"},
+		{"push/unsupported", `push(1, 1)`, "argument to `push` must be Array, got Integer"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			compiler := compiler.New()
+			require.NoError(t, compiler.Compile(parser.New(lexer.New(tt.input)).Parse()))
+
+			vm := vm.New(compiler.Bytecode())
+			assert.ErrorContains(t, vm.Run(), tt.want)
+		})
+	}
+}